@@ -0,0 +1,436 @@
+package cytracker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Administrative JSON API, served on Tracker.AdminAddr:
+//
+//	GET    /torrents                        list torrents with scrape stats
+//	POST   /torrents                        register {"info_hash": hex, "name": name}
+//	GET    /torrents/<hash>                 single torrent
+//	DELETE /torrents/<hash>                 unregister
+//	GET    /torrents/<hash>/stats           transfer stats and hourly history,
+//	                                        ?since=<RFC 3339 time> limits history
+//	GET    /torrents/<hash>/peers           peer table
+//	DELETE /torrents/<hash>/peers/<key>     kick a peer
+//	POST   /torrents/<hash>/peers/<key>/ban kick a peer and ban the IP it
+//	                                        announces from
+//	GET    /bans                            banned IPs
+//	POST   /bans                            ban {"ip": ip}
+//	DELETE /bans/<ip>                       lift a ban
+//	GET    /metrics                         Prometheus metrics
+//
+// Info hashes and peer IDs are hex-encoded, peers are keyed by their peer ID
+// and IP address like "<peer id>@10.0.0.1". Every request except /metrics must
+// carry the header "Authorization: Bearer <Tracker.AdminToken>".
+
+type adminTorrent struct {
+	InfoHash   string `json:"info_hash"`
+	Name       string `json:"name"`
+	Auto       bool   `json:"auto"`
+	Complete   int    `json:"complete"`
+	Incomplete int    `json:"incomplete"`
+	Downloaded uint64 `json:"downloaded"`
+}
+
+type adminPeer struct {
+	Key        string    `json:"key"`
+	PeerID     string    `json:"peer_id"`
+	Addr       string    `json:"addr"`
+	AltAddr    string    `json:"alt_addr,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+	LastSeen   time.Time `json:"last_seen"`
+	Uploaded   uint64    `json:"uploaded"`
+	Downloaded uint64    `json:"downloaded"`
+	Left       uint64    `json:"left"`
+}
+
+type adminRegister struct {
+	InfoHash string `json:"info_hash"`
+	Name     string `json:"name"`
+}
+
+type adminBan struct {
+	IP string `json:"ip"`
+}
+
+// adminError is an error with an HTTP status
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+func newAdminError(status int, format string, a ...interface{}) error {
+	return &adminError{status: status, msg: fmt.Sprintf(format, a...)}
+}
+
+func newAdminTorrent(infoHash InfoHash, torrent *trackerTorrent) adminTorrent {
+	complete, incomplete := torrent.countPeers()
+	return adminTorrent{
+		InfoHash:   infoHash.String(),
+		Name:       torrent.name,
+		Auto:       torrent.auto,
+		Complete:   complete,
+		Incomplete: incomplete,
+		Downloaded: torrent.downloaded,
+	}
+}
+
+func newAdminPeer(key string, peer *trackerPeer) adminPeer {
+	p := adminPeer{
+		Key:        key,
+		PeerID:     peer.id.String(),
+		Addr:       peer.listenAddr.String(),
+		LastSeen:   peer.lastSeen,
+		Uploaded:   peer.uploaded,
+		Downloaded: peer.downloaded,
+		Left:       peer.left,
+	}
+	if peer.altAddr != nil {
+		p.AltAddr = peer.altAddr.String()
+	}
+	if peer.clientIP != nil {
+		p.ClientIP = peer.clientIP.String()
+	}
+	return p
+}
+
+func (t *Tracker) newAdminMux() *http.ServeMux {
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/metrics", t.handleMetrics)
+	serveMux.HandleFunc("/", t.handleAdmin)
+	return serveMux
+}
+
+func (t *Tracker) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	var (
+		status = http.StatusOK
+		result interface{}
+		err    error
+	)
+	header := r.Header.Get("Authorization")
+	token := strings.TrimPrefix(header, "Bearer ")
+	if blank(t.AdminToken) || !strings.HasPrefix(header, "Bearer ") || subtle.ConstantTimeCompare([]byte(token), []byte(t.AdminToken)) != 1 {
+		err = newAdminError(http.StatusUnauthorized, "Unauthorized")
+	} else {
+		status, result, err = t.routeAdmin(r)
+	}
+	if err != nil {
+		status = http.StatusInternalServerError
+		if e, ok := err.(*adminError); ok {
+			status = e.status
+		}
+		result = map[string]string{"error": err.Error()}
+		t.log.warn("admin request failed", Field{"method", r.Method}, Field{"path", r.URL.Path},
+			Field{fieldRemoteAddr, r.RemoteAddr}, errorField(err))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(result)
+}
+
+func (t *Tracker) routeAdmin(r *http.Request) (status int, result interface{}, err error) {
+	status = http.StatusOK
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	route := r.Method + " " + parts[0]
+	switch {
+	case route == "GET torrents" && len(parts) == 1:
+		result = t.adminTorrents()
+	case route == "POST torrents" && len(parts) == 1:
+		status = http.StatusCreated
+		result, err = t.adminRegister(r)
+	case route == "GET torrents" && len(parts) == 2:
+		result, err = t.adminTorrent(parts[1])
+	case route == "DELETE torrents" && len(parts) == 2:
+		result, err = t.adminUnregister(parts[1])
+	case route == "GET torrents" && len(parts) == 3 && parts[2] == "stats":
+		result, err = t.adminStats(parts[1], r.URL.Query().Get("since"))
+	case route == "GET torrents" && len(parts) == 3 && parts[2] == "peers":
+		result, err = t.adminPeers(parts[1])
+	case route == "DELETE torrents" && len(parts) == 4 && parts[2] == "peers":
+		result, err = t.adminKick(parts[1], parts[3])
+	case route == "POST torrents" && len(parts) == 5 && parts[2] == "peers" && parts[4] == "ban":
+		result, err = t.adminBanPeer(parts[1], parts[3])
+	case route == "GET bans" && len(parts) == 1:
+		result = t.Bans()
+	case route == "POST bans" && len(parts) == 1:
+		status = http.StatusCreated
+		result, err = t.adminBan(r)
+	case route == "DELETE bans" && len(parts) == 2:
+		result = adminBan{IP: parts[1]}
+		if err = t.Unban(parts[1]); err != nil {
+			err = newAdminError(http.StatusNotFound, "%v", err)
+		}
+	default:
+		err = newAdminError(http.StatusNotFound, "Not found")
+	}
+	return
+}
+
+func decodeInfoHash(s string) (infoHash InfoHash, err error) {
+	if infoHash, err = ParseInfoHash(s); err != nil {
+		err = newAdminError(http.StatusBadRequest, "%v", err)
+	}
+	return
+}
+
+func (t *Tracker) adminTorrents() (torrents []adminTorrent) {
+	torrents = []adminTorrent{}
+	t.torrents.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		defer torrent.m.RUnlock()
+		torrents = append(torrents, newAdminTorrent(infoHash, torrent))
+	})
+	sort.Slice(torrents, func(i, j int) bool { return torrents[i].InfoHash < torrents[j].InfoHash })
+	return
+}
+
+// adminGet returns the torrent with the hex-encoded info hash
+func (t *Tracker) adminGet(hexInfoHash string) (infoHash InfoHash, torrent *trackerTorrent, err error) {
+	if infoHash, err = decodeInfoHash(hexInfoHash); err != nil {
+		return
+	}
+	if torrent = t.torrents.get(infoHash); torrent == nil {
+		err = newAdminError(http.StatusNotFound, "Unknown torrent %v", hexInfoHash)
+	}
+	return
+}
+
+func (t *Tracker) adminTorrent(hexInfoHash string) (result adminTorrent, err error) {
+	infoHash, torrent, err := t.adminGet(hexInfoHash)
+	if err != nil {
+		return
+	}
+	torrent.m.RLock()
+	defer torrent.m.RUnlock()
+	result = newAdminTorrent(infoHash, torrent)
+	return
+}
+
+func (t *Tracker) adminRegister(r *http.Request) (result adminTorrent, err error) {
+	var request adminRegister
+	if err = json.NewDecoder(r.Body).Decode(&request); err != nil {
+		err = newAdminError(http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+	infoHash, err := decodeInfoHash(request.InfoHash)
+	if err != nil {
+		return
+	}
+	if err = t.Register(infoHash, request.Name); err != nil {
+		err = newAdminError(http.StatusConflict, "%v", err)
+		return
+	}
+	return t.adminTorrent(request.InfoHash)
+}
+
+func (t *Tracker) adminUnregister(hexInfoHash string) (result adminTorrent, err error) {
+	if result, err = t.adminTorrent(hexInfoHash); err != nil {
+		return
+	}
+	infoHash, _ := decodeInfoHash(hexInfoHash)
+	err = t.Unregister(infoHash)
+	return
+}
+
+// adminStats returns the stats of a torrent with the history buckets since
+// the RFC 3339 time since, if it is not empty
+func (t *Tracker) adminStats(hexInfoHash, since string) (result TorrentStats, err error) {
+	infoHash, err := decodeInfoHash(hexInfoHash)
+	if err != nil {
+		return
+	}
+	var start time.Time
+	if since != "" {
+		if start, err = time.Parse(time.RFC3339, since); err != nil {
+			err = newAdminError(http.StatusBadRequest, "Invalid since: %v", err)
+			return
+		}
+	}
+	if result, err = t.TorrentStats(infoHash); err != nil {
+		err = newAdminError(http.StatusNotFound, "%v", err)
+		return
+	}
+	result.History = result.historySince(start)
+	if result.History == nil {
+		result.History = []StatsBucket{}
+	}
+	return
+}
+
+func (t *Tracker) adminPeers(hexInfoHash string) (peers []adminPeer, err error) {
+	_, torrent, err := t.adminGet(hexInfoHash)
+	if err != nil {
+		return
+	}
+	torrent.m.RLock()
+	defer torrent.m.RUnlock()
+	peers = []adminPeer{}
+	for key, peer := range torrent.peers {
+		peers = append(peers, newAdminPeer(key, peer))
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Key < peers[j].Key })
+	return
+}
+
+// adminKick removes a peer from the peer table of a torrent
+func (t *Tracker) adminKick(hexInfoHash, key string) (result adminPeer, err error) {
+	infoHash, torrent, err := t.adminGet(hexInfoHash)
+	if err != nil {
+		return
+	}
+	peer, ok := t.torrents.kick(infoHash, torrent, key)
+	if !ok {
+		err = newAdminError(http.StatusNotFound, "Unknown peer %v", key)
+		return
+	}
+	return peer, nil
+}
+
+// adminBanPeer kicks a peer and bans the address its announces came from
+func (t *Tracker) adminBanPeer(hexInfoHash, key string) (result adminBan, err error) {
+	peer, err := t.adminKick(hexInfoHash, key)
+	if err != nil {
+		return
+	}
+	result.IP = peer.ClientIP
+	err = t.Ban(result.IP)
+	return
+}
+
+func (t *Tracker) adminBan(r *http.Request) (ban adminBan, err error) {
+	if err = json.NewDecoder(r.Body).Decode(&ban); err != nil {
+		err = newAdminError(http.StatusBadRequest, "Invalid request: %v", err)
+		return
+	}
+	if err = t.Ban(ban.IP); err != nil {
+		err = newAdminError(http.StatusBadRequest, "%v", err)
+	}
+	return
+}
+
+// Ban refuses announces from ip and removes its peers from all torrents
+func (t *Tracker) Ban(ip string) (err error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("Invalid IP address %#v", ip)
+	}
+	t.log.info("banning", Field{"ip", parsed.String()})
+	t.torrents.ban(parsed)
+	return
+}
+
+// Unban lifts the ban of ip
+func (t *Tracker) Unban(ip string) (err error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("Invalid IP address %#v", ip)
+	}
+	return t.torrents.unban(parsed)
+}
+
+// Bans returns the banned IPs
+func (t *Tracker) Bans() (bans []string) {
+	return t.torrents.bans()
+}
+
+// kick removes the peer with peerKey from torrent, which is tracked under
+// infoHash or linked to it
+func (t *trackerTorrents) kick(infoHash InfoHash, torrent *trackerTorrent, peerKey string) (result adminPeer, ok bool) {
+	torrent.m.Lock()
+	defer torrent.m.Unlock()
+	peer, ok := torrent.peers[peerKey]
+	if !ok {
+		return
+	}
+	result = newAdminPeer(peerKey, peer)
+	torrent.removePeer(peerKey)
+	// journaled so that replaying the announces doesn't bring the peer back
+	t.journal(JournalEntry{Op: JournalKick, Time: time.Now(), InfoHash: t.resolve(infoHash), PeerKey: peerKey}, &torrent.seq)
+	return
+}
+
+func (t *trackerTorrents) ban(ip net.IP) {
+	t.m.Lock()
+	t.banned[ip.String()] = true
+	t.journal(JournalEntry{Op: JournalBan, Time: time.Now(), IP: ip.String()}, &t.bansSeq)
+	t.m.Unlock()
+	t.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.Lock()
+		defer torrent.m.Unlock()
+		for key, peer := range torrent.peers {
+			if peer.hasIP(ip) {
+				torrent.removePeer(key)
+			}
+		}
+	})
+}
+
+func (t *trackerTorrents) unban(ip net.IP) error {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if !t.banned[ip.String()] {
+		return fmt.Errorf("%v is not banned", ip)
+	}
+	delete(t.banned, ip.String())
+	t.journal(JournalEntry{Op: JournalUnban, Time: time.Now(), IP: ip.String()}, &t.bansSeq)
+	return nil
+}
+
+// dropBanned removes the peers of banned IPs
+func (t *trackerTorrents) dropBanned() {
+	t.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.Lock()
+		defer torrent.m.Unlock()
+		for key, peer := range torrent.peers {
+			if t.checkBanned(peer.clientIP, peer.listenAddr, peer.altAddr) != nil {
+				torrent.removePeer(key)
+			}
+		}
+	})
+}
+
+// bans returns the banned IPs in order
+func (t *trackerTorrents) bans() []string {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return t.bannedIPs()
+}
+
+// bannedIPs returns the banned IPs in order, the caller must hold t.m
+func (t *trackerTorrents) bannedIPs() (bans []string) {
+	bans = []string{}
+	for ip := range t.banned {
+		bans = append(bans, ip)
+	}
+	sort.Strings(bans)
+	return
+}
+
+// checkBanned returns an error if the address the announce came from or any
+// listen address of the peer is banned. clientIP is nil if unknown.
+func (t *trackerTorrents) checkBanned(clientIP net.IP, addrs ...*net.TCPAddr) error {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	if clientIP != nil && t.banned[clientIP.String()] {
+		return failure{"banned", fmt.Errorf("Banned")}
+	}
+	for _, addr := range addrs {
+		if addr != nil && t.banned[addr.IP.String()] {
+			return failure{"banned", fmt.Errorf("Banned")}
+		}
+	}
+	return nil
+}
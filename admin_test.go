@@ -0,0 +1,138 @@
+package cytracker
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func adminRequest(tracker *Tracker, method, target, body string) (status int, result interface{}) {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	tracker.handleAdmin(w, r)
+	So(w.Header().Get("Content-Type"), ShouldEqual, "application/json")
+	So(json.Unmarshal(w.Body.Bytes(), &result), ShouldBeNil)
+	return w.Code, result
+}
+
+func TestAdmin(t *testing.T) {
+	Convey("Admin API", t, func() {
+		tracker := NewTracker()
+		tracker.AdminToken = "token"
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		hexInfoHash := hex.EncodeToString([]byte(infoHash))
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 0, 10, "started"))
+		seedKey := newPeerKey(testPeerID("seed"), net.ParseIP("10.0.0.1"))
+
+		Convey("Requires token", func() {
+			r := httptest.NewRequest("GET", "/torrents", nil)
+			r.Header.Set("Authorization", "Bearer wrong")
+			w := httptest.NewRecorder()
+			tracker.handleAdmin(w, r)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+
+			r.Header.Set("Authorization", "token")
+			w = httptest.NewRecorder()
+			tracker.handleAdmin(w, r)
+			So(w.Code, ShouldEqual, http.StatusUnauthorized)
+		})
+		Convey("Lists torrents", func() {
+			status, result := adminRequest(tracker, "GET", "/torrents", "")
+			So(status, ShouldEqual, http.StatusOK)
+			torrents := result.([]interface{})
+			So(torrents, ShouldHaveLength, 1)
+			torrent := torrents[0].(map[string]interface{})
+			So(torrent["info_hash"], ShouldEqual, hexInfoHash)
+			So(torrent["auto"], ShouldEqual, true)
+			So(torrent["complete"], ShouldEqual, 1)
+			So(torrent["incomplete"], ShouldEqual, 1)
+		})
+		Convey("Registers and unregisters torrents", func() {
+			other := hex.EncodeToString([]byte("abcdefghijabcdefghij"))
+			status, result := adminRequest(tracker, "POST", "/torrents", `{"info_hash":"`+other+`","name":"other"}`)
+			So(status, ShouldEqual, http.StatusCreated)
+			So(result.(map[string]interface{})["name"], ShouldEqual, "other")
+
+			status, _ = adminRequest(tracker, "POST", "/torrents", `{"info_hash":"`+other+`","name":"other"}`)
+			So(status, ShouldEqual, http.StatusConflict)
+
+			status, _ = adminRequest(tracker, "DELETE", "/torrents/"+other, "")
+			So(status, ShouldEqual, http.StatusOK)
+			status, _ = adminRequest(tracker, "GET", "/torrents/"+other, "")
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Rejects malformed info hashes", func() {
+			status, _ := adminRequest(tracker, "GET", "/torrents/xyz", "")
+			So(status, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Lists peers", func() {
+			status, result := adminRequest(tracker, "GET", "/torrents/"+hexInfoHash+"/peers", "")
+			So(status, ShouldEqual, http.StatusOK)
+			peers := result.([]interface{})
+			So(peers, ShouldHaveLength, 2)
+			So(peers[0].(map[string]interface{})["key"], ShouldEqual, newPeerKey(testPeerID("leech"), net.ParseIP("10.0.0.1")))
+			peer := peers[1].(map[string]interface{})
+			So(peer["key"], ShouldEqual, seedKey)
+			So(peer["peer_id"], ShouldEqual, testPeerID("seed").String())
+			So(peer["addr"], ShouldEqual, "10.0.0.1:7000")
+		})
+		Convey("Kicks peers", func() {
+			status, _ := adminRequest(tracker, "DELETE", "/torrents/"+hexInfoHash+"/peers/"+seedKey, "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(tracker.torrents.get(testInfoHash(infoHash)).peers, ShouldHaveLength, 1)
+			status, _ = adminRequest(tracker, "DELETE", "/torrents/"+hexInfoHash+"/peers/"+seedKey, "")
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Bans peers", func() {
+			status, result := adminRequest(tracker, "POST", "/torrents/"+hexInfoHash+"/peers/"+seedKey+"/ban", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(result.(map[string]interface{})["ip"], ShouldEqual, "10.0.0.1")
+			So(tracker.torrents.get(testInfoHash(infoHash)).peers, ShouldBeEmpty)
+			So(tracker.Bans(), ShouldResemble, []string{"10.0.0.1"})
+
+			response := get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, ""))
+			So(response["failure reason"], ShouldEqual, "Banned")
+			response = get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "")+"&ip=10.0.0.9")
+			So(response["failure reason"], ShouldEqual, "Banned")
+
+			Convey("Lifts bans", func() {
+				status, _ := adminRequest(tracker, "DELETE", "/bans/10.0.0.1", "")
+				So(status, ShouldEqual, http.StatusOK)
+				response := get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, ""))
+				So(response, ShouldNotContainKey, "failure reason")
+			})
+		})
+		Convey("Bans the address peers announce from", func() {
+			get(mux, "/announce?"+announceQuery(infoHash, "spoofer", 7002, 0, 0, 10, "started")+"&ip=10.0.0.9")
+			spooferKey := newPeerKey(testPeerID("spoofer"), net.ParseIP("10.0.0.9"))
+			_, result := adminRequest(tracker, "GET", "/torrents/"+hexInfoHash+"/peers", "")
+			So(result.([]interface{})[2].(map[string]interface{})["client_ip"], ShouldEqual, "10.0.0.1")
+
+			status, result := adminRequest(tracker, "POST", "/torrents/"+hexInfoHash+"/peers/"+spooferKey+"/ban", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(result.(map[string]interface{})["ip"], ShouldEqual, "10.0.0.1")
+			So(tracker.Bans(), ShouldResemble, []string{"10.0.0.1"})
+		})
+		Convey("Bans IPs", func() {
+			status, _ := adminRequest(tracker, "POST", "/bans", `{"ip":"10.0.0.2"}`)
+			So(status, ShouldEqual, http.StatusCreated)
+			status, result := adminRequest(tracker, "GET", "/bans", "")
+			So(result, ShouldResemble, []interface{}{"10.0.0.2"})
+			status, _ = adminRequest(tracker, "POST", "/bans", `{"ip":"nonsense"}`)
+			So(status, ShouldEqual, http.StatusBadRequest)
+		})
+		Convey("Unknown routes", func() {
+			status, _ := adminRequest(tracker, "GET", "/nothing", "")
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+	})
+}
@@ -3,20 +3,22 @@ package cytracker
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
 type announceParams struct {
-	infoHash   string
-	peerID     string
+	infoHash   InfoHash
+	peerID     PeerID
 	ip         string // optional
+	ipv4       string // optional, BEP 7
+	ipv6       string // optional, BEP 7
 	port       int
 	uploaded   uint64
 	downloaded uint64
@@ -26,6 +28,12 @@ type announceParams struct {
 	event      string
 	numWant    int
 	trackerID  string
+	key        string // optional, proves the identity of a peer across IP changes
+	passkey    string // private tracker only
+	// limits rate limit the peer, set by the tracker and nil when replaying
+	limits *Limits
+	// clientIP is the address the announce came from, nil if unknown
+	clientIP net.IP
 }
 
 type Values struct {
@@ -85,6 +93,8 @@ func getUint(v url.Values, key string) (i int, err error) {
 const (
 	paramInfoHash   = "info_hash"
 	paramIP         = "ip"
+	paramIPv4       = "ipv4"
+	paramIPv6       = "ipv6"
 	paramPeerID     = "peer_id"
 	paramPort       = "port"
 	paramUploaded   = "uploaded"
@@ -95,16 +105,23 @@ const (
 	paramEvent      = "event"
 	paramNumberWant = "numwant"
 	paramTrackerID  = "trackerid"
+	paramKey        = "key"
+
+	// maxKeyLength is the longest key= accepted
+	maxKeyLength = 64
 )
 
 func (a *announceParams) parse(u *url.URL) (err error) {
 	q := Values{u.Query()}
-	a.infoHash = q.Get(paramInfoHash)
-	if blank(a.infoHash) {
-		return fmt.Errorf("Missing info_hash")
+	if a.infoHash, err = NewInfoHash(q.Get(paramInfoHash)); err != nil {
+		return
+	}
+	if a.peerID, err = NewPeerID(q.Get(paramPeerID)); err != nil {
+		return
 	}
 	a.ip = q.Get(paramIP)
-	a.peerID = q.Get(paramPeerID)
+	a.ipv4 = q.Get(paramIPv4)
+	a.ipv6 = q.Get(paramIPv6)
 	a.port, err = q.GetInt(paramPort)
 	if err != nil {
 		return
@@ -141,24 +158,76 @@ func (a *announceParams) parse(u *url.URL) (err error) {
 	}
 	a.event = q.Get(paramEvent)
 	a.trackerID = q.Get(paramTrackerID)
+	a.key = q.Get(paramKey)
+	if len(a.key) > maxKeyLength {
+		err = failure{"invalid_key", fmt.Errorf("Invalid key: longer than %d bytes", maxKeyLength)}
+	}
 	return
 }
 
-func newTrackerPeerListenAddress(requestRemoteAddr string, params *announceParams) (addr *net.TCPAddr, err error) {
+// newTrackerPeerListenAddress returns the listen address of the client at
+// remoteIP, or at the address it announced
+func newTrackerPeerListenAddress(remoteIP net.IP, params *announceParams) (addr *net.TCPAddr, err error) {
 	var host string
 	if !blank(params.ip) {
 		host = params.ip
+	} else if remoteIP != nil {
+		host = remoteIP.String()
 	} else {
-		host, _, err = net.SplitHostPort(requestRemoteAddr)
-		if err != nil {
+		err = fmt.Errorf("Unknown client address")
+		return
+	}
+	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(params.port)))
+}
+
+// newTrackerPeerAltAddress returns the listen address of the other IP family
+// announced with the ipv4= or ipv6= parameter, or nil if there is none
+func newTrackerPeerAltAddress(listenAddr *net.TCPAddr, params *announceParams) (addr *net.TCPAddr, err error) {
+	if listenAddr.IP.To4() != nil {
+		if blank(params.ipv6) {
+			return
+		}
+		addr, err = parseEndpoint(params.ipv6, params.port)
+		if err == nil && addr.IP.To4() != nil {
+			err = fmt.Errorf("Not an IPv6 address: %#v", params.ipv6)
+		}
+	} else {
+		if blank(params.ipv4) {
 			return
 		}
+		addr, err = parseEndpoint(params.ipv4, params.port)
+		if err == nil && addr.IP.To4() == nil {
+			err = fmt.Errorf("Not an IPv4 address: %#v", params.ipv4)
+		}
 	}
-	return net.ResolveTCPAddr("tcp", net.JoinHostPort(host, strconv.Itoa(params.port)))
+	if err != nil {
+		addr = nil
+	}
+	return
+}
+
+// parseEndpoint parses either a bare IP address or an address with port
+func parseEndpoint(s string, defaultPort int) (addr *net.TCPAddr, err error) {
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return &net.TCPAddr{IP: ip, Port: defaultPort}, nil
+	}
+	var host, port string
+	host, port, err = net.SplitHostPort(s)
+	if err != nil {
+		return
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		err = fmt.Errorf("Invalid IP address: %#v", host)
+		return
+	}
+	addr = &net.TCPAddr{IP: ip}
+	addr.Port, err = strconv.Atoi(port)
+	return
 }
 
 func (t *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
-	log.Println("Handling announce")
+	start := time.Now()
 	w.Header().Set("Content-Type", "text/plain")
 	var (
 		params            announceParams
@@ -167,27 +236,46 @@ func (t *Tracker) handleAnnounce(w http.ResponseWriter, r *http.Request) {
 		b                 bytes.Buffer
 		response          = make(bmap)
 	)
-	err = params.parse(r.URL)
+	limits := t.limits()
+	clientIP := t.clientIP(r)
+	err = t.checkAnnounceRate(clientIP, start, limits)
+	if err == nil {
+		err = params.parse(r.URL)
+	}
+	if err == nil && t.Users != nil {
+		params.passkey, err = t.authenticate(r.URL.Path)
+	}
 	if err == nil {
 		if params.trackerID != "" && params.trackerID != t.ID {
-			err = fmt.Errorf("Incorrect tracker ID: %#v", params.trackerID)
+			err = failure{"tracker_id", fmt.Errorf("Incorrect tracker ID: %#v", params.trackerID)}
 		}
 	}
 	if err == nil {
-		peerListenAddress, err = newTrackerPeerListenAddress(r.RemoteAddr, &params)
+		t.applyClientIPPolicy(&params)
+		peerListenAddress, err = newTrackerPeerListenAddress(clientIP, &params)
 	}
 	if err == nil {
+		var delta transfer
 		now := time.Now()
-		t.m.Lock()
-		err = t.torrents.handleAnnounce(now, peerListenAddress, &params, response)
-		t.m.Unlock()
+		params.numWant = limits.numWant(params.numWant)
+		params.limits = &limits
+		params.clientIP = clientIP
+		delta, err = t.torrents.handleAnnounce(now, peerListenAddress, &params, response)
 		if err == nil {
-			response["interval"] = int64(30 * 60)
+			response["interval"] = int64(limits.announceInterval() / time.Second)
+			if limits.MinInterval > 0 {
+				response["min interval"] = int64(limits.MinInterval / time.Second)
+			}
 			response["tracker id"] = t.ID
+			if t.Users != nil {
+				t.account(params.passkey, delta)
+			}
 		}
 	}
+	t.metrics.announced(start, params.event, err)
 	if err != nil {
-		log.Printf("announce from %v failed: %#v", r.RemoteAddr, err.Error())
+		t.log.info("announce failed", Field{fieldRemoteAddr, r.RemoteAddr}, Field{"client_ip", clientIP.String()}, infoHashField(params.infoHash),
+			Field{fieldEvent, params.event}, errorField(err))
 		errorResponse := make(bmap)
 		errorResponse["failure reason"] = err.Error()
 		err = bencode.Marshal(&b, errorResponse)
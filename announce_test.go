@@ -1,6 +1,7 @@
 package cytracker
 
 import (
+	"net"
 	"testing"
 
 	. "github.com/smartystreets/goconvey/convey"
@@ -83,3 +84,44 @@ func TestParsing(t *testing.T) {
 		})
 	})
 }
+
+func TestAltAddress(t *testing.T) {
+	Convey("Alternate address from ipv4/ipv6 parameters", t, func() {
+		v4 := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 7000}
+		v6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 7000}
+		Convey("IPv6 for IPv4 peer", func() {
+			params := &announceParams{port: 7000, ipv6: "2001:db8::2"}
+			addr, err := newTrackerPeerAltAddress(v4, params)
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::2]:7000")
+		})
+		Convey("IPv6 with port", func() {
+			params := &announceParams{port: 7000, ipv6: "[2001:db8::2]:7001"}
+			addr, err := newTrackerPeerAltAddress(v4, params)
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::2]:7001")
+		})
+		Convey("IPv4 for IPv6 peer", func() {
+			params := &announceParams{port: 7000, ipv4: "10.0.0.2:7002"}
+			addr, err := newTrackerPeerAltAddress(v6, params)
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "10.0.0.2:7002")
+		})
+		Convey("Same family is ignored", func() {
+			params := &announceParams{port: 7000, ipv4: "10.0.0.2"}
+			addr, err := newTrackerPeerAltAddress(v4, params)
+			So(err, ShouldBeNil)
+			So(addr, ShouldBeNil)
+		})
+		Convey("Wrong family", func() {
+			params := &announceParams{port: 7000, ipv6: "10.0.0.2"}
+			_, err := newTrackerPeerAltAddress(v4, params)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Garbage", func() {
+			params := &announceParams{port: 7000, ipv6: "not an address"}
+			_, err := newTrackerPeerAltAddress(v4, params)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
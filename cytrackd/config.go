@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/cydev/cytracker"
+)
+
+// config is the configuration of cytrackd, read from a JSON file and
+// overridden by flags. Example:
+//
+//	{
+//		"addr": ":8080",
+//		"udp_addr": ":8080",
+//		"announce": "/announce",
+//		"interval": "30m",
+//		"min_interval": "5m",
+//		"announce_rate": 1,
+//		"policy": "whitelist",
+//		"trusted_proxies": ["127.0.0.1"],
+//		"client_ip": "private",
+//		"tls_cert": "/etc/cytrackd/cert.pem",
+//		"tls_key": "/etc/cytrackd/key.pem",
+//		"full_scrape": "cached",
+//		"storage": "file",
+//		"state": "/var/lib/cytrackd",
+//		"torrents": ["/srv/torrents/a.torrent"],
+//		"torrent_dir": "/srv/releases",
+//		"webhook_url": "https://releases.example.com/hooks/tracker",
+//		"webhook_events": ["completed", "registered"]
+//	}
+type config struct {
+	Addr               string   `json:"addr"`
+	UDPAddr            string   `json:"udp_addr"`
+	AdminAddr          string   `json:"admin_addr"`
+	Announce           string   `json:"announce"`
+	ID                 string   `json:"tracker_id"`
+	Interval           duration `json:"interval"`
+	MinInterval        duration `json:"min_interval"`
+	PeerTTL            duration `json:"peer_ttl"`
+	NumWant            int      `json:"numwant"`
+	MaxNumWant         int      `json:"max_numwant"`
+	PeerSelection      string   `json:"peer_selection"`
+	ASNTable           string   `json:"asn_table"`
+	ScrapeInterval     duration `json:"scrape_interval"`
+	MaxScrapeHashes    int      `json:"max_scrape_hashes"`
+	FullScrape         string   `json:"full_scrape"`
+	FullScrapeInterval duration `json:"full_scrape_interval"`
+	AnnounceRate       float64  `json:"announce_rate"`
+	AnnounceBurst      int      `json:"announce_burst"`
+	PeerAnnounceBurst  int      `json:"peer_announce_burst"`
+	CacheEarly         bool     `json:"cache_early_announces"`
+	TrustedProxies     list     `json:"trusted_proxies"`
+	ProxyProtocol      bool     `json:"proxy_protocol"`
+	ClientIP           string   `json:"client_ip"`
+	TLSCert            string   `json:"tls_cert"`
+	TLSKey             string   `json:"tls_key"`
+	TLSClientCA        string   `json:"tls_client_ca"`
+	Shutdown           duration `json:"shutdown_timeout"`
+	Policy             string   `json:"policy"`
+	Blacklist          list     `json:"blacklist"`
+	Storage            string   `json:"storage"`
+	StateDir           string   `json:"state"`
+	LogLevel           string   `json:"log_level"`
+	LogJSON            bool     `json:"log_json"`
+	Torrents           []string `json:"torrents"`
+	TorrentDir         string   `json:"torrent_dir"`
+	TorrentDirInterval duration `json:"torrent_dir_interval"`
+	WebhookURL         string   `json:"webhook_url"`
+	WebhookEvents      list     `json:"webhook_events"`
+	WebhookQueue       int      `json:"webhook_queue"`
+	WebhookRetries     int      `json:"webhook_retries"`
+	WebhookTimeout     duration `json:"webhook_timeout"`
+}
+
+const (
+	storageMemory = "memory"
+	storageFile   = "file"
+)
+
+func defaultConfig() config {
+	return config{
+		Addr:           ":8080",
+		Announce:       "/announce",
+		Policy:         cytracker.PolicyOpen.String(),
+		ClientIP:       cytracker.ClientIPPrivate.String(),
+		FullScrape:     cytracker.FullScrapeOn.String(),
+		PeerSelection:  cytracker.PeerSelectionRandom.String(),
+		LogLevel:       cytracker.LevelInfo.String(),
+		WebhookRetries: defaultWebhookRetries,
+	}
+}
+
+// duration is a time.Duration written as a string like "30m" in JSON
+type duration time.Duration
+
+func (d duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *duration) Set(s string) error {
+	parsed, err := time.ParseDuration(s)
+	*d = duration(parsed)
+	return err
+}
+
+func (d *duration) UnmarshalJSON(b []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(b, &s); err != nil {
+		return
+	}
+	return d.Set(s)
+}
+
+// list is a list of strings separated by commas in flags
+type list []string
+
+func (l list) String() string {
+	return strings.Join(l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = nil
+	if s != "" {
+		*l = strings.Split(s, ",")
+	}
+	return nil
+}
+
+// parseConfig reads the configuration from args and the config file they name.
+// Flags take precedence over the file, arguments are torrent files.
+func parseConfig(args []string, output io.Writer) (c config, err error) {
+	c = defaultConfig()
+	fs := flag.NewFlagSet("cytrackd", flag.ContinueOnError)
+	fs.SetOutput(output)
+	file := fs.String("config", "", "JSON config file, flags override its settings")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "Address of the HTTP tracker")
+	fs.StringVar(&c.UDPAddr, "udp", c.UDPAddr, "Address of the UDP tracker, disabled if blank")
+	fs.StringVar(&c.AdminAddr, "admin", c.AdminAddr, "Address of the admin API, the token is read from $CYTRACKD_ADMIN_TOKEN")
+	fs.StringVar(&c.Announce, "announce", c.Announce, "Announce path")
+	fs.StringVar(&c.ID, "id", c.ID, "Tracker ID, random if blank")
+	fs.Var(&c.Interval, "interval", "Announce interval, 30m if zero")
+	fs.Var(&c.MinInterval, "min-interval", "Minimum announce interval, not sent if zero")
+	fs.Var(&c.PeerTTL, "peer-ttl", "How long peers are kept after their last announce, twice the interval if zero")
+	fs.IntVar(&c.NumWant, "numwant", c.NumWant, "Peers sent to clients that don't ask for a number, 50 if zero")
+	fs.IntVar(&c.MaxNumWant, "max-numwant", c.MaxNumWant, "Most peers sent to a client, -numwant if zero")
+	fs.StringVar(&c.PeerSelection, "peer-selection", c.PeerSelection, "Peers sent to clients: random, leechers-for-seeds, locality (same subnet, then same -asn-table AS) or freshest")
+	fs.StringVar(&c.ASNTable, "asn-table", c.ASNTable, "File of lines of a network and its AS number for -peer-selection locality")
+	fs.Var(&c.ScrapeInterval, "scrape-interval", "Minimum scrape interval sent to clients, -interval if zero")
+	fs.IntVar(&c.MaxScrapeHashes, "max-scrape-hashes", c.MaxScrapeHashes, "Most info hashes answered in a scrape, 74 if zero")
+	fs.StringVar(&c.FullScrape, "full-scrape", c.FullScrape, "Scrapes without info hashes: on, off, limited (one per -full-scrape-interval) or cached")
+	fs.Var(&c.FullScrapeInterval, "full-scrape-interval", "How often a limited full scrape is answered or a cached one refreshed, 1m if zero")
+	fs.Float64Var(&c.AnnounceRate, "announce-rate", c.AnnounceRate, "Announces per second an IP address may send on average, not limited if zero")
+	fs.IntVar(&c.AnnounceBurst, "announce-burst", c.AnnounceBurst, "Announces an IP address may send at once, 10 if zero")
+	fs.IntVar(&c.PeerAnnounceBurst, "peer-announce-burst", c.PeerAnnounceBurst, "Regular announces a peer may send at once before -min-interval applies, 1 if zero")
+	fs.BoolVar(&c.CacheEarly, "cache-early-announces", c.CacheEarly, "Answer announces sooner than -min-interval with the previous response instead of a failure")
+	fs.Var(&c.TrustedProxies, "trusted-proxies", "Comma separated addresses and networks of reverse proxies whose X-Forwarded-For and X-Real-IP headers are used")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", c.ProxyProtocol, "Read a PROXY protocol header on connections from -trusted-proxies")
+	fs.StringVar(&c.ClientIP, "client-ip", c.ClientIP, "When the ip= address of clients is used: always, never or private (private addresses only). always is how older versions behaved")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "Certificate file of HTTPS, read again on SIGHUP and when it changes")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "Key file of -tls-cert")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "CA certificates file, HTTPS clients must present a certificate signed by one of them")
+	fs.Var(&c.Shutdown, "shutdown-timeout", "How long in-flight requests may take on SIGINT or SIGTERM, 10s if zero")
+	fs.StringVar(&c.Policy, "policy", c.Policy, "Access policy: open, whitelist (only the given torrent files) or blacklist (all but -blacklist)")
+	fs.Var(&c.Blacklist, "blacklist", "Comma separated hex info hashes refused with -policy blacklist, set again on SIGHUP")
+	fs.StringVar(&c.Storage, "storage", c.Storage, "Storage of swarm state: memory or file, file if -state is set")
+	fs.StringVar(&c.StateDir, "state", c.StateDir, "Directory to keep swarm state in with -storage file")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Minimum level of logged messages: debug, info, warn or error")
+	fs.BoolVar(&c.LogJSON, "log-json", c.LogJSON, "Log JSON objects instead of text lines")
+	fs.StringVar(&c.TorrentDir, "torrent-dir", c.TorrentDir, "Directory whose .torrent files are registered and unregistered as they come and go")
+	fs.Var(&c.TorrentDirInterval, "torrent-dir-interval", "How often -torrent-dir is scanned, 10s if zero")
+	fs.StringVar(&c.WebhookURL, "webhook", c.WebhookURL, "URL that swarm events are posted to as JSON, disabled if blank")
+	fs.Var(&c.WebhookEvents, "webhook-events", "Comma separated events posted to -webhook: started, completed, stopped, reaped, registered and unregistered, all if blank")
+	fs.IntVar(&c.WebhookQueue, "webhook-queue", c.WebhookQueue, "Events waiting to be posted to -webhook before more are dropped, 1000 if zero")
+	fs.IntVar(&c.WebhookRetries, "webhook-retries", c.WebhookRetries, "How often a failed post to -webhook is retried")
+	fs.Var(&c.WebhookTimeout, "webhook-timeout", "How long a post to -webhook may take, 10s if zero")
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+	if *file != "" {
+		// the flags are bound to c, so set flags are applied again over the file
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = f.Value.String() })
+		if c, err = readConfig(*file); err != nil {
+			return
+		}
+		for name, value := range set {
+			if err = fs.Set(name, value); err != nil {
+				return
+			}
+		}
+	}
+	c.Torrents = append(c.Torrents, fs.Args()...)
+	return
+}
+
+func readConfig(name string) (c config, err error) {
+	c = defaultConfig()
+	f, err := os.Open(name)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err = d.Decode(&c); err != nil {
+		err = fmt.Errorf("Invalid config file %v: %v", name, err)
+	}
+	return
+}
+
+// newTracker creates the tracker described by c and its logger, it returns an
+// error if c is invalid
+func (c config) newTracker() (t *cytracker.Tracker, logger cytracker.Logger, err error) {
+	level, err := cytracker.ParseLevel(c.LogLevel)
+	if err != nil {
+		return
+	}
+	if c.LogJSON {
+		logger = cytracker.NewJSONLogger(os.Stderr, level)
+	} else {
+		logger = cytracker.NewTextLogger(os.Stderr, level)
+	}
+	policy, blacklist, err := c.policy()
+	if err != nil {
+		return
+	}
+	clientIP, err := cytracker.ParseClientIPPolicy(c.ClientIP)
+	if err != nil {
+		return
+	}
+	trustedProxies, err := cytracker.ParseNetworks(c.TrustedProxies)
+	if err != nil {
+		return
+	}
+	t = cytracker.NewTracker()
+	t.SetLogger(logger)
+	t.Addr = c.Addr
+	t.UDPAddr = c.UDPAddr
+	t.AdminAddr = c.AdminAddr
+	t.AdminToken = os.Getenv("CYTRACKD_ADMIN_TOKEN")
+	t.Announce = c.Announce
+	t.ID = c.ID
+	if t.Limits, err = c.limits(); err != nil {
+		return
+	}
+	t.TrustedProxies = trustedProxies
+	t.ProxyProtocol = c.ProxyProtocol
+	t.ClientIP = clientIP
+	t.TLSCertFile, t.TLSKeyFile, t.TLSClientCAFile = c.TLSCert, c.TLSKey, c.TLSClientCA
+	t.ShutdownTimeout = time.Duration(c.Shutdown)
+	t.TorrentDir = c.TorrentDir
+	t.TorrentDirInterval = time.Duration(c.TorrentDirInterval)
+	t.SetPolicy(policy)
+	t.SetBlacklist(blacklist)
+	if err = t.Validate(); err != nil {
+		return
+	}
+	storage := c.Storage
+	if storage == "" {
+		storage = storageMemory
+		if c.StateDir != "" {
+			storage = storageFile
+		}
+	}
+	switch storage {
+	case storageMemory:
+		if c.StateDir != "" {
+			err = fmt.Errorf("State directory %v requires file storage", c.StateDir)
+		}
+	case storageFile:
+		if c.StateDir == "" {
+			err = fmt.Errorf("File storage requires a state directory")
+			return
+		}
+		var s *cytracker.FileStorage
+		if s, err = cytracker.NewFileStorage(c.StateDir); err == nil {
+			s.Logger = logger
+			t.Storage = s
+		}
+	default:
+		err = fmt.Errorf("Unknown storage %#v", c.Storage)
+	}
+	return
+}
+
+// policy returns the access policy and the blacklist, which requires the
+// blacklist policy
+func (c config) policy() (policy cytracker.AccessPolicy, blacklist []cytracker.InfoHash, err error) {
+	if policy, err = cytracker.ParseAccessPolicy(c.Policy); err != nil {
+		return
+	}
+	if len(c.Blacklist) > 0 && policy != cytracker.PolicyBlacklist {
+		err = fmt.Errorf("Blacklist requires the blacklist policy")
+		return
+	}
+	for _, s := range c.Blacklist {
+		var infoHash cytracker.InfoHash
+		if infoHash, err = cytracker.ParseInfoHash(s); err != nil {
+			return
+		}
+		blacklist = append(blacklist, infoHash)
+	}
+	return
+}
+
+func (c config) limits() (l cytracker.Limits, err error) {
+	fullScrape, err := cytracker.ParseFullScrapeMode(c.FullScrape)
+	if err != nil {
+		return
+	}
+	peerSelection, err := cytracker.ParsePeerSelection(c.PeerSelection)
+	if err != nil {
+		return
+	}
+	var asns *cytracker.ASNTable
+	if c.ASNTable != "" {
+		if asns, err = cytracker.LoadASNTable(c.ASNTable); err != nil {
+			return
+		}
+	}
+	l = cytracker.Limits{
+		AnnounceInterval:    time.Duration(c.Interval),
+		MinInterval:         time.Duration(c.MinInterval),
+		PeerTTL:             time.Duration(c.PeerTTL),
+		NumWant:             c.NumWant,
+		MaxNumWant:          c.MaxNumWant,
+		PeerSelection:       peerSelection,
+		ASNTable:            asns,
+		ScrapeInterval:      time.Duration(c.ScrapeInterval),
+		MaxScrapeHashes:     c.MaxScrapeHashes,
+		FullScrape:          fullScrape,
+		FullScrapeInterval:  time.Duration(c.FullScrapeInterval),
+		AnnounceRate:        c.AnnounceRate,
+		AnnounceBurst:       c.AnnounceBurst,
+		PeerAnnounceBurst:   c.PeerAnnounceBurst,
+		CacheEarlyAnnounces: c.CacheEarly,
+	}
+	return
+}
+
+// reload applies the settings of next that can change while t serves: the
+// limits, peer selection, scrape settings and announce rate limits, the access
+// policy and blacklist and the torrent files. The tracker reads the TLS files again itself.
+// Changes to other settings are logged as requiring a restart. It returns the
+// configuration in effect.
+func (c config) reload(t *cytracker.Tracker, logger cytracker.Logger, next config) config {
+	fail := func(msg string, err error) config {
+		logger.Log(cytracker.LevelError, msg, cytracker.Field{Key: "error", Value: err.Error()})
+		return c
+	}
+	policy, blacklist, err := next.policy()
+	if err != nil {
+		return fail("invalid configuration, keeping the current one", err)
+	}
+	limits, err := next.limits()
+	if err == nil {
+		err = t.SetLimits(limits)
+	}
+	if err != nil {
+		return fail("invalid configuration, keeping the current one", err)
+	}
+	t.SetPolicy(policy)
+	t.SetBlacklist(blacklist)
+	if err = t.LoadTorrentFiles(next.Torrents); err != nil {
+		fail("reloading torrent files failed", err)
+	}
+
+	// settings that only apply on start keep their current values
+	effective := c
+	effective.Interval, effective.MinInterval, effective.PeerTTL = next.Interval, next.MinInterval, next.PeerTTL
+	effective.NumWant, effective.MaxNumWant = next.NumWant, next.MaxNumWant
+	effective.PeerSelection, effective.ASNTable = next.PeerSelection, next.ASNTable
+	effective.ScrapeInterval, effective.MaxScrapeHashes = next.ScrapeInterval, next.MaxScrapeHashes
+	effective.FullScrape, effective.FullScrapeInterval = next.FullScrape, next.FullScrapeInterval
+	effective.AnnounceRate, effective.AnnounceBurst = next.AnnounceRate, next.AnnounceBurst
+	effective.PeerAnnounceBurst, effective.CacheEarly = next.PeerAnnounceBurst, next.CacheEarly
+	effective.Policy, effective.Blacklist, effective.Torrents = next.Policy, next.Blacklist, next.Torrents
+	if !reflect.DeepEqual(effective, next) {
+		logger.Log(cytracker.LevelWarn, "listen addresses, tracker ID, proxies, client IP policy, TLS files, storage, logging, shutdown timeout, torrent directory and webhook change on restart")
+	}
+	return effective
+}
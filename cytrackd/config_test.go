@@ -0,0 +1,208 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cydev/cytracker"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestConfig(t *testing.T) {
+	Convey("Configuration", t, func() {
+		dir, err := ioutil.TempDir("", "cytrackd")
+		So(err, ShouldBeNil)
+		file := filepath.Join(dir, "config.json")
+		write := func(s string) {
+			So(ioutil.WriteFile(file, []byte(s), 0600), ShouldBeNil)
+		}
+
+		Convey("Defaults", func() {
+			c, err := parseConfig(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(c, ShouldResemble, defaultConfig())
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.ClientIP, ShouldEqual, cytracker.ClientIPPrivate)
+		})
+		Convey("Flags override the file", func() {
+			write(`{"addr": ":1", "announce": "/a", "interval": "10m", "torrents": ["a.torrent"]}`)
+			c, err := parseConfig([]string{"-addr", ":2", "-config", file, "-numwant", "20", "b.torrent"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(c.Addr, ShouldEqual, ":2")
+			So(c.Announce, ShouldEqual, "/a")
+			So(time.Duration(c.Interval), ShouldEqual, 10*time.Minute)
+			So(c.NumWant, ShouldEqual, 20)
+			So(c.Torrents, ShouldResemble, []string{"a.torrent", "b.torrent"})
+
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.Addr, ShouldEqual, ":2")
+			So(tracker.AnnounceInterval, ShouldEqual, 10*time.Minute)
+			So(tracker.NumWant, ShouldEqual, 20)
+		})
+		Convey("Scrape settings", func() {
+			c, err := parseConfig([]string{"-full-scrape", "cached", "-full-scrape-interval", "5m", "-max-scrape-hashes", "10"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.FullScrape, ShouldEqual, cytracker.FullScrapeCached)
+			So(tracker.FullScrapeInterval, ShouldEqual, 5*time.Minute)
+			So(tracker.MaxScrapeHashes, ShouldEqual, 10)
+		})
+		Convey("Rate limits", func() {
+			write(`{"announce_rate": 0.5, "announce_burst": 5, "min_interval": "1m"}`)
+			c, err := parseConfig([]string{"-config", file, "-peer-announce-burst", "2", "-cache-early-announces"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.AnnounceRate, ShouldEqual, 0.5)
+			So(tracker.AnnounceBurst, ShouldEqual, 5)
+			So(tracker.PeerAnnounceBurst, ShouldEqual, 2)
+			So(tracker.CacheEarlyAnnounces, ShouldBeTrue)
+		})
+		Convey("Peer selection", func() {
+			table := filepath.Join(dir, "asn.txt")
+			So(ioutil.WriteFile(table, []byte("10.0.0.0/8 AS64496\n"), 0600), ShouldBeNil)
+			c, err := parseConfig([]string{"-peer-selection", "locality", "-asn-table", table}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.PeerSelection, ShouldEqual, cytracker.PeerSelectionLocality)
+			So(tracker.ASNTable.Lookup(net.ParseIP("10.0.0.1")), ShouldEqual, 64496)
+		})
+		Convey("Proxies", func() {
+			write(`{"trusted_proxies": ["10.0.0.0/8"], "client_ip": "never"}`)
+			c, err := parseConfig([]string{"-config", file, "-trusted-proxies", "127.0.0.1,::1", "-proxy-protocol"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.TrustedProxies, ShouldHaveLength, 2)
+			So(tracker.ProxyProtocol, ShouldBeTrue)
+			So(tracker.ClientIP, ShouldEqual, cytracker.ClientIPNever)
+		})
+		Convey("TLS", func() {
+			write(`{"tls_cert": "/etc/cytrackd/cert.pem", "tls_key": "/etc/cytrackd/key.pem"}`)
+			c, err := parseConfig([]string{"-config", file, "-tls-client-ca", "/etc/cytrackd/ca.pem"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.TLSCertFile, ShouldEqual, "/etc/cytrackd/cert.pem")
+			So(tracker.TLSKeyFile, ShouldEqual, "/etc/cytrackd/key.pem")
+			So(tracker.TLSClientCAFile, ShouldEqual, "/etc/cytrackd/ca.pem")
+		})
+		Convey("Torrent directory", func() {
+			write(`{"torrent_dir": "/nonexistent", "torrent_dir_interval": "1m"}`)
+			c, err := parseConfig([]string{"-config", file, "-torrent-dir", dir}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.TorrentDir, ShouldEqual, dir)
+			So(tracker.TorrentDirInterval, ShouldEqual, time.Minute)
+		})
+		Convey("Blacklist", func() {
+			a, b := strings.Repeat("a", 40), strings.Repeat("b", 40)
+			write(`{"policy": "blacklist", "blacklist": ["` + a + `"]}`)
+			c, err := parseConfig([]string{"-config", file}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, logger, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.Policy(), ShouldEqual, cytracker.PolicyBlacklist)
+			infoHash, err := cytracker.ParseInfoHash(a)
+			So(err, ShouldBeNil)
+			So(tracker.Blacklisted(), ShouldResemble, []cytracker.InfoHash{infoHash})
+
+			Convey("Reload replaces it", func() {
+				next, err := parseConfig([]string{"-config", file, "-blacklist", b}, ioutil.Discard)
+				So(err, ShouldBeNil)
+				c = c.reload(tracker, logger, next)
+				So(c.Blacklist, ShouldResemble, list{b})
+				infoHash, err := cytracker.ParseInfoHash(b)
+				So(err, ShouldBeNil)
+				So(tracker.Blacklisted(), ShouldResemble, []cytracker.InfoHash{infoHash})
+
+				next, err = parseConfig(nil, ioutil.Discard)
+				So(err, ShouldBeNil)
+				c = c.reload(tracker, logger, next)
+				So(tracker.Policy(), ShouldEqual, cytracker.PolicyOpen)
+				So(tracker.Blacklisted(), ShouldBeEmpty)
+			})
+			Convey("Reload keeps it if invalid", func() {
+				invalid, err := parseConfig([]string{"-config", file, "-blacklist", "not a hash"}, ioutil.Discard)
+				So(err, ShouldBeNil)
+				So(c.reload(tracker, logger, invalid), ShouldResemble, c)
+				So(tracker.Blacklisted(), ShouldResemble, []cytracker.InfoHash{infoHash})
+			})
+		})
+		Convey("Rejects unknown settings", func() {
+			write(`{"adress": ":1"}`)
+			_, err := parseConfig([]string{"-config", file}, ioutil.Discard)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Rejects invalid values", func() {
+			for _, args := range [][]string{
+				{"-policy", "closed"},
+				{"-policy", "blacklist", "-blacklist", "not a hash"},
+				{"-blacklist", strings.Repeat("a", 40)},
+				{"-log-level", "loud"},
+				{"-storage", "tape"},
+				{"-storage", "file"},
+				{"-storage", "memory", "-state", dir},
+				{"-announce", "announce"},
+				{"-interval", "1m", "-min-interval", "2m"},
+				{"-numwant", "100", "-max-numwant", "10"},
+				{"-torrent-dir", filepath.Join(dir, "missing")},
+				{"-full-scrape", "sometimes"},
+				{"-max-scrape-hashes", "-1"},
+				{"-announce-rate", "-1"},
+				{"-client-ip", "sometimes"},
+				{"-peer-selection", "best"},
+				{"-asn-table", filepath.Join(dir, "missing")},
+				{"-trusted-proxies", "proxy"},
+				{"-proxy-protocol"},
+				{"-tls-cert", "cert.pem"},
+				{"-tls-client-ca", "ca.pem"},
+			} {
+				c, err := parseConfig(args, ioutil.Discard)
+				So(err, ShouldBeNil)
+				_, _, err = c.newTracker()
+				So(err, ShouldNotBeNil)
+			}
+			_, err := parseConfig([]string{"-interval", "often"}, ioutil.Discard)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("State directory selects file storage", func() {
+			c, err := parseConfig([]string{"-state", filepath.Join(dir, "state")}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, _, err := c.newTracker()
+			So(err, ShouldBeNil)
+			So(tracker.Storage, ShouldNotBeNil)
+			So(tracker.Storage.Close(), ShouldBeNil)
+		})
+		Convey("Reload applies limits, policy and torrents", func() {
+			c, err := parseConfig(nil, ioutil.Discard)
+			So(err, ShouldBeNil)
+			tracker, logger, err := c.newTracker()
+			So(err, ShouldBeNil)
+
+			next, err := parseConfig([]string{"-interval", "5m", "-policy", "whitelist", "-addr", ":9"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			c = c.reload(tracker, logger, next)
+			So(tracker.Policy(), ShouldEqual, cytracker.PolicyWhitelist)
+			So(time.Duration(c.Interval), ShouldEqual, 5*time.Minute)
+			So(c.Addr, ShouldEqual, defaultConfig().Addr)
+
+			invalid, err := parseConfig([]string{"-interval", "5m", "-min-interval", "10m"}, ioutil.Discard)
+			So(err, ShouldBeNil)
+			So(c.reload(tracker, logger, invalid), ShouldResemble, c)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -3,18 +3,48 @@ package main
 import (
 	"flag"
 	"log"
+	"os"
+	"time"
 
 	"github.com/cydev/cytracker"
 )
 
-var (
-	bindAddr = flag.String("addr", ":8080", "Creates a tracker serving the given torrent file on the given address")
-)
-
 func main() {
-	log.Println("starting tracker on", *bindAddr)
-	flag.Parse()
-	if err := cytracker.StartTracker(*bindAddr, flag.Args()); err != nil {
+	c, err := parseConfig(os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
 		log.Fatal(err)
 	}
+	t, logger, err := c.newTracker()
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhook, err := c.newWebhook(logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var stopWebhook func(time.Duration)
+	if webhook != nil {
+		stopWebhook = webhook.start(t)
+	}
+	reload := func() {
+		// the config file and flags are read again
+		next, err := parseConfig(os.Args[1:], os.Stderr)
+		if err != nil {
+			logger.Log(cytracker.LevelError, "invalid configuration, keeping the current one", cytracker.Field{Key: "error", Value: err.Error()})
+			return
+		}
+		c = c.reload(t, logger, next)
+	}
+	logger.Log(cytracker.LevelInfo, "starting tracker", cytracker.Field{Key: "addr", Value: c.Addr})
+	err = t.RunWithReload(c.Torrents, reload)
+	if stopWebhook != nil {
+		stopWebhook(t.ShutdownTimeout)
+	}
+	if err != nil {
+		logger.Log(cytracker.LevelError, "tracker failed", cytracker.Field{Key: "error", Value: err.Error()})
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/cydev/cytracker"
+)
+
+const (
+	defaultWebhookQueue   = 1000
+	defaultWebhookRetries = 3
+	defaultWebhookTimeout = 10 * time.Second
+	webhookBackoff        = time.Second
+)
+
+// webhook posts the tracker events as JSON objects to a URL. Events wait in a
+// bounded queue, they are dropped while it is full.
+type webhook struct {
+	url    string
+	events map[cytracker.EventType]bool // all events if nil
+	queue  int
+	// retries is how often a failed post is retried, waiting backoff
+	// doubled each time
+	retries int
+	backoff time.Duration
+	client  *http.Client
+	logger  cytracker.Logger
+	done    chan struct{} // closed when the queue is drained
+}
+
+// newWebhook returns the webhook described by c, or nil if it has no URL
+func (c config) newWebhook(logger cytracker.Logger) (w *webhook, err error) {
+	if c.WebhookURL == "" {
+		return
+	}
+	if u, err := url.Parse(c.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid webhook URL %#v", c.WebhookURL)
+	}
+	w = &webhook{
+		url:     c.WebhookURL,
+		queue:   c.WebhookQueue,
+		retries: c.WebhookRetries,
+		backoff: webhookBackoff,
+		client:  &http.Client{Timeout: time.Duration(c.WebhookTimeout)},
+		logger:  logger,
+	}
+	if w.queue <= 0 {
+		w.queue = defaultWebhookQueue
+	}
+	if w.retries < 0 {
+		return nil, fmt.Errorf("Invalid webhook retries %d", w.retries)
+	}
+	if c.WebhookTimeout == 0 {
+		w.client.Timeout = defaultWebhookTimeout
+	}
+	for _, name := range c.WebhookEvents {
+		e, err := cytracker.ParseEventType(name)
+		if err != nil {
+			return nil, err
+		}
+		if w.events == nil {
+			w.events = make(map[cytracker.EventType]bool)
+		}
+		w.events[e] = true
+	}
+	return
+}
+
+// start posts the events of t until the returned stop is called. stop waits
+// up to timeout, or 10 seconds if zero, for the queued events to be posted.
+func (w *webhook) start(t *cytracker.Tracker) (stop func(timeout time.Duration)) {
+	events, unsubscribe := t.Subscribe(w.queue)
+	w.done = make(chan struct{})
+	go w.run(events)
+	return func(timeout time.Duration) {
+		unsubscribe()
+		if timeout == 0 {
+			timeout = defaultWebhookTimeout
+		}
+		select {
+		case <-w.done:
+		case <-time.After(timeout):
+			w.logger.Log(cytracker.LevelWarn, "webhook events not posted in time, dropping them")
+		}
+	}
+}
+
+func (w *webhook) run(events <-chan cytracker.Event) {
+	defer close(w.done)
+	for e := range events {
+		if w.events != nil && !w.events[e.Type] {
+			continue
+		}
+		if err := w.post(e); err != nil {
+			w.logger.Log(cytracker.LevelError, "webhook failed",
+				cytracker.Field{Key: "event", Value: e.Type.String()},
+				cytracker.Field{Key: "info_hash", Value: e.InfoHash.String()},
+				cytracker.Field{Key: "error", Value: err.Error()})
+		}
+	}
+}
+
+// post sends e, retrying after network errors and server errors
+func (w *webhook) post(e cytracker.Event) (err error) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		if retry, err = w.send(body); err == nil || !retry || attempt == w.retries {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// send posts body once and reports whether a failure may be retried
+func (w *webhook) send(body []byte) (retry bool, err error) {
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	err = fmt.Errorf("Webhook responded %v", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
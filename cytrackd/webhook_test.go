@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cydev/cytracker"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWebhook(t *testing.T) {
+	Convey("Webhook", t, func() {
+		var (
+			m        sync.Mutex
+			received []cytracker.Event
+			failures int // responses to fail with 503
+		)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m.Lock()
+			defer m.Unlock()
+			if failures > 0 {
+				failures--
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			var e cytracker.Event
+			if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			received = append(received, e)
+		}))
+		defer server.Close()
+
+		c, err := parseConfig([]string{"-webhook", server.URL, "-webhook-events", "registered,unregistered", "-webhook-retries", "2"}, ioutil.Discard)
+		So(err, ShouldBeNil)
+		tracker, logger, err := c.newTracker()
+		So(err, ShouldBeNil)
+		w, err := c.newWebhook(logger)
+		So(err, ShouldBeNil)
+		w.backoff = time.Millisecond
+
+		Convey("posts the chosen events", func() {
+			stop := w.start(tracker)
+			a, b := cytracker.InfoHash{1}, cytracker.InfoHash{2}
+			So(tracker.Register(a, "a"), ShouldBeNil)
+			So(tracker.Register(b, "b"), ShouldBeNil)
+			So(tracker.Unregister(a), ShouldBeNil)
+			stop(time.Second)
+			So(received, ShouldHaveLength, 3)
+			So(received[0].Type, ShouldEqual, cytracker.EventRegistered)
+			So(received[0].InfoHash, ShouldEqual, a)
+			So(received[0].Name, ShouldEqual, "a")
+			So(received[2].Type, ShouldEqual, cytracker.EventUnregistered)
+		})
+		Convey("retries failed posts", func() {
+			failures = 2
+			stop := w.start(tracker)
+			So(tracker.Register(cytracker.InfoHash{1}, "a"), ShouldBeNil)
+			stop(time.Second)
+			So(received, ShouldHaveLength, 1)
+			So(failures, ShouldEqual, 0)
+		})
+		Convey("gives up after the retries", func() {
+			failures = 3
+			stop := w.start(tracker)
+			So(tracker.Register(cytracker.InfoHash{1}, "a"), ShouldBeNil)
+			So(tracker.Register(cytracker.InfoHash{2}, "b"), ShouldBeNil)
+			stop(time.Second)
+			So(received, ShouldHaveLength, 1)
+			So(received[0].Name, ShouldEqual, "b")
+		})
+		Convey("is optional", func() {
+			w, err := defaultConfig().newWebhook(logger)
+			So(err, ShouldBeNil)
+			So(w, ShouldBeNil)
+		})
+		Convey("rejects invalid settings", func() {
+			for _, args := range [][]string{
+				{"-webhook", "releases.example.com"},
+				{"-webhook", "ftp://releases.example.com"},
+				{"-webhook", server.URL, "-webhook-events", "exploded"},
+				{"-webhook", server.URL, "-webhook-retries", "-1"},
+			} {
+				c, err := parseConfig(args, ioutil.Discard)
+				So(err, ShouldBeNil)
+				_, err = c.newWebhook(logger)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+}
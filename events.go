@@ -0,0 +1,146 @@
+package cytracker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventType is the kind of swarm change an Event reports
+type EventType int
+
+const (
+	// EventStarted is sent when a peer announces it started downloading
+	EventStarted EventType = iota
+	// EventCompleted is sent when a peer completes a download, the first
+	// completion of a torrent has Completed 1
+	EventCompleted
+	// EventStopped is sent when a peer announces it stopped
+	EventStopped
+	// EventReaped is sent when a peer is removed for not announcing
+	EventReaped
+	// EventRegistered is sent when a torrent is registered, Auto is set if
+	// an announce registered it
+	EventRegistered
+	// EventUnregistered is sent when a torrent is unregistered, or dropped
+	// for having no peers
+	EventUnregistered
+)
+
+var eventTypeNames = []string{"started", "completed", "stopped", "reaped", "registered", "unregistered"}
+
+func (e EventType) String() string {
+	if e < 0 || int(e) >= len(eventTypeNames) {
+		return fmt.Sprintf("EventType(%d)", int(e))
+	}
+	return eventTypeNames[e]
+}
+
+// ParseEventType returns the event type named s
+func ParseEventType(s string) (e EventType, err error) {
+	for i, name := range eventTypeNames {
+		if name == s {
+			return EventType(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown event type %#v", s)
+	return
+}
+
+func (e EventType) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+func (e *EventType) UnmarshalText(b []byte) (err error) {
+	*e, err = ParseEventType(string(b))
+	return
+}
+
+// Event is a change of a swarm. Seeders, Leechers and Completed are the
+// counts of the torrent after the change, so a stopped or reaped event with
+// no Seeders reports that a torrent lost its last seeder.
+type Event struct {
+	Type      EventType `json:"type"`
+	Time      time.Time `json:"time"`
+	InfoHash  InfoHash  `json:"info_hash"`
+	Name      string    `json:"name"`
+	Auto      bool      `json:"auto,omitempty"`
+	PeerID    *PeerID   `json:"peer_id,omitempty"`
+	Addr      string    `json:"addr,omitempty"`
+	Seeders   int       `json:"seeders"`
+	Leechers  int       `json:"leechers"`
+	Completed uint64    `json:"completed"`
+}
+
+// newEvent returns an event of the torrent, the caller must hold its lock
+func (t *trackerTorrent) newEvent(typ EventType, now time.Time, infoHash InfoHash) Event {
+	e := Event{Type: typ, Time: now, InfoHash: infoHash, Name: t.name, Auto: t.auto, Completed: t.downloaded}
+	e.Seeders, e.Leechers = t.countPeers()
+	return e
+}
+
+// newPeerEvent returns an event of a peer of the torrent, the caller must hold
+// its lock
+func (t *trackerTorrent) newPeerEvent(typ EventType, now time.Time, infoHash InfoHash, id PeerID, addr *net.TCPAddr) Event {
+	e := t.newEvent(typ, now, infoHash)
+	e.PeerID = &id
+	e.Addr = addr.String()
+	return e
+}
+
+type subscription struct {
+	events chan Event
+}
+
+// eventBus sends events to subscribers without blocking, the zero value is
+// ready to use
+type eventBus struct {
+	m           sync.RWMutex // Protects subscribers
+	subscribers map[*subscription]bool
+	// dropped counts the events subscribers were too slow to receive
+	dropped uint64
+}
+
+// subscribe returns a subscription buffering up to buffer events
+func (b *eventBus) subscribe(buffer int) (events <-chan Event, unsubscribe func()) {
+	s := &subscription{events: make(chan Event, buffer)}
+	b.m.Lock()
+	if b.subscribers == nil {
+		b.subscribers = make(map[*subscription]bool)
+	}
+	b.subscribers[s] = true
+	b.m.Unlock()
+	var once sync.Once
+	return s.events, func() {
+		once.Do(func() {
+			b.m.Lock()
+			delete(b.subscribers, s)
+			b.m.Unlock()
+			close(s.events)
+		})
+	}
+}
+
+// publish sends e to the subscribers with room for it and drops it for the
+// others
+func (b *eventBus) publish(e Event) {
+	b.m.RLock()
+	defer b.m.RUnlock()
+	for s := range b.subscribers {
+		select {
+		case s.events <- e:
+		default:
+			atomic.AddUint64(&b.dropped, 1)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the swarm events, in the order they
+// happened per torrent. Announces never wait for subscribers: events that
+// don't fit the buffer of the channel are dropped. unsubscribe closes the
+// channel.
+func (t *Tracker) Subscribe(buffer int) (events <-chan Event, unsubscribe func()) {
+	return t.torrents.events.subscribe(buffer)
+}
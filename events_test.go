@@ -0,0 +1,101 @@
+package cytracker
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// receive returns the events waiting in events
+func receive(events <-chan Event) (received []Event) {
+	for {
+		select {
+		case e := <-events:
+			received = append(received, e)
+		default:
+			return
+		}
+	}
+}
+
+func eventTypes(events []Event) (types []string) {
+	for _, e := range events {
+		types = append(types, e.Type.String())
+	}
+	return
+}
+
+func TestEvents(t *testing.T) {
+	Convey("Event types", t, func() {
+		for _, name := range eventTypeNames {
+			e, err := ParseEventType(name)
+			So(err, ShouldBeNil)
+			So(e.String(), ShouldEqual, name)
+		}
+		_, err := ParseEventType("exploded")
+		So(err, ShouldNotBeNil)
+
+		b, err := json.Marshal(Event{Type: EventCompleted, InfoHash: testInfoHash("01234567890123456789")})
+		So(err, ShouldBeNil)
+		var e Event
+		So(json.Unmarshal(b, &e), ShouldBeNil)
+		So(e.Type, ShouldEqual, EventCompleted)
+		So(e.PeerID, ShouldBeNil)
+	})
+	Convey("Swarm events", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		events, unsubscribe := tracker.Subscribe(100)
+		infoHash := "01234567890123456789"
+
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 0, 10, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 10, 10, ""))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 10, 0, "completed"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 10, 0, "completed"))
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "stopped"))
+		received := receive(events)
+		So(eventTypes(received), ShouldResemble, []string{"registered", "started", "started", "completed", "stopped"})
+
+		registered := received[0]
+		So(registered.InfoHash, ShouldEqual, testInfoHash(infoHash))
+		So(registered.Auto, ShouldBeTrue)
+		So(registered.PeerID, ShouldBeNil)
+		completed := received[3]
+		So(*completed.PeerID, ShouldEqual, testPeerID("leech"))
+		So(completed.Addr, ShouldEqual, "10.0.0.1:7001")
+		So(completed.Completed, ShouldEqual, 1)
+		So(completed.Seeders, ShouldEqual, 2)
+		So(completed.Leechers, ShouldEqual, 0)
+		So(received[4].Seeders, ShouldEqual, 1)
+
+		Convey("of reaping and unregistering", func() {
+			tracker.reap(time.Now().Add(tracker.limits().peerTTL() + time.Minute))
+			So(eventTypes(receive(events)), ShouldResemble, []string{"reaped", "unregistered"})
+			So(tracker.Register(testInfoHash(infoHash), "registered"), ShouldBeNil)
+			So(tracker.Unregister(testInfoHash(infoHash)), ShouldBeNil)
+			received := receive(events)
+			So(eventTypes(received), ShouldResemble, []string{"registered", "unregistered"})
+			So(received[0].Name, ShouldEqual, "registered")
+			So(received[0].Auto, ShouldBeFalse)
+		})
+		Convey("are dropped for slow subscribers", func() {
+			slow, unsubscribeSlow := tracker.Subscribe(1)
+			defer unsubscribeSlow()
+			get(mux, "/announce?"+announceQuery(infoHash, "a", 7002, 0, 0, 10, "started"))
+			get(mux, "/announce?"+announceQuery(infoHash, "b", 7003, 0, 0, 10, "started"))
+			So(receive(slow), ShouldHaveLength, 1)
+			So(receive(events), ShouldHaveLength, 2)
+			So(tracker.torrents.events.dropped, ShouldEqual, 1)
+		})
+		Convey("end when unsubscribing", func() {
+			unsubscribe()
+			unsubscribe()
+			get(mux, "/announce?"+announceQuery(infoHash, "a", 7002, 0, 0, 10, "started"))
+			_, ok := <-events
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,218 @@
+package cytracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	journalFile  = "journal.log"
+	// rotatedFile is the journal before the last Rotate, it is removed by
+	// Snapshot
+	rotatedFile = "journal.log.1"
+)
+
+// FileStorage keeps swarm state in a directory as a JSON snapshot and an
+// append-only journal with one JSON entry per line. Info hashes and peer IDs
+// are hex-encoded. The journal is flushed to disk by Rotate and Close, a
+// crash of the machine may lose the entries appended since.
+type FileStorage struct {
+	// Logger receives warnings about skipped journal entries if set
+	Logger  Logger
+	dir     string
+	m       sync.Mutex // Protects journal
+	journal *os.File
+	sm      sync.Mutex // Serializes snapshots
+}
+
+// NewFileStorage opens or creates the storage in dir
+func NewFileStorage(dir string) (s *FileStorage, err error) {
+	if err = os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	s = &FileStorage{dir: dir}
+	if s.journal, err = openJournal(filepath.Join(dir, journalFile)); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// openJournal opens the journal for appending. An unterminated last line, a
+// write interrupted by a crash, is cut off so that the next entry starts on
+// a line of its own.
+func openJournal(name string) (journal *os.File, err error) {
+	journal, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return
+	}
+	var data []byte
+	if data, err = ioutil.ReadFile(name); err == nil {
+		if n := bytes.LastIndexByte(data, '\n') + 1; n < len(data) {
+			err = journal.Truncate(int64(n))
+		}
+	}
+	if err != nil {
+		journal.Close()
+		return nil, err
+	}
+	return
+}
+
+func (s *FileStorage) Load() (state SwarmState, journal []JournalEntry, err error) {
+	var data []byte
+	data, err = ioutil.ReadFile(filepath.Join(s.dir, snapshotFile))
+	if err == nil {
+		err = json.Unmarshal(data, &state)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	for _, name := range []string{rotatedFile, journalFile} {
+		if journal, err = s.readJournal(filepath.Join(s.dir, name), journal); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// readJournal appends the entries in the journal file name to journal
+func (s *FileStorage) readJournal(name string, journal []JournalEntry) ([]JournalEntry, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return journal, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// an unterminated line is a write interrupted by a crash
+			return journal, nil
+		}
+		if err != nil {
+			return journal, err
+		}
+		var entry JournalEntry
+		if err = json.Unmarshal(line, &entry); err != nil {
+			logger{l: s.Logger}.warn("skipping corrupt journal entry", Field{"entry", string(line)}, errorField(err))
+			continue
+		}
+		journal = append(journal, entry)
+	}
+}
+
+func (s *FileStorage) Append(entry JournalEntry) (err error) {
+	var data []byte
+	data, err = json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	_, err = s.journal.Write(append(data, '\n'))
+	return
+}
+
+// Rotate renames the journal to journal.log.1 and starts a new one. It keeps
+// appending to the journal if journal.log.1 is left from a failed snapshot.
+func (s *FileStorage) Rotate() (err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	rotated := filepath.Join(s.dir, rotatedFile)
+	if _, err = os.Stat(rotated); err == nil || !os.IsNotExist(err) {
+		return
+	}
+	if err = s.journal.Sync(); err != nil {
+		return
+	}
+	name := filepath.Join(s.dir, journalFile)
+	if err = os.Rename(name, rotated); err != nil {
+		return
+	}
+	// the old file stays open until the new one is, so appends have one
+	var journal *os.File
+	if journal, err = openJournal(name); err != nil {
+		return
+	}
+	s.journal.Close()
+	s.journal = journal
+	return
+}
+
+func (s *FileStorage) Snapshot(state SwarmState) (err error) {
+	var data []byte
+	data, err = json.Marshal(state)
+	if err != nil {
+		return
+	}
+	// appends go on while the snapshot is written
+	s.sm.Lock()
+	defer s.sm.Unlock()
+
+	// writing the new snapshot next to the old one and renaming it, so that
+	// a crash leaves either the old or the new snapshot in place
+	name := filepath.Join(s.dir, snapshotFile)
+	var f *os.File
+	f, err = os.Create(name + ".tmp")
+	if err != nil {
+		return
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return
+	}
+	if err = syncDir(s.dir); err != nil {
+		return
+	}
+	if err = os.Remove(filepath.Join(s.dir, rotatedFile)); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
+
+// Close flushes the journal to disk and closes it
+func (s *FileStorage) Close() (err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	err = s.journal.Sync()
+	if closeErr := s.journal.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
+
+// syncDir flushes the entries of dir to disk, making a rename in it durable
+func syncDir(dir string) (err error) {
+	var f *os.File
+	if f, err = os.Open(dir); err != nil {
+		return
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package cytracker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// hashSize is the length of info hashes and peer IDs
+const hashSize = 20
+
+// InfoHash is the SHA-1 hash of the info dictionary of a torrent, or the
+// truncated SHA-256 hash of a v2 torrent
+type InfoHash [hashSize]byte
+
+// PeerID is the ID a client chooses for itself
+type PeerID [hashSize]byte
+
+// NewInfoHash returns the info hash with the raw bytes s, as sent in announces
+// and scrapes
+func NewInfoHash(s string) (h InfoHash, err error) {
+	if len(s) != hashSize {
+		err = failure{"invalid_info_hash", fmt.Errorf("Invalid info_hash: %d bytes instead of %d", len(s), hashSize)}
+		return
+	}
+	copy(h[:], s)
+	return
+}
+
+// ParseInfoHash returns the info hash written as 40 hex digits, or as the 64
+// hex digits of a v2 info hash (BEP 52)
+func ParseInfoHash(s string) (h InfoHash, err error) {
+	if len(s) == hex.EncodedLen(sha256.Size) {
+		var sum [sha256.Size]byte
+		if err = parseHex(sum[:], s, "info hash"); err == nil {
+			h = truncateInfoHash(sum)
+		}
+		return
+	}
+	err = parseHex(h[:], s, "info hash")
+	return
+}
+
+// truncateInfoHash returns the info hash of the SHA-256 hash of a v2 info
+// dictionary, which is truncated to 20 bytes for announces and scrapes
+func truncateInfoHash(sum [sha256.Size]byte) (h InfoHash) {
+	copy(h[:], sum[:])
+	return
+}
+
+// String returns the info hash as hex digits
+func (h InfoHash) String() string {
+	return hex.EncodeToString(h[:])
+}
+
+// MarshalText writes the info hash as hex digits
+func (h InfoHash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// UnmarshalText reads an info hash written as hex digits
+func (h *InfoHash) UnmarshalText(b []byte) error {
+	return parseHex(h[:], string(b), "info hash")
+}
+
+// NewPeerID returns the peer ID with the raw bytes s, as sent in announces
+func NewPeerID(s string) (id PeerID, err error) {
+	if len(s) != hashSize {
+		err = failure{"invalid_peer_id", fmt.Errorf("Invalid peer_id: %d bytes instead of %d", len(s), hashSize)}
+		return
+	}
+	copy(id[:], s)
+	return
+}
+
+// String returns the peer ID as hex digits
+func (id PeerID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// MarshalText writes the peer ID as hex digits
+func (id PeerID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText reads a peer ID written as hex digits
+func (id *PeerID) UnmarshalText(b []byte) error {
+	return parseHex(id[:], string(b), "peer ID")
+}
+
+// parseHex decodes the hex digits s into b, which they must fill
+func parseHex(b []byte, s, what string) error {
+	if len(s) != hex.EncodedLen(len(b)) {
+		return fmt.Errorf("Invalid %v %#v: %d hex digits instead of %d", what, s, len(s), hex.EncodedLen(len(b)))
+	}
+	if _, err := hex.Decode(b, []byte(s)); err != nil {
+		return fmt.Errorf("Invalid %v %#v: %v", what, s, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package cytracker
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testInfoHash returns the info hash with the raw bytes s padded with zeros
+func testInfoHash(s string) (h InfoHash) {
+	copy(h[:], s)
+	return
+}
+
+// testPeerID returns the peer ID with the raw bytes s padded with zeros
+func testPeerID(s string) (id PeerID) {
+	copy(id[:], s)
+	return
+}
+
+func TestInfoHash(t *testing.T) {
+	Convey("Info hashes", t, func() {
+		raw := "\x00\xff binary info hash!"
+		h, err := NewInfoHash(raw)
+		So(err, ShouldBeNil)
+		So(string(h[:]), ShouldEqual, raw)
+
+		Convey("must be 20 bytes", func() {
+			for _, s := range []string{"", "short", raw + "x", strings.Repeat("ab", 20)} {
+				_, err := NewInfoHash(s)
+				So(err, ShouldNotBeNil)
+			}
+			_, err := NewPeerID("-XX0001-")
+			So(err, ShouldNotBeNil)
+		})
+		Convey("are written as hex", func() {
+			So(h.String(), ShouldEqual, "00ff2062696e61727920696e666f206861736821")
+			parsed, err := ParseInfoHash(h.String())
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, h)
+			for _, s := range []string{raw, h.String()[1:], h.String() + "0", strings.Repeat("x", 40)} {
+				_, err := ParseInfoHash(s)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("round trip through JSON", func() {
+			id := testPeerID("\x01\xfe binary peer id")
+			b, err := json.Marshal(struct {
+				H  InfoHash
+				ID PeerID
+			}{h, id})
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, `{"H":"`+h.String()+`","ID":"`+id.String()+`"}`)
+			var decoded struct {
+				H  InfoHash
+				ID PeerID
+			}
+			So(json.Unmarshal(b, &decoded), ShouldBeNil)
+			So(decoded.H, ShouldEqual, h)
+			So(decoded.ID, ShouldEqual, id)
+		})
+	})
+	Convey("Malformed announces and scrapes fail", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		valid := announceQuery("01234567890123456789", "peer", 7000, 0, 0, 0, "")
+		for _, test := range []struct{ param, value string }{
+			{paramInfoHash, ""},
+			{paramInfoHash, "0123456789012345678"},
+			{paramInfoHash, "3031323334353637383930313233343536373839"},
+			{paramPeerID, ""},
+			{paramPeerID, "-XX0001-"},
+		} {
+			q, err := url.ParseQuery(valid)
+			So(err, ShouldBeNil)
+			q.Set(test.param, test.value)
+			response := get(mux, "/announce?"+q.Encode())
+			So(response["failure reason"], ShouldContainSubstring, test.param)
+		}
+		So(get(mux, "/scrape?info_hash=short")["failure reason"], ShouldContainSubstring, paramInfoHash)
+		So(tracker.torrents.count(), ShouldEqual, 0)
+		So(tracker.metrics.failures.values["invalid_info_hash"], ShouldEqual, 4)
+		So(tracker.metrics.failures.values["invalid_peer_id"], ShouldEqual, 2)
+	})
+}
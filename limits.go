@@ -0,0 +1,173 @@
+package cytracker
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limits are the announce timing and peer list sizes of a tracker
+type Limits struct {
+	// AnnounceInterval is the interval clients are asked to announce at,
+	// 30 minutes if zero
+	AnnounceInterval time.Duration
+	// MinInterval is the minimum interval clients may announce at, not sent
+	// if zero
+	MinInterval time.Duration
+	// PeerTTL is how long a peer is kept after its last announce, twice the
+	// announce interval if zero
+	PeerTTL time.Duration
+	// NumWant is the number of peers returned to clients that don't ask for
+	// a number, 50 if zero
+	NumWant int
+	// MaxNumWant is the most peers returned to a client, NumWant if zero
+	MaxNumWant int
+	// PeerSelection decides which peers are sent to clients
+	PeerSelection PeerSelection
+	// PeerSelector picks the peers sent to clients instead of PeerSelection
+	// if set
+	PeerSelector PeerSelector
+	// ASNTable gives the autonomous systems of peers for
+	// PeerSelectionLocality, only subnets are compared if nil
+	ASNTable *ASNTable
+	// ScrapeInterval is the min_request_interval sent in scrape responses,
+	// the announce interval if zero
+	ScrapeInterval time.Duration
+	// MaxScrapeHashes is the most info hashes answered in a scrape, 74 if
+	// zero
+	MaxScrapeHashes int
+	// FullScrape decides how scrapes without info hashes are answered
+	FullScrape FullScrapeMode
+	// FullScrapeInterval is how often a rate limited full scrape is
+	// answered, or a cached one refreshed, a minute if zero
+	FullScrapeInterval time.Duration
+	// AnnounceRate is the number of announces per second an IP address may
+	// send on average, not limited if zero
+	AnnounceRate float64
+	// AnnounceBurst is the number of announces an IP address may send at
+	// once, 10 if zero
+	AnnounceBurst int
+	// PeerAnnounceBurst is the number of regular announces a peer may send
+	// at once before MinInterval applies, 1 if zero. Announces with an event
+	// are never early.
+	PeerAnnounceBurst int
+	// CacheEarlyAnnounces answers early announces with the previous response
+	// to the peer instead of a failure
+	CacheEarlyAnnounces bool
+}
+
+const (
+	defaultMaxScrapeHashes    = 74
+	defaultFullScrapeInterval = time.Minute
+)
+
+func (l Limits) announceInterval() time.Duration {
+	if l.AnnounceInterval <= 0 {
+		return defaultInterval
+	}
+	return l.AnnounceInterval
+}
+
+func (l Limits) peerTTL() time.Duration {
+	if l.PeerTTL <= 0 {
+		return 2 * l.announceInterval()
+	}
+	return l.PeerTTL
+}
+
+// numWant returns the number of peers to send to a client asking for requested
+func (l Limits) numWant(requested int) int {
+	numWant := l.NumWant
+	if numWant <= 0 {
+		numWant = defaultPeerCount
+	}
+	max := l.MaxNumWant
+	if max <= 0 {
+		max = numWant
+	}
+	switch {
+	case requested <= 0:
+		return numWant
+	case requested > max:
+		return max
+	}
+	return requested
+}
+
+func (l Limits) scrapeInterval() time.Duration {
+	if l.ScrapeInterval <= 0 {
+		return l.announceInterval()
+	}
+	return l.ScrapeInterval
+}
+
+func (l Limits) maxScrapeHashes() int {
+	if l.MaxScrapeHashes <= 0 {
+		return defaultMaxScrapeHashes
+	}
+	return l.MaxScrapeHashes
+}
+
+func (l Limits) fullScrapeInterval() time.Duration {
+	if l.FullScrapeInterval <= 0 {
+		return defaultFullScrapeInterval
+	}
+	return l.FullScrapeInterval
+}
+
+func (l Limits) announceBurst() int {
+	if l.AnnounceBurst <= 0 {
+		return defaultAnnounceBurst
+	}
+	return l.AnnounceBurst
+}
+
+func (l Limits) peerAnnounceBurst() int {
+	if l.PeerAnnounceBurst <= 0 {
+		return defaultPeerAnnounceBurst
+	}
+	return l.PeerAnnounceBurst
+}
+
+// validate returns an error if the limits are inconsistent
+func (l Limits) validate() error {
+	switch {
+	case l.AnnounceInterval < 0 || l.MinInterval < 0 || l.PeerTTL < 0:
+		return fmt.Errorf("Announce intervals and peer TTL must not be negative")
+	case l.MinInterval > l.announceInterval():
+		return fmt.Errorf("MinInterval %v exceeds the announce interval %v", l.MinInterval, l.announceInterval())
+	case l.peerTTL() < l.announceInterval():
+		return fmt.Errorf("PeerTTL %v is shorter than the announce interval %v", l.peerTTL(), l.announceInterval())
+	case l.NumWant < 0 || l.MaxNumWant < 0:
+		return fmt.Errorf("NumWant and MaxNumWant must not be negative")
+	case l.MaxNumWant > 0 && l.MaxNumWant < l.numWant(0):
+		return fmt.Errorf("MaxNumWant %d is less than NumWant %d", l.MaxNumWant, l.numWant(0))
+	case l.ScrapeInterval < 0 || l.FullScrapeInterval < 0 || l.MaxScrapeHashes < 0:
+		return fmt.Errorf("Scrape intervals and MaxScrapeHashes must not be negative")
+	case l.FullScrape < 0 || int(l.FullScrape) >= len(fullScrapeModeNames):
+		return fmt.Errorf("Unknown full scrape mode %v", l.FullScrape)
+	case l.PeerSelection < 0 || int(l.PeerSelection) >= len(peerSelectionNames):
+		return fmt.Errorf("Unknown peer selection %v", l.PeerSelection)
+	case l.AnnounceRate < 0 || l.AnnounceBurst < 0 || l.PeerAnnounceBurst < 0:
+		return fmt.Errorf("Announce rate and bursts must not be negative")
+	}
+	return nil
+}
+
+// limits returns the current limits
+func (t *Tracker) limits() Limits {
+	t.lm.RLock()
+	defer t.lm.RUnlock()
+	return t.Limits
+}
+
+// SetLimits changes the limits, also while serving. Invalid limits are
+// rejected. A new announce interval applies to the reaper after its next run.
+func (t *Tracker) SetLimits(l Limits) error {
+	if err := l.validate(); err != nil {
+		return err
+	}
+	t.lm.Lock()
+	defer t.lm.Unlock()
+	t.Limits = l
+	return nil
+}
@@ -0,0 +1,199 @@
+package cytracker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named s
+func ParseLevel(s string) (l Level, err error) {
+	for i, name := range levelNames {
+		if name == s {
+			return Level(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown log level %#v", s)
+	return
+}
+
+// Field is a named value attached to a log message
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the log messages of a Tracker. Implementations must be safe
+// for concurrent use.
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// LevelLogger is a Logger that tells which levels it logs, the tracker skips
+// building the fields of messages it would discard
+type LevelLogger interface {
+	Logger
+	Enabled(level Level) bool
+}
+
+// Keys of the fields attached to log messages
+const (
+	fieldInfoHash   = "info_hash"
+	fieldPeer       = "peer"
+	fieldEvent      = "event"
+	fieldRemoteAddr = "remote_addr"
+	fieldError      = "error"
+)
+
+func infoHashField(infoHash InfoHash) Field {
+	return Field{fieldInfoHash, infoHash.String()}
+}
+
+func errorField(err error) Field {
+	return Field{fieldError, err.Error()}
+}
+
+// logger adds context fields to the messages sent to a Logger, it discards
+// messages if the Logger is nil
+type logger struct {
+	l      Logger
+	fields []Field
+}
+
+// enabled reports whether messages of level are logged, to skip computing
+// fields. Loggers that aren't LevelLoggers log every level.
+func (l logger) enabled(level Level) bool {
+	if l.l == nil {
+		return false
+	}
+	if ll, ok := l.l.(LevelLogger); ok {
+		return ll.Enabled(level)
+	}
+	return true
+}
+
+// with returns a logger adding fields to every message
+func (l logger) with(fields ...Field) logger {
+	if l.l == nil {
+		return l
+	}
+	// full slice expression so that loggers derived from l don't share fields
+	return logger{l.l, append(l.fields[:len(l.fields):len(l.fields)], fields...)}
+}
+
+func (l logger) log(level Level, msg string, fields []Field) {
+	if l.l == nil {
+		return
+	}
+	if len(l.fields) > 0 {
+		fields = append(l.fields[:len(l.fields):len(l.fields)], fields...)
+	}
+	l.l.Log(level, msg, fields...)
+}
+
+func (l logger) debug(msg string, fields ...Field) { l.log(LevelDebug, msg, fields) }
+func (l logger) info(msg string, fields ...Field)  { l.log(LevelInfo, msg, fields) }
+func (l logger) warn(msg string, fields ...Field)  { l.log(LevelWarn, msg, fields) }
+func (l logger) error(msg string, fields ...Field) { l.log(LevelError, msg, fields) }
+
+// writerLogger writes messages of at least level min to w
+type writerLogger struct {
+	m      sync.Mutex // Protects w
+	w      io.Writer
+	min    Level
+	format func(b *bytes.Buffer, now time.Time, level Level, msg string, fields []Field)
+}
+
+func (l *writerLogger) Enabled(level Level) bool {
+	return level >= l.min
+}
+
+func (l *writerLogger) Log(level Level, msg string, fields ...Field) {
+	if !l.Enabled(level) {
+		return
+	}
+	var b bytes.Buffer
+	l.format(&b, time.Now(), level, msg, fields)
+	b.WriteByte('\n')
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.w.Write(b.Bytes())
+}
+
+// NewTextLogger returns a Logger writing messages of at least level min to w
+// as lines of the form: time level message key=value...
+func NewTextLogger(w io.Writer, min Level) Logger {
+	return &writerLogger{w: w, min: min, format: formatText}
+}
+
+// NewJSONLogger returns a Logger writing messages of at least level min to w
+// as JSON objects, one per line, with the keys time, level, msg and the fields
+func NewJSONLogger(w io.Writer, min Level) Logger {
+	return &writerLogger{w: w, min: min, format: formatJSON}
+}
+
+func formatText(b *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	fmt.Fprintf(b, "%s %-5s %s", now.Format(time.RFC3339), level, msg)
+	for _, f := range fields {
+		fmt.Fprintf(b, " %s=%v", f.Key, f.Value)
+	}
+}
+
+func formatJSON(b *bytes.Buffer, now time.Time, level Level, msg string, fields []Field) {
+	// written by hand to keep the field order
+	writeJSONField(b, "time", now.Format(time.RFC3339Nano), true)
+	writeJSONField(b, "level", level.String(), false)
+	writeJSONField(b, "msg", msg, false)
+	for _, f := range fields {
+		writeJSONField(b, f.Key, f.Value, false)
+	}
+	b.WriteByte('}')
+}
+
+func writeJSONField(b *bytes.Buffer, key string, value interface{}, first bool) {
+	if first {
+		b.WriteByte('{')
+	} else {
+		b.WriteByte(',')
+	}
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+	if err, ok := value.(error); ok {
+		value = err.Error()
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		v, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(v)
+}
+
+// SetLogger sets the Logger receiving the messages of the tracker, they are
+// discarded if none is set. Call it before serving.
+func (t *Tracker) SetLogger(l Logger) {
+	t.log = logger{l: l}
+	t.torrents.log = t.log
+}
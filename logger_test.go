@@ -0,0 +1,146 @@
+package cytracker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type logMessage struct {
+	level  Level
+	msg    string
+	fields map[string]interface{}
+}
+
+// recordingLogger keeps the messages it receives
+type recordingLogger struct {
+	m        sync.Mutex // Protects messages
+	messages []logMessage
+}
+
+func (l *recordingLogger) Log(level Level, msg string, fields ...Field) {
+	m := logMessage{level: level, msg: msg, fields: make(map[string]interface{})}
+	for _, f := range fields {
+		m.fields[f.Key] = f.Value
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.messages = append(l.messages, m)
+}
+
+func (l *recordingLogger) find(msg string) (m logMessage, ok bool) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	for _, m = range l.messages {
+		if m.msg == msg {
+			return m, true
+		}
+	}
+	return
+}
+
+// levelLogger records messages like recordingLogger but tells that it logs
+// only those of at least level min
+type levelLogger struct {
+	recordingLogger
+	min Level
+}
+
+func (l *levelLogger) Enabled(level Level) bool {
+	return level >= l.min
+}
+
+func TestLogger(t *testing.T) {
+	Convey("Writer loggers", t, func() {
+		var b bytes.Buffer
+		Convey("Text", func() {
+			l := NewTextLogger(&b, LevelInfo)
+			l.Log(LevelDebug, "hidden")
+			l.Log(LevelWarn, "shown", Field{"peer", "10.0.0.1:7000"}, Field{"n", 2})
+			So(b.String(), ShouldEndWith, "warn  shown peer=10.0.0.1:7000 n=2\n")
+			So(b.String(), ShouldNotContainSubstring, "hidden")
+		})
+		Convey("JSON", func() {
+			l := NewJSONLogger(&b, LevelDebug)
+			l.Log(LevelError, "failed", Field{"error", "boom"}, Field{"n", 2})
+			So(strings.Count(b.String(), "\n"), ShouldEqual, 1)
+			So(b.String(), ShouldContainSubstring, `"level":"error","msg":"failed","error":"boom","n":2}`)
+			var decoded map[string]interface{}
+			So(json.Unmarshal(b.Bytes(), &decoded), ShouldBeNil)
+			So(decoded, ShouldContainKey, "time")
+		})
+		Convey("Levels", func() {
+			for _, level := range []Level{LevelDebug, LevelInfo, LevelWarn, LevelError} {
+				parsed, err := ParseLevel(level.String())
+				So(err, ShouldBeNil)
+				So(parsed, ShouldEqual, level)
+			}
+			_, err := ParseLevel("loud")
+			So(err, ShouldNotBeNil)
+		})
+	})
+	Convey("Derived loggers don't share fields", t, func() {
+		l := &recordingLogger{}
+		base := logger{l: l}.with(Field{"a", 1})
+		base.with(Field{"b", 2}).info("first")
+		base.with(Field{"c", 3}).info("second")
+		first, _ := l.find("first")
+		second, _ := l.find("second")
+		So(first.fields, ShouldResemble, map[string]interface{}{"a": 1, "b": 2})
+		So(second.fields, ShouldResemble, map[string]interface{}{"a": 1, "c": 3})
+	})
+	Convey("Tracker messages carry fields", t, func() {
+		l := &recordingLogger{}
+		tracker := NewTracker()
+		tracker.SetLogger(l)
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		get(mux, "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 10, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 10, "bogus"))
+		get(mux, "/announce?info_hash=x")
+
+		joined, ok := l.find("peer joined")
+		So(ok, ShouldBeTrue)
+		So(joined.level, ShouldEqual, LevelDebug)
+		So(joined.fields[fieldInfoHash], ShouldEqual, hex.EncodeToString([]byte(infoHash)))
+		So(joined.fields[fieldPeer], ShouldEqual, "10.0.0.1:7000")
+
+		unknown, ok := l.find("unknown event")
+		So(ok, ShouldBeTrue)
+		So(unknown.level, ShouldEqual, LevelWarn)
+		So(unknown.fields[fieldEvent], ShouldEqual, "bogus")
+
+		failed, ok := l.find("announce failed")
+		So(ok, ShouldBeTrue)
+		So(failed.fields[fieldRemoteAddr], ShouldEqual, "10.0.0.1:1234")
+		So(failed.fields, ShouldContainKey, fieldError)
+	})
+	Convey("Fields are built only for enabled levels", t, func() {
+		So(logger{}.enabled(LevelError), ShouldBeFalse)
+		So(logger{l: &recordingLogger{}}.enabled(LevelDebug), ShouldBeTrue)
+		So(logger{l: NewTextLogger(&bytes.Buffer{}, LevelInfo)}.enabled(LevelDebug), ShouldBeFalse)
+		So(logger{l: NewTextLogger(&bytes.Buffer{}, LevelInfo)}.enabled(LevelWarn), ShouldBeTrue)
+
+		l := &levelLogger{min: LevelInfo}
+		tracker := NewTracker()
+		tracker.SetLogger(l)
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		get(mux, "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 10, "bogus"))
+
+		// the tracker still sends the debug message, the logger discards it
+		joined, ok := l.find("peer joined")
+		So(ok, ShouldBeTrue)
+		So(joined.fields, ShouldNotContainKey, fieldInfoHash)
+
+		unknown, ok := l.find("unknown event")
+		So(ok, ShouldBeTrue)
+		So(unknown.fields[fieldInfoHash], ShouldEqual, hex.EncodeToString([]byte(infoHash)))
+		So(unknown.fields[fieldPeer], ShouldEqual, "10.0.0.1:7000")
+	})
+}
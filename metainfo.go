@@ -0,0 +1,147 @@
+package cytracker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+
+	"github.com/jackpal/bencode-go"
+)
+
+const (
+	// maxTorrentFileSize bounds the size of .torrent files, which hold little
+	// more than the piece hashes
+	maxTorrentFileSize = 4 << 20
+	// maxBencodeDepth bounds the nesting of lists and dictionaries
+	maxBencodeDepth = 64
+)
+
+// metaInfo is what the tracker needs of a .torrent file
+type metaInfo struct {
+	name string
+	// infoHashes are the v1 info hash of v1 and hybrid torrents followed by
+	// the v2 info hash of v2 and hybrid torrents (BEP 52)
+	infoHashes []InfoHash
+}
+
+// readMetaInfo reads the .torrent file, which may be a v1, v2 or hybrid torrent
+func readMetaInfo(file string) (m metaInfo, err error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxTorrentFileSize+1))
+	if err != nil {
+		return
+	}
+	if len(data) > maxTorrentFileSize {
+		err = fmt.Errorf("Larger than %d bytes", maxTorrentFileSize)
+		return
+	}
+	// the info hashes are of the info dictionary exactly as it is written
+	raw, err := bencodeDictValue(data, "info")
+	if err != nil {
+		return
+	}
+	decoded, err := bencode.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return
+	}
+	info, ok := decoded.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("Info is not a dictionary")
+		return
+	}
+	m.name, _ = info["name"].(string)
+	if _, ok := info["pieces"]; ok {
+		m.infoHashes = append(m.infoHashes, sha1.Sum(raw))
+	}
+	if version, _ := info["meta version"].(int64); version == 2 {
+		m.infoHashes = append(m.infoHashes, truncateInfoHash(sha256.Sum256(raw)))
+	}
+	if len(m.infoHashes) == 0 {
+		err = fmt.Errorf("Neither a v1 nor a v2 torrent")
+	}
+	return
+}
+
+// bencodeDictValue returns the bencoded value of key in the dictionary b
+func bencodeDictValue(b []byte, key string) (value []byte, err error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return nil, fmt.Errorf("Not a bencoded dictionary")
+	}
+	for i := 1; i < len(b) && b[i] != 'e'; {
+		var k []byte
+		if k, i, err = bencodeString(b, i); err != nil {
+			return
+		}
+		start := i
+		if i, err = bencodeEnd(b, i); err != nil {
+			return
+		}
+		if string(k) == key {
+			return b[start:i], nil
+		}
+	}
+	return nil, fmt.Errorf("Missing %#v", key)
+}
+
+// bencodeString returns the bencoded string at b[i] and the index after it
+func bencodeString(b []byte, i int) (s []byte, end int, err error) {
+	colon := bytes.IndexByte(b[i:], ':')
+	if colon < 0 {
+		return nil, 0, fmt.Errorf("Malformed bencoded string at %d", i)
+	}
+	n, err := strconv.Atoi(string(b[i : i+colon]))
+	start := i + colon + 1
+	// comparing with the bytes left, as start + n may overflow
+	if err != nil || n < 0 || n > len(b)-start {
+		return nil, 0, fmt.Errorf("Malformed bencoded string at %d", i)
+	}
+	end = start + n
+	return b[start:end], end, nil
+}
+
+// bencodeEnd returns the index after the bencoded value at b[i]. It skips
+// nested values without recursing, up to maxBencodeDepth levels.
+func bencodeEnd(b []byte, i int) (end int, err error) {
+	depth := 0
+	for {
+		if i >= len(b) {
+			return 0, fmt.Errorf("Truncated bencoded value")
+		}
+		switch c := b[i]; {
+		case c == 'i':
+			e := bytes.IndexByte(b[i:], 'e')
+			if e < 0 {
+				return 0, fmt.Errorf("Malformed bencoded integer at %d", i)
+			}
+			i += e + 1
+		case c == 'l' || c == 'd':
+			// dictionaries alternate keys and values, both are skipped alike
+			if depth++; depth > maxBencodeDepth {
+				return 0, fmt.Errorf("Bencoded value nested deeper than %d at %d", maxBencodeDepth, i)
+			}
+			i++
+			continue
+		case c == 'e' && depth > 0:
+			depth--
+			i++
+		case c >= '0' && c <= '9':
+			if _, i, err = bencodeString(b, i); err != nil {
+				return
+			}
+		default:
+			return 0, fmt.Errorf("Malformed bencoded value at %d", i)
+		}
+		if depth == 0 {
+			return i, nil
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package cytracker
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const (
+	// hybridInfo is the info dictionary of a hybrid v1 and v2 torrent
+	hybridInfo = "d9:file treed6:hybridd0:d6:lengthi1e11:pieces root32:" + "01234567890123456789012345678901" +
+		"eee6:lengthi1e12:meta versioni2e4:name6:hybrid12:piece lengthi16384e6:pieces20:01234567890123456789e"
+	// v2Info is the info dictionary of a v2 only torrent
+	v2Info = "d9:file treed2:v2d0:d6:lengthi1eeee12:meta versioni2e4:name2:v212:piece lengthi16384ee"
+)
+
+// writeMetaInfo writes a torrent file with the info dictionary info
+func writeMetaInfo(file, info string) {
+	So(ioutil.WriteFile(file, []byte("d8:announce9:/announce4:info"+info+"e"), 0600), ShouldBeNil)
+}
+
+func TestReadMetaInfo(t *testing.T) {
+	Convey("Reading torrent files", t, func() {
+		dir, err := ioutil.TempDir("", "torrents")
+		So(err, ShouldBeNil)
+		file := filepath.Join(dir, "a.torrent")
+
+		Convey("v1", func() {
+			infoHash := writeTorrentFile(file, "a")
+			m, err := readMetaInfo(file)
+			So(err, ShouldBeNil)
+			So(m.name, ShouldEqual, "a")
+			So(m.infoHashes, ShouldResemble, []InfoHash{infoHash})
+		})
+		Convey("Hybrid", func() {
+			writeMetaInfo(file, hybridInfo)
+			m, err := readMetaInfo(file)
+			So(err, ShouldBeNil)
+			So(m.name, ShouldEqual, "hybrid")
+			So(m.infoHashes, ShouldResemble, []InfoHash{sha1.Sum([]byte(hybridInfo)), truncateInfoHash(sha256.Sum256([]byte(hybridInfo)))})
+		})
+		Convey("v2", func() {
+			writeMetaInfo(file, v2Info)
+			m, err := readMetaInfo(file)
+			So(err, ShouldBeNil)
+			So(m.infoHashes, ShouldResemble, []InfoHash{truncateInfoHash(sha256.Sum256([]byte(v2Info)))})
+
+			sum := sha256.Sum256([]byte(v2Info))
+			parsed, err := ParseInfoHash(hex.EncodeToString(sum[:]))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, m.infoHashes[0])
+		})
+		Convey("Malformed", func() {
+			for _, content := range []string{
+				"",
+				"garbage",
+				"d8:announce9:/announcee",
+				"d4:info",
+				"d4:infod4:name1:a",
+				"d4:infoi1ee",
+				"d4:infod4:name1:aee",
+				"d4:infod4:name99:aeee",
+				"d99999999999:xe",
+				"d9223372036854775800:xe",
+				"d4:infod4:name9223372036854775807:aee",
+			} {
+				So(ioutil.WriteFile(file, []byte(content), 0600), ShouldBeNil)
+				_, err := readMetaInfo(file)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("Deeply nested", func() {
+			nested := strings.Repeat("l", maxBencodeDepth) + strings.Repeat("e", maxBencodeDepth)
+			writeMetaInfo(file, "d4:name1:a6:pieces20:01234567890123456789"+"5:extra"+nested[1:len(nested)-1]+"e")
+			_, err := readMetaInfo(file)
+			So(err, ShouldBeNil)
+
+			for _, content := range []string{
+				"d4:info" + strings.Repeat("l", 1<<20),
+				"d4:infod5:extra" + strings.Repeat("l", maxBencodeDepth) + strings.Repeat("e", maxBencodeDepth) + "ee",
+			} {
+				So(ioutil.WriteFile(file, []byte(content), 0600), ShouldBeNil)
+				_, err := readMetaInfo(file)
+				So(err, ShouldNotBeNil)
+			}
+		})
+		Convey("Too large", func() {
+			padding := strings.Repeat("x", maxTorrentFileSize)
+			writeMetaInfo(file, fmt.Sprintf("d4:name1:a6:pieces20:012345678901234567897:padding%d:%se", len(padding), padding))
+			_, err := readMetaInfo(file)
+			So(err, ShouldNotBeNil)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -0,0 +1,181 @@
+package cytracker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics in the Prometheus text exposition format, served at /metrics on the
+// admin listener without authentication.
+
+const metricsPrefix = "cytracker_"
+
+// counterVec is a set of counters partitioned by the value of one label
+type counterVec struct {
+	name, help, label string
+	m                 sync.Mutex // Protects values
+	values            map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{name: metricsPrefix + name, help: help, label: label, values: make(map[string]uint64)}
+}
+
+func (c *counterVec) add(value string, n uint64) {
+	c.m.Lock()
+	c.values[value] += n
+	c.m.Unlock()
+}
+
+func (c *counterVec) inc(value string) {
+	c.add(value, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if blank(c.label) {
+		fmt.Fprintf(w, "%s %d\n", c.name, c.values[""])
+		return
+	}
+	values := make([]string, 0, len(c.values))
+	for value := range c.values {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, value, c.values[value])
+	}
+}
+
+// histogram counts observations in cumulative buckets
+type histogram struct {
+	name, help string
+	buckets    []float64  // upper bounds
+	m          sync.Mutex // Protects counts, sum and count
+	counts     []uint64
+	sum        float64
+	count      uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: metricsPrefix + name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.m.Lock()
+	defer h.m.Unlock()
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", h.name, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeGauge(w io.Writer, name, help string, value int) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", name, help, name, name, value)
+}
+
+func writeCounter(w io.Writer, name, help string, value uint64) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+}
+
+type trackerMetrics struct {
+	announces *counterVec
+	scrapes   *counterVec
+	failures  *counterVec
+	reaped    *counterVec
+	// reapedTorrents counts auto-registered torrents dropped without peers
+	reapedTorrents *counterVec
+	latency        *histogram
+}
+
+func newTrackerMetrics() *trackerMetrics {
+	return &trackerMetrics{
+		announces:      newCounterVec("announces_total", "Successful announces by event.", "event"),
+		scrapes:        newCounterVec("scrapes_total", "Scrape requests.", ""),
+		failures:       newCounterVec("failures_total", "Failed requests by reason.", "reason"),
+		reaped:         newCounterVec("reaped_peers_total", "Peers removed for not announcing.", ""),
+		reapedTorrents: newCounterVec("reaped_torrents_total", "Auto-registered torrents removed for having no peers.", ""),
+		latency: newHistogram("announce_duration_seconds", "Announce latency.",
+			[]float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}),
+	}
+}
+
+// announced records an announce handled in the time since start
+func (m *trackerMetrics) announced(start time.Time, event string, err error) {
+	m.latency.observe(time.Since(start).Seconds())
+	if err != nil {
+		m.failed(err)
+		return
+	}
+	switch event {
+	case "":
+		event = "none"
+	case "started", "completed", "stopped":
+	default:
+		event = "unknown"
+	}
+	m.announces.inc(event)
+}
+
+func (m *trackerMetrics) failed(err error) {
+	reason := "invalid"
+	if f, ok := err.(failure); ok {
+		reason = f.reason
+	}
+	m.failures.inc(reason)
+}
+
+// failure is a request error with the reason reported in metrics
+type failure struct {
+	reason string
+	error
+}
+
+func (t *Tracker) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var torrents, seeders, leechers int
+	t.torrents.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		complete, incomplete := torrent.countPeers()
+		torrent.m.RUnlock()
+		torrents++
+		seeders += complete
+		leechers += incomplete
+	})
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := t.metrics
+	m.announces.write(w)
+	m.scrapes.write(w)
+	m.failures.write(w)
+	m.reaped.write(w)
+	m.reapedTorrents.write(w)
+	m.latency.write(w)
+	writeCounter(w, "events_dropped_total", "Events dropped for subscribers that fell behind.", atomic.LoadUint64(&t.torrents.events.dropped))
+	writeGauge(w, "torrents", "Tracked torrents.", torrents)
+	writeGauge(w, "seeders", "Peers that have completed the download.", seeders)
+	writeGauge(w, "leechers", "Peers that are still downloading.", leechers)
+}
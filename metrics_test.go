@@ -0,0 +1,68 @@
+package cytracker
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestHistogram(t *testing.T) {
+	Convey("Histogram buckets are cumulative", t, func() {
+		h := newHistogram("test", "Test.", []float64{1, 2})
+		h.observe(0.5)
+		h.observe(1.5)
+		h.observe(3)
+		var b bytes.Buffer
+		h.write(&b)
+		So(b.String(), ShouldEqual, strings.Join([]string{
+			"# HELP cytracker_test Test.",
+			"# TYPE cytracker_test histogram",
+			`cytracker_test_bucket{le="1"} 1`,
+			`cytracker_test_bucket{le="2"} 2`,
+			`cytracker_test_bucket{le="+Inf"} 3`,
+			"cytracker_test_sum 5",
+			"cytracker_test_count 3",
+			"",
+		}, "\n"))
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	Convey("Metrics endpoint", t, func() {
+		tracker := NewTracker()
+		tracker.SetPolicy(PolicyBlacklist)
+		tracker.Blacklist(testInfoHash("blacklisted012345678"))
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 0, 10, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 0, 10, ""))
+		get(mux, "/announce?"+announceQuery("blacklisted012345678", "leech", 7001, 0, 0, 10, ""))
+		get(mux, "/announce?info_hash=x")
+		get(mux, "/scrape")
+		tracker.reap(time.Now().Add(tracker.limits().peerTTL() + time.Minute))
+
+		w := httptest.NewRecorder()
+		tracker.newAdminMux().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		body := w.Body.String()
+		for _, line := range []string{
+			`cytracker_announces_total{event="none"} 1`,
+			`cytracker_announces_total{event="started"} 2`,
+			`cytracker_failures_total{reason="blacklisted"} 1`,
+			`cytracker_failures_total{reason="invalid_info_hash"} 1`,
+			`cytracker_scrapes_total 1`,
+			`cytracker_reaped_peers_total 2`,
+			`cytracker_reaped_torrents_total 1`,
+			`cytracker_announce_duration_seconds_count 5`,
+			`cytracker_torrents 0`,
+			`cytracker_seeders 0`,
+			`cytracker_leechers 0`,
+		} {
+			So(body, ShouldContainSubstring, line+"\n")
+		}
+	})
+}
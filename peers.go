@@ -2,83 +2,96 @@ package cytracker
 
 import (
 	"bytes"
-	"fmt"
-	"log"
 	"net"
 	"strconv"
 	"time"
 )
 
-// key is the client's listen address, in the form IP:port
+// key is the peer ID and IP address of the client, see newPeerKey
 type trackerPeers map[string]*trackerPeer
 
+// peerKeys lists the keys of the peers of a torrent in no particular order, so
+// that random peers are picked without walking the peer map. A peer knows its
+// index in the list.
+type peerKeys []string
+
 type trackerPeer struct {
 	listenAddr *net.TCPAddr
-	id         string
+	altAddr    *net.TCPAddr // listen address of the other IP family, if announced
+	clientIP   net.IP       // address the last announce came from, nil if unknown
+	id         PeerID
+	key        string // key= sent by the client to prove its identity, optional
 	lastSeen   time.Time
 	uploaded   uint64
 	downloaded uint64
 	left       uint64
+	limit      tokenBucket // of regular announces, refilled every MinInterval
+	response   bmap        // last response, kept with CacheEarlyAnnounces
+	asn        uint32      // of asnIP in asnTable, 0 if unknown
+	asnTable   *ASNTable
+	asnIP      net.IP // IP of listenAddr when asn was looked up
+	index      int    // in the peerKeys of the torrent
 }
 
 func (t trackerPeers) Add(key string, peer *trackerPeer) {
-	log.Printf("Peer %s joined", key)
 	t[key] = peer
 }
 
 func (t trackerPeers) Remove(key string) {
-	log.Printf("Peer %s removed", key)
 	delete(t, key)
 }
 
-func (t trackerPeers) pickRandomPeers(peerKey string, compact bool, count int) (peers []string) {
-	// Cheesy approximation to picking randomly from all peers.
-	// Depends upon the implementation detail that map iteration is pseudoRandom
-	for k, v := range t {
-		if k == peerKey {
-			continue
-		}
-		if compact && v.listenAddr.IP.To4() == nil {
-			continue
-		}
-		peers = append(peers, k)
-		if len(peers) == count {
-			break
-		}
-	}
-	return
+func (k *peerKeys) add(key string, peer *trackerPeer) {
+	peer.index = len(*k)
+	*k = append(*k, key)
+}
+
+// remove drops the key of peer by moving the last key in its place, peers must
+// still hold the peer of the last key
+func (k *peerKeys) remove(peers trackerPeers, peer *trackerPeer) {
+	last := len(*k) - 1
+	moved := (*k)[last]
+	(*k)[peer.index] = moved
+	peers[moved].index = peer.index
+	*k = (*k)[:last]
 }
 
-func (t trackerPeers) writeCompactPeers(b *bytes.Buffer, keys []string) (err error) {
+// writeCompactPeers writes IPv4 peers to b and IPv6 peers to b6, a dual-stack
+// peer is written to both
+func (t trackerPeers) writeCompactPeers(b, b6 *bytes.Buffer, keys []string) (err error) {
 	for _, k := range keys {
 		p := t[k]
-		la := p.listenAddr
-		ip4 := la.IP.To4()
-		if ip4 == nil {
-			err = fmt.Errorf("Can't write a compact peer for a non-IPv4 peer %v %v", k, p.listenAddr.String())
-			return
-		}
-		_, err = b.Write(ip4)
-		if err != nil {
-			return
+		if la := p.addr4(); la != nil {
+			if err = writeCompactPeer(b, la.IP.To4(), la.Port); err != nil {
+				return
+			}
 		}
-		port := la.Port
-		portBytes := []byte{byte(port >> 8), byte(port)}
-		_, err = b.Write(portBytes)
-		if err != nil {
-			return
+		if la := p.addr6(); la != nil {
+			if err = writeCompactPeer(b6, la.IP.To16(), la.Port); err != nil {
+				return
+			}
 		}
 	}
 	return
 }
 
+func writeCompactPeer(b *bytes.Buffer, ip net.IP, port int) (err error) {
+	_, err = b.Write(ip)
+	if err != nil {
+		return
+	}
+	portBytes := []byte{byte(port >> 8), byte(port)}
+	_, err = b.Write(portBytes)
+	return
+}
+
 func (t trackerPeers) getPeers(keys []string, noPeerID bool) (peers []bmap, err error) {
 	for _, k := range keys {
 		p := t[k]
 		la := p.listenAddr
 		var peer bmap = make(bmap)
 		if !noPeerID {
-			peer["peer id"] = p.id
+			peer["peer id"] = string(p.id[:])
 		}
 		peer["ip"] = la.IP.String()
 		peer["port"] = strconv.Itoa(la.Port)
@@ -87,19 +100,70 @@ func (t trackerPeers) getPeers(keys []string, noPeerID bool) (peers []bmap, err
 	return
 }
 
-func (t trackerTorrents) reap(deadline time.Time) {
-	for _, tt := range t {
-		tt.reap(deadline)
+// reap removes peers last seen before deadline and auto-registered torrents
+// left without peers, and returns their numbers
+func (t *trackerTorrents) reap(deadline time.Time) (peers, torrents int) {
+	t.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.Lock()
+		reaped := torrent.reap(t.log.with(infoHashField(infoHash)), deadline)
+		now := time.Now()
+		for _, peer := range reaped {
+			t.publish(torrent.newPeerEvent(EventReaped, now, infoHash, peer.id, peer.listenAddr))
+		}
+		peers += len(reaped)
+		empty := torrent.auto && len(torrent.peers) == 0
+		torrent.m.Unlock()
+		if empty && t.drop(infoHash, torrent) {
+			torrents++
+		}
+	})
+	return
+}
+
+// addr4 returns the IPv4 listen address of the peer, or nil
+func (t *trackerPeer) addr4() *net.TCPAddr {
+	for _, a := range []*net.TCPAddr{t.listenAddr, t.altAddr} {
+		if a != nil && a.IP.To4() != nil {
+			return a
+		}
 	}
+	return nil
 }
 
-func (t trackerPeers) reap(deadline time.Time) {
-	for address, peer := range t {
-		if deadline.After(peer.lastSeen) {
-			log.Println("reaping", address)
-			delete(t, address)
+// addr6 returns the IPv6 listen address of the peer, or nil
+func (t *trackerPeer) addr6() *net.TCPAddr {
+	for _, a := range []*net.TCPAddr{t.listenAddr, t.altAddr} {
+		if a != nil && a.IP.To4() == nil && a.IP.To16() != nil {
+			return a
 		}
 	}
+	return nil
+}
+
+// transfer is the amount of data a peer reported since its previous announce
+type transfer struct {
+	uploaded   uint64
+	downloaded uint64
+}
+
+// transferSince returns the data transferred since the previous announce of
+// the peer. Counters that went backwards mean the client restarted them.
+func (t *trackerPeer) transferSince(params *announceParams) (delta transfer) {
+	delta.uploaded = params.uploaded
+	if params.uploaded >= t.uploaded {
+		delta.uploaded -= t.uploaded
+	}
+	delta.downloaded = params.downloaded
+	if params.downloaded >= t.downloaded {
+		delta.downloaded -= t.downloaded
+	}
+	return
+}
+
+// hasIP reports whether any listen address of the peer or the address it
+// announces from is ip
+func (t *trackerPeer) hasIP(ip net.IP) bool {
+	return t.listenAddr.IP.Equal(ip) || (t.altAddr != nil && t.altAddr.IP.Equal(ip)) || t.clientIP.Equal(ip)
 }
 
 func (t *trackerPeer) isComplete() bool {
@@ -3,7 +3,9 @@ package cytracker
 import (
 	"errors"
 	"log"
+	"net"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -44,3 +46,134 @@ func TestTrackerStart(t *testing.T) {
 		}
 	})
 }
+
+func TestDualStackPeers(t *testing.T) {
+	Convey("Dual-stack peers", t, func() {
+		torrents := NewTrackerTorrents()
+		infoHash := testInfoHash("01234567890123456789")
+		now := time.Now()
+		announce := func(remote string, params announceParams) bmap {
+			params.infoHash = infoHash
+			params.compact = true
+			params.numWant = defaultPeerCount
+			response := make(bmap)
+			addr, err := newTrackerPeerListenAddress(remoteIP(remote), &params)
+			So(err, ShouldBeNil)
+			_, err = torrents.handleAnnounce(now, addr, &params, response)
+			So(err, ShouldBeNil)
+			return response
+		}
+
+		announce("10.0.0.1:1", announceParams{peerID: testPeerID("dual"), port: 7000, ipv6: "2001:db8::1"})
+		announce("[2001:db8::2]:1", announceParams{peerID: testPeerID("v6only"), port: 7001})
+
+		Convey("Compact response splits peers by family", func() {
+			response := announce("10.0.0.3:1", announceParams{peerID: testPeerID("other"), port: 7002, left: 1})
+			So(response[paramPeers], ShouldHaveLength, 6)
+			So(response[paramPeers6], ShouldHaveLength, 2*18)
+			So(response[paramIncomplete], ShouldEqual, 1)
+			So(response[paramComplete], ShouldEqual, 2)
+		})
+		Convey("Announce over the other family is the same peer", func() {
+			announce("[2001:db8::1]:1", announceParams{peerID: testPeerID("dual"), port: 7000})
+			So(torrents.get(infoHash).peers, ShouldHaveLength, 2)
+
+			Convey("Stopping removes the alias", func() {
+				announce("[2001:db8::1]:1", announceParams{peerID: testPeerID("dual"), port: 7000, event: "stopped"})
+				So(torrents.get(infoHash).peers, ShouldHaveLength, 1)
+				So(torrents.get(infoHash).aliases, ShouldBeEmpty)
+			})
+		})
+		Convey("Announce over the other family with ipv4= keeps both addresses", func() {
+			announce("[2001:db8::1]:1", announceParams{peerID: testPeerID("dual"), port: 7000, ipv4: "10.0.0.1"})
+			announce("[2001:db8::1]:1", announceParams{peerID: testPeerID("dual"), port: 7000})
+			torrent := torrents.get(infoHash)
+			So(torrent.peers, ShouldHaveLength, 2)
+			peer := torrent.peers[newPeerKey(testPeerID("dual"), net.ParseIP("10.0.0.1"))]
+			So(peer, ShouldNotBeNil)
+			So(peer.listenAddr.String(), ShouldEqual, "10.0.0.1:7000")
+			So(peer.altAddr.String(), ShouldEqual, "[2001:db8::1]:7000")
+
+			response := announce("10.0.0.3:1", announceParams{peerID: testPeerID("other"), port: 7002, left: 1})
+			So(response[paramPeers], ShouldEqual, "\x0a\x00\x00\x01\x1b\x58")
+			So(response[paramPeers6], ShouldHaveLength, 2*18)
+			So(response[paramPeers6], ShouldContainSubstring, string(net.ParseIP("2001:db8::1"))+"\x1b\x58")
+			So(response[paramPeers6], ShouldContainSubstring, string(net.ParseIP("2001:db8::2"))+"\x1b\x59")
+		})
+		Convey("A different peer ID on the alias is a new peer", func() {
+			announce("[2001:db8::1]:1", announceParams{peerID: testPeerID("impostor"), port: 7000})
+			So(torrents.get(infoHash).peers, ShouldHaveLength, 3)
+		})
+		Convey("Reaping removes aliases", func() {
+			torrent := torrents.get(infoHash)
+			peers, dropped := torrents.reap(now.Add(time.Second))
+			So(peers, ShouldEqual, 2)
+			So(torrent.peers, ShouldBeEmpty)
+			So(torrent.aliases, ShouldBeEmpty)
+			So(dropped, ShouldEqual, 1)
+			So(torrents.get(infoHash), ShouldBeNil)
+		})
+	})
+}
+
+func TestPeerIdentity(t *testing.T) {
+	Convey("Peer identity", t, func() {
+		torrents := NewTrackerTorrents()
+		infoHash := testInfoHash("01234567890123456789")
+		now := time.Now()
+		announce := func(addr string, params announceParams) {
+			listenAddr, err := net.ResolveTCPAddr("tcp", addr)
+			So(err, ShouldBeNil)
+			params.infoHash = infoHash
+			params.port = listenAddr.Port
+			_, err = torrents.handleAnnounce(now, listenAddr, &params, make(bmap))
+			So(err, ShouldBeNil)
+		}
+		peers := func() trackerPeers {
+			return torrents.get(infoHash).peers
+		}
+		id := testPeerID("client")
+		announce("10.0.0.1:7000", announceParams{peerID: id, event: "started", left: 10, key: "secret"})
+
+		Convey("Follows port changes", func() {
+			announce("10.0.0.1:7001", announceParams{peerID: id, left: 5})
+			So(peers(), ShouldHaveLength, 1)
+			So(peers()[newPeerKey(id, net.ParseIP("10.0.0.1"))].listenAddr.String(), ShouldEqual, "10.0.0.1:7001")
+		})
+		Convey("Tells apart clients behind one address", func() {
+			announce("10.0.0.1:7000", announceParams{peerID: testPeerID("neighbour"), event: "started"})
+			So(peers(), ShouldHaveLength, 2)
+		})
+		Convey("Follows IP changes proven by the key", func() {
+			announce("192.0.2.1:7000", announceParams{peerID: id, left: 5, key: "secret"})
+			So(peers(), ShouldHaveLength, 1)
+			peer := peers()[newPeerKey(id, net.ParseIP("192.0.2.1"))]
+			So(peer, ShouldNotBeNil)
+			So(peer.listenAddr.String(), ShouldEqual, "192.0.2.1:7000")
+			So(peer.left, ShouldEqual, 5)
+			So(torrents.get(infoHash).aliases, ShouldResemble, map[string]string{
+				keyAlias(id, "secret"): newPeerKey(id, net.ParseIP("192.0.2.1")),
+			})
+		})
+		Convey("Doesn't follow IP changes without the key", func() {
+			announce("192.0.2.1:7000", announceParams{peerID: id, event: "started"})
+			announce("192.0.2.2:7000", announceParams{peerID: id, event: "started", key: "guess"})
+			So(peers(), ShouldHaveLength, 3)
+			So(peers()[newPeerKey(id, net.ParseIP("10.0.0.1"))].left, ShouldEqual, 10)
+		})
+		Convey("Forgets keys with the peer", func() {
+			announce("10.0.0.1:7000", announceParams{peerID: id, event: "stopped"})
+			So(peers(), ShouldBeEmpty)
+			So(torrents.get(infoHash).aliases, ShouldBeEmpty)
+		})
+	})
+	Convey("Announce keys", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		query := announceQuery("01234567890123456789", "peer", 7000, 0, 0, 10, "started")
+		So(get(mux, "/announce?"+query+"&key=abcd1234"), ShouldContainKey, "interval")
+		So(get(mux, "/announce?"+query+"&key="+strings.Repeat("k", 65))["failure reason"], ShouldContainSubstring, "key")
+		torrent := tracker.torrents.get(testInfoHash("01234567890123456789"))
+		So(torrent.aliases, ShouldContainKey, keyAlias(testPeerID("peer"), "abcd1234"))
+	})
+}
@@ -0,0 +1,115 @@
+package cytracker
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+)
+
+// AccessPolicy decides which torrents the tracker serves
+type AccessPolicy int
+
+const (
+	// PolicyOpen tracks any torrent, registering unknown ones on first announce
+	PolicyOpen AccessPolicy = iota
+	// PolicyWhitelist tracks only torrents added with Register
+	PolicyWhitelist
+	// PolicyBlacklist tracks any torrent that is not blacklisted
+	PolicyBlacklist
+)
+
+var accessPolicyNames = []string{"open", "whitelist", "blacklist"}
+
+func (p AccessPolicy) String() string {
+	if p < 0 || int(p) >= len(accessPolicyNames) {
+		return fmt.Sprintf("AccessPolicy(%d)", int(p))
+	}
+	return accessPolicyNames[p]
+}
+
+// ParseAccessPolicy returns the policy named s
+func ParseAccessPolicy(s string) (p AccessPolicy, err error) {
+	for i, name := range accessPolicyNames {
+		if name == s {
+			return AccessPolicy(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown access policy %#v", s)
+	return
+}
+
+// checkAccess returns an error if the policy forbids tracking infoHash. torrent
+// is the tracked torrent or nil, the caller must hold its lock. A hybrid
+// torrent is blacklisted by the announced info hash and the one it is tracked
+// under, so it can't be reached through the other one.
+func (t *trackerTorrents) checkAccess(infoHash InfoHash, torrent *trackerTorrent) error {
+	canonical := t.resolve(infoHash)
+	t.m.RLock()
+	defer t.m.RUnlock()
+	switch t.policy {
+	case PolicyWhitelist:
+		if torrent == nil || torrent.auto {
+			return failure{"not_registered", fmt.Errorf("Torrent not registered")}
+		}
+	case PolicyBlacklist:
+		if t.blacklist[infoHash] || t.blacklist[canonical] {
+			return failure{"blacklisted", fmt.Errorf("Torrent is blacklisted")}
+		}
+	}
+	return nil
+}
+
+// SetPolicy changes the access policy, it applies to subsequent requests
+func (t *Tracker) SetPolicy(policy AccessPolicy) {
+	t.log.info("access policy", Field{"policy", policy.String()})
+	t.torrents.m.Lock()
+	defer t.torrents.m.Unlock()
+	t.torrents.policy = policy
+}
+
+// Policy returns the current access policy
+func (t *Tracker) Policy() AccessPolicy {
+	t.torrents.m.RLock()
+	defer t.torrents.m.RUnlock()
+	return t.torrents.policy
+}
+
+// SetBlacklist replaces the blacklist used by PolicyBlacklist. The blacklist
+// isn't saved to Storage, it has to be set again after a restart.
+func (t *Tracker) SetBlacklist(infoHashes []InfoHash) {
+	blacklist := make(map[InfoHash]bool, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		blacklist[infoHash] = true
+	}
+	t.torrents.m.Lock()
+	defer t.torrents.m.Unlock()
+	t.torrents.blacklist = blacklist
+}
+
+// Blacklist adds infoHash to the blacklist
+func (t *Tracker) Blacklist(infoHash InfoHash) {
+	t.torrents.m.Lock()
+	defer t.torrents.m.Unlock()
+	t.torrents.blacklist[infoHash] = true
+}
+
+// Blacklisted returns the blacklisted info hashes
+func (t *Tracker) Blacklisted() (infoHashes []InfoHash) {
+	t.torrents.m.RLock()
+	defer t.torrents.m.RUnlock()
+	infoHashes = []InfoHash{}
+	for infoHash := range t.torrents.blacklist {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	sort.Slice(infoHashes, func(i, j int) bool {
+		return bytes.Compare(infoHashes[i][:], infoHashes[j][:]) < 0
+	})
+	return
+}
+
+// Unblacklist removes infoHash from the blacklist
+func (t *Tracker) Unblacklist(infoHash InfoHash) {
+	t.torrents.m.Lock()
+	defer t.torrents.m.Unlock()
+	delete(t.torrents.blacklist, infoHash)
+}
@@ -0,0 +1,96 @@
+package cytracker
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAccessPolicyNames(t *testing.T) {
+	Convey("Access policy names", t, func() {
+		for _, p := range []AccessPolicy{PolicyOpen, PolicyWhitelist, PolicyBlacklist} {
+			parsed, err := ParseAccessPolicy(p.String())
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, p)
+		}
+		_, err := ParseAccessPolicy("closed")
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAccessPolicy(t *testing.T) {
+	Convey("Access policy", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		registered := "registered0123456789"
+		auto := "auto0123456789012345"
+		So(tracker.Register(testInfoHash(registered), "registered"), ShouldBeNil)
+		announce := func(infoHash string) map[string]interface{} {
+			return get(mux, "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 0, "started"))
+		}
+		So(announce(auto), ShouldNotContainKey, "failure reason")
+
+		Convey("Open tracks anything", func() {
+			So(announce("other012345678901234"), ShouldNotContainKey, "failure reason")
+			So(get(mux, "/scrape")["files"], ShouldHaveLength, 3)
+		})
+		Convey("Whitelist", func() {
+			tracker.SetPolicy(PolicyWhitelist)
+			So(tracker.Policy(), ShouldEqual, PolicyWhitelist)
+
+			So(announce(registered), ShouldNotContainKey, "failure reason")
+			So(announce("other012345678901234")["failure reason"], ShouldEqual, "Torrent not registered")
+			So(tracker.torrents.get(testInfoHash("other012345678901234")), ShouldBeNil)
+
+			Convey("Denies auto-registered torrents", func() {
+				So(announce(auto)["failure reason"], ShouldEqual, "Torrent not registered")
+				files := get(mux, "/scrape")["files"]
+				So(files, ShouldContainKey, registered)
+				So(files, ShouldNotContainKey, auto)
+				files = get(mux, "/scrape?info_hash="+auto)["files"]
+				So(files, ShouldBeEmpty)
+			})
+			Convey("Register takes over auto-registered torrents", func() {
+				So(tracker.Register(testInfoHash(auto), "now registered"), ShouldBeNil)
+				So(announce(auto), ShouldNotContainKey, "failure reason")
+				So(tracker.torrents.get(testInfoHash(auto)).name, ShouldEqual, "now registered")
+				So(tracker.torrents.get(testInfoHash(auto)).peers, ShouldHaveLength, 1)
+				So(tracker.Register(testInfoHash(auto), "again"), ShouldNotBeNil)
+			})
+		})
+		Convey("Blacklist", func() {
+			tracker.SetPolicy(PolicyBlacklist)
+			tracker.Blacklist(testInfoHash(auto))
+			So(announce(auto)["failure reason"], ShouldEqual, "Torrent is blacklisted")
+			So(announce(registered), ShouldNotContainKey, "failure reason")
+			So(get(mux, "/scrape")["files"], ShouldNotContainKey, auto)
+
+			So(tracker.Blacklisted(), ShouldResemble, []InfoHash{testInfoHash(auto)})
+
+			Convey("Can be reloaded", func() {
+				tracker.SetBlacklist([]InfoHash{testInfoHash(registered)})
+				So(tracker.Blacklisted(), ShouldResemble, []InfoHash{testInfoHash(registered)})
+				So(announce(auto), ShouldNotContainKey, "failure reason")
+				So(announce(registered)["failure reason"], ShouldEqual, "Torrent is blacklisted")
+			})
+			Convey("Unblacklist", func() {
+				tracker.Unblacklist(testInfoHash(auto))
+				So(announce(auto), ShouldNotContainKey, "failure reason")
+			})
+			Convey("Covers both info hashes of hybrid torrents", func() {
+				v2 := "v2infohash0123456789"
+				So(tracker.Link(testInfoHash(registered), testInfoHash(v2)), ShouldBeNil)
+				tracker.Blacklist(testInfoHash(registered))
+				So(announce(v2)["failure reason"], ShouldEqual, "Torrent is blacklisted")
+				So(get(mux, "/scrape?info_hash="+v2)["files"], ShouldBeEmpty)
+			})
+		})
+		Convey("Whitelist serves hybrid torrents by either info hash", func() {
+			tracker.SetPolicy(PolicyWhitelist)
+			v2 := "v2infohash0123456789"
+			So(tracker.Link(testInfoHash(registered), testInfoHash(v2)), ShouldBeNil)
+			So(announce(v2), ShouldNotContainKey, "failure reason")
+			So(get(mux, "/scrape?info_hash="+v2)["files"], ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,161 @@
+package cytracker
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// UserStore authenticates the passkeys of a private tracker and accounts the
+// traffic of their users. Implementations must be safe for concurrent use.
+type UserStore interface {
+	// Authenticate returns an error if passkey does not belong to an active user
+	Authenticate(passkey string) error
+	// Account adds transferred bytes to the user owning passkey
+	Account(passkey string, uploaded, downloaded uint64) error
+}
+
+// User is a private tracker user
+type User struct {
+	Name       string
+	Uploaded   uint64
+	Downloaded uint64
+}
+
+// Users is an in-memory UserStore
+type Users struct {
+	m     sync.Mutex // Protects users
+	users map[string]*User
+}
+
+func NewUsers() *Users {
+	return &Users{users: make(map[string]*User)}
+}
+
+// Add adds a user with passkey
+func (u *Users) Add(passkey, name string) (err error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if _, ok := u.users[passkey]; ok {
+		return fmt.Errorf("Passkey already registered")
+	}
+	u.users[passkey] = &User{Name: name}
+	return
+}
+
+// Remove revokes passkey
+func (u *Users) Remove(passkey string) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	delete(u.users, passkey)
+}
+
+// Get returns a copy of the user owning passkey
+func (u *Users) Get(passkey string) (user User, ok bool) {
+	u.m.Lock()
+	defer u.m.Unlock()
+	p, ok := u.users[passkey]
+	if ok {
+		user = *p
+	}
+	return
+}
+
+func (u *Users) Authenticate(passkey string) error {
+	u.m.Lock()
+	defer u.m.Unlock()
+	if _, ok := u.users[passkey]; !ok {
+		return fmt.Errorf("Unknown passkey")
+	}
+	return nil
+}
+
+func (u *Users) Account(passkey string, uploaded, downloaded uint64) error {
+	u.m.Lock()
+	defer u.m.Unlock()
+	user, ok := u.users[passkey]
+	if !ok {
+		return fmt.Errorf("Unknown passkey")
+	}
+	user.Uploaded += uploaded
+	user.Downloaded += downloaded
+	return nil
+}
+
+// splitPasskey splits a path of the form /<passkey>/rest
+func splitPasskey(urlPath string) (passkey, rest string) {
+	p := strings.TrimPrefix(urlPath, "/")
+	i := strings.Index(p, "/")
+	if i < 0 {
+		return "", urlPath
+	}
+	return p[:i], p[i:]
+}
+
+// authenticate checks the passkey in the request path
+func (t *Tracker) authenticate(urlPath string) (passkey string, err error) {
+	passkey, _ = splitPasskey(urlPath)
+	if blank(passkey) {
+		err = fmt.Errorf("Missing passkey")
+	} else {
+		err = t.Users.Authenticate(passkey)
+	}
+	if err != nil {
+		err = failure{"passkey", err}
+	}
+	return
+}
+
+func (t *Tracker) account(passkey string, delta transfer) {
+	if delta.uploaded == 0 && delta.downloaded == 0 {
+		return
+	}
+	if err := t.Users.Account(passkey, delta.uploaded, delta.downloaded); err != nil {
+		t.log.error("accounting failed", Field{"passkey", redactPasskey(passkey)}, Field{"uploaded", delta.uploaded},
+			Field{"downloaded", delta.downloaded}, errorField(err))
+	}
+}
+
+// redactPasskey returns a short hash of passkey, logs can tell passkeys apart
+// without leaking them
+func redactPasskey(passkey string) string {
+	sum := sha256.Sum256([]byte(passkey))
+	return "sha256:" + hex.EncodeToString(sum[:4])
+}
+
+// handlePrivate routes /<passkey>/announce and /<passkey>/scrape
+func (t *Tracker) handlePrivate(w http.ResponseWriter, r *http.Request) {
+	announce := t.Announce
+	if blank(announce) {
+		announce = defaultAnnounce
+	}
+	scrape := ScrapePattern(announce)
+	_, rest := splitPasskey(r.URL.Path)
+	switch {
+	case rest == announce:
+		t.handleAnnounce(w, r)
+	case !blank(scrape) && rest == scrape:
+		t.handleScrape(w, r)
+	case r.URL.Path == announce || r.URL.Path == scrape:
+		err := failure{"passkey", fmt.Errorf("Missing passkey")}
+		t.metrics.failed(err)
+		writeFailure(w, err)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// writeFailure writes a bencoded failure response
+func writeFailure(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain")
+	var b bytes.Buffer
+	if bencode.Marshal(&b, bmap{"failure reason": err.Error()}) == nil {
+		w.Write(b.Bytes())
+	}
+}
@@ -0,0 +1,131 @@
+package cytracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/jackpal/bencode-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// get performs a request against handler and decodes the bencoded response
+func get(handler http.Handler, target string) (response map[string]interface{}) {
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return map[string]interface{}{"status": w.Code}
+	}
+	decoded, err := bencode.Decode(w.Body)
+	So(err, ShouldBeNil)
+	response, ok := decoded.(map[string]interface{})
+	So(ok, ShouldBeTrue)
+	return
+}
+
+// announceQuery returns the query of an announce, peerID is padded to 20 bytes
+func announceQuery(infoHash, peerID string, port int, uploaded, downloaded, left uint64, event string) string {
+	id := testPeerID(peerID)
+	v := url.Values{}
+	v.Set(paramInfoHash, infoHash)
+	v.Set(paramPeerID, string(id[:]))
+	v.Set(paramPort, strconv.Itoa(port))
+	v.Set(paramUploaded, strconv.FormatUint(uploaded, 10))
+	v.Set(paramDownloaded, strconv.FormatUint(downloaded, 10))
+	v.Set(paramLeft, strconv.FormatUint(left, 10))
+	v.Set(paramCompact, "1")
+	if event != "" {
+		v.Set(paramEvent, event)
+	}
+	return v.Encode()
+}
+
+func TestSplitPasskey(t *testing.T) {
+	Convey("Splitting passkey from path", t, func() {
+		tests := []struct{ path, passkey, rest string }{
+			{"/abc/announce", "abc", "/announce"},
+			{"/abc/x/announce", "abc", "/x/announce"},
+			{"/abc/", "abc", "/"},
+			{"/announce", "", "/announce"},
+			{"//announce", "", "/announce"},
+		}
+		for _, test := range tests {
+			passkey, rest := splitPasskey(test.path)
+			So(passkey, ShouldEqual, test.passkey)
+			So(rest, ShouldEqual, test.rest)
+		}
+	})
+}
+
+func TestPrivateTracker(t *testing.T) {
+	Convey("Private tracker", t, func() {
+		tracker := NewTracker()
+		users := NewUsers()
+		So(users.Add("secret", "alice"), ShouldBeNil)
+		err := users.Add("secret", "bob")
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldNotContainSubstring, "secret")
+		tracker.Users = users
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+
+		Convey("Announce with passkey", func() {
+			response := get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 100, "started"))
+			So(response, ShouldNotContainKey, "failure reason")
+			So(response["incomplete"], ShouldEqual, 1)
+
+			Convey("Accounts transfer deltas", func() {
+				get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 10, 50, 50, ""))
+				get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 30, 100, 0, "completed"))
+				user, ok := users.Get("secret")
+				So(ok, ShouldBeTrue)
+				So(user.Uploaded, ShouldEqual, 30)
+				So(user.Downloaded, ShouldEqual, 100)
+			})
+			Convey("Restarted counters are counted from zero", func() {
+				get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 40, 40, 60, ""))
+				get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 5, 5, 55, ""))
+				user, _ := users.Get("secret")
+				So(user.Uploaded, ShouldEqual, 45)
+				So(user.Downloaded, ShouldEqual, 45)
+			})
+			Convey("Scrape with passkey", func() {
+				response := get(mux, "/secret/scrape")
+				So(response["files"], ShouldContainKey, infoHash)
+			})
+		})
+		Convey("Unknown passkey", func() {
+			response := get(mux, "/wrong/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 100, "started"))
+			So(response["failure reason"], ShouldEqual, "Unknown passkey")
+			response = get(mux, "/wrong/scrape")
+			So(response["failure reason"], ShouldEqual, "Unknown passkey")
+		})
+		Convey("Missing passkey", func() {
+			response := get(mux, "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 100, "started"))
+			So(response["failure reason"], ShouldEqual, "Missing passkey")
+		})
+		Convey("Revoked passkey", func() {
+			users.Remove("secret")
+			response := get(mux, "/secret/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 100, "started"))
+			So(response["failure reason"], ShouldEqual, "Unknown passkey")
+		})
+		Convey("Other paths", func() {
+			response := get(mux, "/secret/foo")
+			So(response["status"], ShouldEqual, http.StatusNotFound)
+		})
+		Convey("Logs no passkeys", func() {
+			l := &recordingLogger{}
+			tracker.SetLogger(l)
+			users.Remove("secret")
+			tracker.account("secret", transfer{uploaded: 10})
+			m, ok := l.find("accounting failed")
+			So(ok, ShouldBeTrue)
+			So(m.fields["passkey"], ShouldEqual, redactPasskey("secret"))
+			So(m.fields["passkey"], ShouldNotContainSubstring, "secret")
+		})
+	})
+}
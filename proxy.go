@@ -0,0 +1,274 @@
+package cytracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout is how long a trusted proxy may take to send the PROXY
+// protocol header of a connection
+const proxyHeaderTimeout = 10 * time.Second
+
+// ClientIPPolicy decides when the addresses a client announces with the ip=,
+// ipv4= and ipv6= parameters are used instead of the address its request
+// comes from
+type ClientIPPolicy int
+
+const (
+	// ClientIPAlways uses any announced address. It is the zero value, which
+	// keeps the behavior of older versions, though it lets clients point
+	// peers at any host.
+	ClientIPAlways ClientIPPolicy = iota
+	// ClientIPNever ignores announced addresses
+	ClientIPNever
+	// ClientIPPrivate uses announced private addresses (RFC 1918 and RFC
+	// 4193), which can't point peers at hosts on the internet
+	ClientIPPrivate
+)
+
+var clientIPPolicyNames = []string{"always", "never", "private"}
+
+func (p ClientIPPolicy) String() string {
+	if p < 0 || int(p) >= len(clientIPPolicyNames) {
+		return fmt.Sprintf("ClientIPPolicy(%d)", int(p))
+	}
+	return clientIPPolicyNames[p]
+}
+
+// ParseClientIPPolicy returns the client IP policy named s
+func ParseClientIPPolicy(s string) (p ClientIPPolicy, err error) {
+	for i, name := range clientIPPolicyNames {
+		if name == s {
+			return ClientIPPolicy(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown client IP policy %#v", s)
+	return
+}
+
+// allows reports whether the announced address s is used, s is an IP address
+// or a host name, with or without a port
+func (p ClientIPPolicy) allows(s string) bool {
+	switch p {
+	case ClientIPAlways:
+		return true
+	case ClientIPPrivate:
+		addr, err := parseEndpoint(s, 0)
+		return err == nil && addr.IP.IsPrivate()
+	}
+	return false
+}
+
+// applyClientIPPolicy drops the addresses announced by the client that the
+// ClientIP policy doesn't allow
+func (t *Tracker) applyClientIPPolicy(params *announceParams) {
+	for _, s := range []*string{&params.ip, &params.ipv4, &params.ipv6} {
+		if !blank(*s) && !t.ClientIP.allows(*s) {
+			t.log.debug("ignoring announced address", Field{"addr", *s}, Field{"policy", t.ClientIP.String()})
+			*s = ""
+		}
+	}
+}
+
+// ParseNetworks parses IP addresses and CIDR networks like 10.0.0.0/8
+func ParseNetworks(s []string) (networks []*net.IPNet, err error) {
+	for _, n := range s {
+		var network *net.IPNet
+		if ip := net.ParseIP(n); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, network, err = net.ParseCIDR(n); err != nil {
+			return nil, fmt.Errorf("Invalid network %#v", n)
+		}
+		networks = append(networks, network)
+	}
+	return
+}
+
+// trusted reports whether ip is the address of a trusted proxy
+func (t *Tracker) trusted(ip net.IP) bool {
+	for _, network := range t.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of r: the remote address, or
+// the address forwarded by trusted proxies in X-Forwarded-For or X-Real-IP
+func (t *Tracker) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r.RemoteAddr)
+	if ip == nil || !t.trusted(ip) {
+		return ip
+	}
+	// the nearest address not of a trusted proxy is the client, addresses
+	// further left may be made up by it
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	if len(forwarded) > 0 {
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			next := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if next == nil {
+				break
+			}
+			ip = next
+			if !t.trusted(ip) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); realIP != nil {
+		return realIP
+	}
+	return ip
+}
+
+// remoteIP returns the IP address of the remote address of a request, or nil
+func remoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// proxyListener reads the PROXY protocol header of connections from trusted
+// proxies
+type proxyListener struct {
+	net.Listener
+	t *Tracker
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return c, err
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && l.t.trusted(addr.IP) {
+		return &proxyConn{Conn: c}, nil
+	}
+	return c, nil
+}
+
+// proxyConn is a connection starting with a PROXY protocol header, which is
+// read on first use so that Accept doesn't wait for it
+type proxyConn struct {
+	net.Conn
+	once sync.Once
+	r    *bufio.Reader
+	addr net.Addr // of the client, nil if the header has none
+	err  error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.r = bufio.NewReader(c.Conn)
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.addr, c.err = readProxyHeader(c.r)
+		c.Conn.SetReadDeadline(time.Time{})
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.addr != nil {
+		return c.addr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header and returns the
+// source address, or nil for health checks of the proxy and unknown protocols
+func readProxyHeader(r *bufio.Reader) (addr net.Addr, err error) {
+	start, err := r.Peek(len(proxyV2Signature))
+	switch {
+	case err != nil:
+		return nil, fmt.Errorf("Missing PROXY protocol header: %v", err)
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	}
+	return nil, fmt.Errorf("Missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads a line like "PROXY TCP4 192.0.2.1 192.0.2.2 5000 80"
+func readProxyHeaderV1(r *bufio.Reader) (addr net.Addr, err error) {
+	// the longest v1 header is 107 bytes
+	line, err := r.ReadSlice('\n')
+	if err != nil || len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, fmt.Errorf("Malformed PROXY protocol header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("Malformed PROXY protocol header %#v", string(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("Malformed PROXY protocol header %#v", string(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyHeaderV2 reads a binary header
+func readProxyHeaderV2(r *bufio.Reader) (addr net.Addr, err error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return
+	}
+	versionCommand, family := header[12], header[13]
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err = io.ReadFull(r, body); err != nil {
+		return
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("Unknown PROXY protocol version %d", versionCommand>>4)
+	}
+	if versionCommand&0xf == 0 {
+		// LOCAL, a connection of the proxy itself
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 1:
+		if len(body) >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+		}
+	case 2:
+		if len(body) >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+		}
+	default:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("Truncated PROXY protocol header")
+}
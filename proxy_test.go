@@ -0,0 +1,236 @@
+package cytracker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClientIP(t *testing.T) {
+	Convey("Client IP policies", t, func() {
+		for _, name := range clientIPPolicyNames {
+			p, err := ParseClientIPPolicy(name)
+			So(err, ShouldBeNil)
+			So(p.String(), ShouldEqual, name)
+		}
+		_, err := ParseClientIPPolicy("sometimes")
+		So(err, ShouldNotBeNil)
+
+		So(ClientIPAlways.allows("example.com"), ShouldBeTrue)
+		So(ClientIPNever.allows("10.0.0.1"), ShouldBeFalse)
+		So(ClientIPPrivate.allows("10.0.0.1"), ShouldBeTrue)
+		So(ClientIPPrivate.allows("[fd00::1]:7000"), ShouldBeTrue)
+		So(ClientIPPrivate.allows("192.0.2.1"), ShouldBeFalse)
+		So(ClientIPPrivate.allows("example.com"), ShouldBeFalse)
+	})
+	Convey("Trusted proxy networks", t, func() {
+		networks, err := ParseNetworks([]string{"127.0.0.1", "10.0.0.0/8", "::1"})
+		So(err, ShouldBeNil)
+		So(networks, ShouldHaveLength, 3)
+		So(networks[0].Contains(net.ParseIP("127.0.0.1")), ShouldBeTrue)
+		So(networks[0].Contains(net.ParseIP("127.0.0.2")), ShouldBeFalse)
+		So(networks[1].Contains(net.ParseIP("10.1.2.3")), ShouldBeTrue)
+		So(networks[2].Contains(net.ParseIP("::1")), ShouldBeTrue)
+		_, err = ParseNetworks([]string{"10.0.0.0/33"})
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Client addresses", t, func() {
+		tracker := NewTracker()
+		tracker.TrustedProxies, _ = ParseNetworks([]string{"127.0.0.1", "10.0.0.0/8"})
+		request := func(remoteAddr string, header ...string) *http.Request {
+			r := httptest.NewRequest("GET", "/announce", nil)
+			r.RemoteAddr = remoteAddr
+			for i := 0; i < len(header); i += 2 {
+				r.Header.Add(header[i], header[i+1])
+			}
+			return r
+		}
+		clientIP := func(r *http.Request) string {
+			return tracker.clientIP(r).String()
+		}
+
+		So(clientIP(request("192.0.2.1:1234")), ShouldEqual, "192.0.2.1")
+		Convey("are forwarded by trusted proxies", func() {
+			So(clientIP(request("127.0.0.1:1234", "X-Forwarded-For", "192.0.2.1")), ShouldEqual, "192.0.2.1")
+			So(clientIP(request("127.0.0.1:1234", "X-Real-IP", "2001:db8::1")), ShouldEqual, "2001:db8::1")
+			So(clientIP(request("127.0.0.1:1234", "X-Forwarded-For", "198.51.100.1, 192.0.2.1, 10.0.0.2")), ShouldEqual, "192.0.2.1")
+			So(clientIP(request("127.0.0.1:1234", "X-Forwarded-For", "198.51.100.1", "X-Forwarded-For", "192.0.2.1")), ShouldEqual, "192.0.2.1")
+			So(clientIP(request("127.0.0.1:1234", "X-Forwarded-For", "10.0.0.3")), ShouldEqual, "10.0.0.3")
+			So(clientIP(request("127.0.0.1:1234", "X-Forwarded-For", "garbage")), ShouldEqual, "127.0.0.1")
+		})
+		Convey("are not forwarded by others", func() {
+			So(clientIP(request("192.0.2.1:1234", "X-Forwarded-For", "198.51.100.1")), ShouldEqual, "192.0.2.1")
+			So(clientIP(request("192.0.2.1:1234", "X-Real-IP", "198.51.100.1")), ShouldEqual, "192.0.2.1")
+		})
+	})
+	Convey("Announced addresses", t, func() {
+		tracker := NewTracker()
+		tracker.TrustedProxies, _ = ParseNetworks([]string{"127.0.0.1"})
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		announce := func(peerID string, port int, ip string) (addr string) {
+			query := announceQuery(infoHash, peerID, port, 0, 0, 10, "started")
+			if ip != "" {
+				query += "&ip=" + ip
+			}
+			r := httptest.NewRequest("GET", "/announce?"+query, nil)
+			r.RemoteAddr = "127.0.0.1:1234"
+			r.Header.Set("X-Forwarded-For", "192.0.2.1")
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			decoded, err := bencode.Decode(w.Body)
+			So(err, ShouldBeNil)
+			So(decoded, ShouldContainKey, "interval")
+			torrent := tracker.torrents.get(testInfoHash(infoHash))
+			for _, peer := range torrent.peers {
+				if peer.id == testPeerID(peerID) {
+					addr = peer.listenAddr.String()
+				}
+			}
+			return
+		}
+
+		So(announce("forwarded", 7000, ""), ShouldEqual, "192.0.2.1:7000")
+		So(announce("always", 7001, "198.51.100.1"), ShouldEqual, "198.51.100.1:7001")
+		Convey("are ignored by policy", func() {
+			tracker.ClientIP = ClientIPNever
+			So(announce("never", 7002, "10.0.0.1"), ShouldEqual, "192.0.2.1:7002")
+			tracker.ClientIP = ClientIPPrivate
+			So(announce("public", 7003, "198.51.100.1"), ShouldEqual, "192.0.2.1:7003")
+			So(announce("private", 7004, "10.0.0.1"), ShouldEqual, "10.0.0.1:7004")
+		})
+	})
+	Convey("Validation", t, func() {
+		tracker := NewTracker()
+		tracker.ProxyProtocol = true
+		So(tracker.Validate(), ShouldNotBeNil)
+		tracker.TrustedProxies, _ = ParseNetworks([]string{"127.0.0.1"})
+		So(tracker.Validate(), ShouldBeNil)
+		tracker.ClientIP = ClientIPPolicy(7)
+		So(tracker.Validate(), ShouldNotBeNil)
+	})
+}
+
+// proxyV2Header returns a PROXY protocol v2 header of a TCP connection from src
+func proxyV2Header(src *net.TCPAddr) []byte {
+	var b bytes.Buffer
+	b.Write(proxyV2Signature)
+	b.WriteByte(0x21) // version 2, PROXY
+	if ip := src.IP.To4(); ip != nil {
+		b.WriteByte(0x11) // TCP over IPv4
+		binary.Write(&b, binary.BigEndian, uint16(12))
+		b.Write(ip)
+		b.Write(net.IPv4(127, 0, 0, 1).To4())
+	} else {
+		b.WriteByte(0x21) // TCP over IPv6
+		binary.Write(&b, binary.BigEndian, uint16(36))
+		b.Write(src.IP.To16())
+		b.Write(net.IPv6loopback)
+	}
+	binary.Write(&b, binary.BigEndian, uint16(src.Port))
+	binary.Write(&b, binary.BigEndian, uint16(80))
+	return b.Bytes()
+}
+
+func TestProxyProtocol(t *testing.T) {
+	Convey("PROXY protocol headers", t, func() {
+		read := func(header string) (net.Addr, string, error) {
+			r := bufio.NewReader(strings.NewReader(header + "GET /"))
+			addr, err := readProxyHeader(r)
+			rest, _ := r.ReadString(0)
+			return addr, rest, err
+		}
+
+		Convey("v1", func() {
+			addr, rest, err := read("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\n")
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "192.0.2.1:5000")
+			So(rest, ShouldEqual, "GET /")
+			addr, _, err = read("PROXY TCP6 2001:db8::1 ::1 5000 80\r\n")
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::1]:5000")
+			addr, _, err = read("PROXY UNKNOWN\r\n")
+			So(err, ShouldBeNil)
+			So(addr, ShouldBeNil)
+		})
+		Convey("v2", func() {
+			addr, rest, err := read(string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000})))
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "192.0.2.1:5000")
+			So(rest, ShouldEqual, "GET /")
+			addr, _, err = read(string(proxyV2Header(&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000})))
+			So(err, ShouldBeNil)
+			So(addr.String(), ShouldEqual, "[2001:db8::1]:5000")
+			local := proxyV2Header(&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 5000})
+			local[12] = 0x20
+			addr, rest, err = read(string(local))
+			So(err, ShouldBeNil)
+			So(addr, ShouldBeNil)
+			So(rest, ShouldEqual, "GET /")
+		})
+		Convey("malformed", func() {
+			for _, header := range []string{
+				"",
+				"GET / HTTP/1.1\r\n",
+				"PROXY TCP4 192.0.2.1 127.0.0.1 5000\r\n",
+				"PROXY TCP4 nowhere 127.0.0.1 5000 80\r\n",
+				"PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\n",
+				"PROXY TCP4 192.0.2.1 127.0.0.1 5000 80" + strings.Repeat(" ", 100) + "\r\n",
+				string(proxyV2Signature) + "\x21\x11\x00\x04abcd",
+			} {
+				_, _, err := read(header)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+	Convey("PROXY protocol listener", t, func() {
+		tracker := NewTracker()
+		tracker.TrustedProxies, _ = ParseNetworks([]string{"127.0.0.1"})
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		So(err, ShouldBeNil)
+		defer l.Close()
+		pl := proxyListener{l, tracker}
+		accept := func(header string) net.Conn {
+			c, err := net.Dial("tcp", l.Addr().String())
+			So(err, ShouldBeNil)
+			c.Write([]byte(header + "hello"))
+			defer c.Close()
+			conn, err := pl.Accept()
+			So(err, ShouldBeNil)
+			return conn
+		}
+
+		conn := accept("PROXY TCP4 192.0.2.1 127.0.0.1 5000 80\r\n")
+		defer conn.Close()
+		So(conn.RemoteAddr().String(), ShouldEqual, "192.0.2.1:5000")
+		conn.SetReadDeadline(time.Now().Add(trackerStopTimeOut))
+		b := make([]byte, 5)
+		_, err = conn.Read(b)
+		So(err, ShouldBeNil)
+		So(string(b), ShouldEqual, "hello")
+
+		Convey("fails connections without a header", func() {
+			conn := accept("")
+			defer conn.Close()
+			_, err := conn.Read(b)
+			So(err, ShouldNotBeNil)
+		})
+		Convey("leaves untrusted connections alone", func() {
+			tracker.TrustedProxies = nil
+			conn := accept("")
+			defer conn.Close()
+			_, err := conn.Read(b)
+			So(err, ShouldBeNil)
+			So(string(b), ShouldEqual, "hello")
+		})
+	})
+}
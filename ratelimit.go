@@ -0,0 +1,116 @@
+package cytracker
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnnounceBurst     = 10
+	defaultPeerAnnounceBurst = 1
+	rateLimiterShards        = 64
+)
+
+// tokenBucket allows burst events at once and rate events per second on
+// average
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take removes a token if there is one, the bucket refills for the time since
+// the previous call
+func (b *tokenBucket) take(now time.Time, rate float64, burst int) bool {
+	b.tokens = b.available(now, rate, burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// available returns the tokens in the bucket at now, a new bucket is full
+func (b *tokenBucket) available(now time.Time, rate float64, burst int) float64 {
+	if b.last.IsZero() {
+		return float64(burst)
+	}
+	tokens := b.tokens
+	if now.After(b.last) {
+		tokens += now.Sub(b.last).Seconds() * rate
+	}
+	if tokens > float64(burst) {
+		tokens = float64(burst)
+	}
+	return tokens
+}
+
+type rateLimiterShard struct {
+	m       sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// ipRateLimiter limits announces per remote IP address, the zero value is
+// ready to use
+type ipRateLimiter struct {
+	shards [rateLimiterShards]rateLimiterShard
+}
+
+// allow takes a token of the bucket of ip
+func (l *ipRateLimiter) allow(ip net.IP, now time.Time, rate float64, burst int) bool {
+	key := ip.To16()
+	s := &l.shards[fnv1a(key)%rateLimiterShards]
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.buckets == nil {
+		s.buckets = make(map[string]*tokenBucket)
+	}
+	b, ok := s.buckets[string(key)]
+	if !ok {
+		// MEMORY_ALLOCATION
+		b = new(tokenBucket)
+		s.buckets[string(key)] = b
+	}
+	return b.take(now, rate, burst)
+}
+
+// reap forgets the buckets that refilled, they are the same as new ones, and
+// returns their number
+func (l *ipRateLimiter) reap(now time.Time, rate float64, burst int) (reaped int) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.m.Lock()
+		for key, b := range s.buckets {
+			if rate <= 0 || b.available(now, rate, burst) >= float64(burst) {
+				delete(s.buckets, key)
+				reaped++
+			}
+		}
+		s.m.Unlock()
+	}
+	return
+}
+
+// fnv1a returns the FNV-1a hash of b
+func fnv1a(b []byte) uint32 {
+	h := uint32(2166136261)
+	for _, c := range b {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// checkAnnounceRate returns a failure if the IP address announces faster than
+// AnnounceRate allows
+func (t *Tracker) checkAnnounceRate(ip net.IP, now time.Time, limits Limits) error {
+	if limits.AnnounceRate <= 0 || ip == nil {
+		return nil
+	}
+	if !t.announceLimiter.allow(ip, now, limits.AnnounceRate, limits.announceBurst()) {
+		return failure{"rate_limited", fmt.Errorf("Too many announces from %v, slow down", ip)}
+	}
+	return nil
+}
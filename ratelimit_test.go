@@ -0,0 +1,125 @@
+package cytracker
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTokenBucket(t *testing.T) {
+	Convey("Token buckets", t, func() {
+		var b tokenBucket
+		now := time.Now()
+		Convey("allow a burst", func() {
+			for i := 0; i < 3; i++ {
+				So(b.take(now, 1, 3), ShouldBeTrue)
+			}
+			So(b.take(now, 1, 3), ShouldBeFalse)
+		})
+		Convey("refill at the rate", func() {
+			So(b.take(now, 0.5, 1), ShouldBeTrue)
+			So(b.take(now.Add(time.Second), 0.5, 1), ShouldBeFalse)
+			So(b.take(now.Add(2*time.Second), 0.5, 1), ShouldBeTrue)
+		})
+		Convey("hold at most a burst", func() {
+			So(b.take(now, 1, 2), ShouldBeTrue)
+			So(b.available(now.Add(time.Hour), 1, 2), ShouldEqual, 2)
+		})
+	})
+	Convey("IP rate limiter", t, func() {
+		var l ipRateLimiter
+		now := time.Now()
+		ip := net.IPv4(10, 0, 0, 1)
+		So(l.allow(ip, now, 1, 2), ShouldBeTrue)
+		So(l.allow(ip, now, 1, 2), ShouldBeTrue)
+		So(l.allow(ip, now, 1, 2), ShouldBeFalse)
+		So(l.allow(net.ParseIP("::ffff:10.0.0.1"), now, 1, 2), ShouldBeFalse)
+		So(l.allow(net.IPv4(10, 0, 0, 2), now, 1, 2), ShouldBeTrue)
+
+		So(l.reap(now.Add(time.Second), 1, 2), ShouldEqual, 1)
+		So(l.reap(now.Add(2*time.Second), 1, 2), ShouldEqual, 1)
+		So(l.reap(now.Add(2*time.Second), 1, 2), ShouldEqual, 0)
+	})
+}
+
+func TestAnnounceRateLimits(t *testing.T) {
+	Convey("Announce rate limits", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		announce := func(peerID string, port int, event string) map[string]interface{} {
+			return get(mux, "/announce?"+announceQuery(infoHash, peerID, port, 0, 0, 10, event))
+		}
+
+		Convey("Are off by default", func() {
+			for i := 0; i < 20; i++ {
+				So(announce("peer", 7000, ""), ShouldContainKey, "interval")
+			}
+		})
+		Convey("Limit IP addresses", func() {
+			tracker.AnnounceRate = 0.001
+			tracker.AnnounceBurst = 2
+			So(announce("a", 7000, "started"), ShouldContainKey, "interval")
+			So(announce("b", 7001, "started"), ShouldContainKey, "interval")
+			So(announce("c", 7002, "started")["failure reason"], ShouldContainSubstring, "Too many announces")
+			So(tracker.metrics.failures.values["rate_limited"], ShouldEqual, 1)
+
+			tracker.reap(time.Now().Add(time.Hour))
+			So(announce("c", 7002, "started"), ShouldContainKey, "interval")
+		})
+		Convey("Enforce the min interval per peer", func() {
+			tracker.MinInterval = time.Minute
+			So(announce("peer", 7000, "started")["min interval"], ShouldEqual, 60)
+			So(announce("peer", 7000, "")["failure reason"], ShouldContainSubstring, "too early")
+			So(announce("other", 7001, "started"), ShouldContainKey, "interval")
+			So(tracker.metrics.failures.values["too_early"], ShouldEqual, 1)
+
+			Convey("except for events", func() {
+				So(announce("peer", 7000, "completed"), ShouldContainKey, "interval")
+				So(announce("peer", 7000, "stopped"), ShouldContainKey, "interval")
+				So(announce("peer", 7000, "started"), ShouldContainKey, "interval")
+			})
+			Convey("after the burst", func() {
+				tracker.PeerAnnounceBurst = 3
+				So(announce("new", 7002, ""), ShouldContainKey, "interval")
+				So(announce("new", 7002, ""), ShouldContainKey, "interval")
+				So(announce("new", 7002, ""), ShouldContainKey, "interval")
+				So(announce("new", 7002, "")["failure reason"], ShouldContainSubstring, "too early")
+			})
+			Convey("with cached responses", func() {
+				tracker.CacheEarlyAnnounces = true
+				first := announce("cached", 7002, "started")
+				So(announce("late", 7003, "started")["incomplete"], ShouldEqual, 4)
+				early := announce("cached", 7002, "")
+				So(early["incomplete"], ShouldEqual, first["incomplete"])
+				So(early["peers"], ShouldEqual, first["peers"])
+				So(early, ShouldContainKey, "min interval")
+			})
+		})
+		Convey("Are validated", func() {
+			So(tracker.SetLimits(Limits{AnnounceRate: -1}), ShouldNotBeNil)
+			So(tracker.SetLimits(Limits{PeerAnnounceBurst: -1}), ShouldNotBeNil)
+			So(tracker.SetLimits(Limits{AnnounceRate: 10, AnnounceBurst: 20}), ShouldBeNil)
+		})
+	})
+	Convey("UDP announce rate limits", t, func() {
+		tracker := NewTracker()
+		tracker.AnnounceRate = 0.001
+		tracker.AnnounceBurst = 1
+		now := time.Now()
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+		response := tracker.handleUDPPacket(now, udpConnectRequest(1), addr)
+		connectionID := binary.BigEndian.Uint64(response[8:16])
+		infoHash := strings.Repeat("h", 20)
+
+		response = tracker.handleUDPPacket(now, udpAnnounceRequest(connectionID, infoHash, strings.Repeat("p", 20), 10, 2, 7000), addr)
+		So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionAnnounce)
+		response = tracker.handleUDPPacket(now, udpAnnounceRequest(connectionID, infoHash, strings.Repeat("q", 20), 10, 2, 7001), addr)
+		So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionError)
+		So(string(response[8:]), ShouldContainSubstring, "Too many announces")
+	})
+}
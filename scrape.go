@@ -2,12 +2,59 @@ package cytracker
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
+// FullScrapeMode decides how scrapes without info hashes, which return every
+// torrent, are answered
+type FullScrapeMode int
+
+const (
+	// FullScrapeOn answers every full scrape
+	FullScrapeOn FullScrapeMode = iota
+	// FullScrapeOff refuses full scrapes
+	FullScrapeOff
+	// FullScrapeLimited answers one full scrape per FullScrapeInterval and
+	// refuses the others
+	FullScrapeLimited
+	// FullScrapeCached answers full scrapes from a snapshot refreshed every
+	// FullScrapeInterval
+	FullScrapeCached
+)
+
+var fullScrapeModeNames = []string{"on", "off", "limited", "cached"}
+
+func (m FullScrapeMode) String() string {
+	if m < 0 || int(m) >= len(fullScrapeModeNames) {
+		return fmt.Sprintf("FullScrapeMode(%d)", int(m))
+	}
+	return fullScrapeModeNames[m]
+}
+
+// ParseFullScrapeMode returns the full scrape mode named s
+func ParseFullScrapeMode(s string) (m FullScrapeMode, err error) {
+	for i, name := range fullScrapeModeNames {
+		if name == s {
+			return FullScrapeMode(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown full scrape mode %#v", s)
+	return
+}
+
+// fullScrapes is the state of rate limited and cached full scrapes
+type fullScrapes struct {
+	m     sync.Mutex // Protects last and files
+	last  time.Time  // of the last full scrape answered or cached
+	files bmap       // cached full scrape
+}
+
 func ScrapePattern(announcePattern string) string {
 	lastSlashIndex := strings.LastIndex(announcePattern, "/")
 	if lastSlashIndex >= 0 {
@@ -23,17 +70,84 @@ func ScrapePattern(announcePattern string) string {
 }
 
 func (t *Tracker) handleScrape(w http.ResponseWriter, r *http.Request) {
+	if t.Users != nil {
+		if _, err := t.authenticate(r.URL.Path); err != nil {
+			t.metrics.failed(err)
+			writeFailure(w, err)
+			return
+		}
+	}
+	limits := t.limits()
+	files, err := t.scrape(r.URL.Query()[paramInfoHash], limits)
+	if err != nil {
+		t.metrics.failed(err)
+		writeFailure(w, err)
+		return
+	}
+	t.metrics.scrapes.inc("")
 	w.Header().Set("Content-Type", "text/plain")
-	infoHashes := r.URL.Query()["info_hash"]
 	response := make(bmap)
-	response["files"] = t.torrents.scrape(infoHashes)
+	response["files"] = files
+	response["flags"] = bmap{"min_request_interval": int(limits.scrapeInterval() / time.Second)}
 	var b bytes.Buffer
-	err := bencode.Marshal(&b, response)
+	err = bencode.Marshal(&b, response)
 	if err == nil {
 		w.Write(b.Bytes())
 	}
 }
 
+// scrape returns the files of a scrape for the raw info hashes, or of a full
+// scrape if there are none
+func (t *Tracker) scrape(rawInfoHashes []string, limits Limits) (files bmap, err error) {
+	if len(rawInfoHashes) == 0 {
+		return t.fullScrape(time.Now(), limits)
+	}
+	if len(rawInfoHashes) > limits.maxScrapeHashes() {
+		rawInfoHashes = rawInfoHashes[:limits.maxScrapeHashes()]
+	}
+	infoHashes := make([]InfoHash, len(rawInfoHashes))
+	for i, raw := range rawInfoHashes {
+		if infoHashes[i], err = NewInfoHash(raw); err != nil {
+			return
+		}
+	}
+	return t.torrents.scrape(infoHashes), nil
+}
+
+// fullScrape returns the files of a scrape without info hashes, or an error if
+// the full scrape mode refuses it
+func (t *Tracker) fullScrape(now time.Time, limits Limits) (files bmap, err error) {
+	switch limits.FullScrape {
+	case FullScrapeOff:
+		return nil, failure{"full_scrape_disabled", fmt.Errorf("Full scrape is disabled")}
+	case FullScrapeLimited, FullScrapeCached:
+	default:
+		return t.torrents.scrape(nil), nil
+	}
+	// holding the lock while scraping, so that concurrent requests don't
+	// refresh the cache together
+	s := &t.fullScrapes
+	s.m.Lock()
+	defer s.m.Unlock()
+	interval := limits.fullScrapeInterval()
+	fresh := !s.last.IsZero() && now.Sub(s.last) < interval
+	switch {
+	case fresh && limits.FullScrape == FullScrapeLimited:
+		err = failure{"full_scrape_limited", fmt.Errorf("Full scrape is limited to one per %v", interval)}
+	case fresh && s.files != nil:
+		files = s.files
+	default:
+		files = t.torrents.scrape(nil)
+		s.last = now
+		s.files = nil
+		if limits.FullScrape == FullScrapeCached {
+			// files is only read from now on
+			s.files = files
+		}
+	}
+	return
+}
+
 // scrape returns data about torrent
 func (t *trackerTorrent) scrape() (response bmap) {
 	response = make(bmap)
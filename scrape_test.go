@@ -1,7 +1,11 @@
 package cytracker
 
 import (
+	"fmt"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -21,3 +25,82 @@ func TestScrapeURL(t *testing.T) {
 		}
 	})
 }
+
+func TestFullScrapeModeNames(t *testing.T) {
+	Convey("Full scrape mode names", t, func() {
+		for _, m := range []FullScrapeMode{FullScrapeOn, FullScrapeOff, FullScrapeLimited, FullScrapeCached} {
+			parsed, err := ParseFullScrapeMode(m.String())
+			So(err, ShouldBeNil)
+			So(parsed, ShouldEqual, m)
+		}
+		_, err := ParseFullScrapeMode("sometimes")
+		So(err, ShouldNotBeNil)
+		So(Limits{FullScrape: FullScrapeMode(7)}.validate(), ShouldNotBeNil)
+	})
+}
+
+func TestScrape(t *testing.T) {
+	Convey("Scrape", t, func() {
+		tracker := NewTracker()
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		ports := map[string]int{"leech": 7000, "seed": 7001}
+		announce := func(infoHash, peerID string, left uint64, event string) {
+			get(mux, "/announce?"+announceQuery(infoHash, peerID, ports[peerID], 0, 0, left, event))
+		}
+		announce(infoHash, "leech", 10, "started")
+		setLimits := func(l Limits) {
+			So(tracker.SetLimits(l), ShouldBeNil)
+		}
+
+		Convey("Flags carry the minimum request interval", func() {
+			flags := get(mux, "/scrape")["flags"]
+			So(flags, ShouldResemble, map[string]interface{}{"min_request_interval": int64(defaultInterval / time.Second)})
+			setLimits(Limits{ScrapeInterval: time.Minute})
+			flags = get(mux, "/scrape?info_hash="+url.QueryEscape(infoHash))["flags"]
+			So(flags, ShouldResemble, map[string]interface{}{"min_request_interval": int64(60)})
+		})
+		Convey("Downloaded counts each completion once", func() {
+			announce(infoHash, "leech", 0, "completed")
+			announce(infoHash, "leech", 0, "completed")
+			announce(infoHash, "seed", 0, "completed")
+			files := get(mux, "/scrape?info_hash="+url.QueryEscape(infoHash))["files"].(map[string]interface{})
+			file := files[infoHash].(map[string]interface{})
+			So(file["complete"], ShouldEqual, 2)
+			So(file["incomplete"], ShouldEqual, 0)
+			So(file["downloaded"], ShouldEqual, 2)
+		})
+		Convey("The number of info hashes is limited", func() {
+			var query []string
+			for i := 0; i < 5; i++ {
+				hash := fmt.Sprintf("%020d", i)
+				announce(hash, "leech", 10, "started")
+				query = append(query, "info_hash="+url.QueryEscape(hash))
+			}
+			setLimits(Limits{MaxScrapeHashes: 3})
+			So(get(mux, "/scrape?"+strings.Join(query, "&"))["files"], ShouldHaveLength, 3)
+		})
+		Convey("Full scrape can be disabled", func() {
+			setLimits(Limits{FullScrape: FullScrapeOff})
+			So(get(mux, "/scrape")["failure reason"], ShouldNotBeNil)
+			So(get(mux, "/scrape?info_hash="+url.QueryEscape(infoHash))["files"], ShouldHaveLength, 1)
+		})
+		Convey("Full scrape can be rate limited", func() {
+			setLimits(Limits{FullScrape: FullScrapeLimited, FullScrapeInterval: time.Hour})
+			So(get(mux, "/scrape")["files"], ShouldHaveLength, 1)
+			So(get(mux, "/scrape")["failure reason"], ShouldNotBeNil)
+			now := time.Now()
+			_, err := tracker.fullScrape(now.Add(2*time.Hour), tracker.limits())
+			So(err, ShouldBeNil)
+		})
+		Convey("Full scrape can be cached", func() {
+			setLimits(Limits{FullScrape: FullScrapeCached, FullScrapeInterval: time.Hour})
+			So(get(mux, "/scrape")["files"], ShouldHaveLength, 1)
+			announce("other012345678901234", "leech", 10, "started")
+			So(get(mux, "/scrape")["files"], ShouldHaveLength, 1)
+			files, err := tracker.fullScrape(time.Now().Add(2*time.Hour), tracker.limits())
+			So(err, ShouldBeNil)
+			So(files, ShouldHaveLength, 2)
+		})
+	})
+}
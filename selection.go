@@ -0,0 +1,368 @@
+package cytracker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PeerSelection decides which peers are sent to an announcing peer
+type PeerSelection int
+
+const (
+	// PeerSelectionRandom picks peers uniformly at random
+	PeerSelectionRandom PeerSelection = iota
+	// PeerSelectionLeechersForSeeds picks only leechers for seeds, which
+	// have no use for other seeds, and any peers for leechers
+	PeerSelectionLeechersForSeeds
+	// PeerSelectionLocality prefers peers in the same subnet, then peers in
+	// the same autonomous system according to ASNTable, among a sample
+	PeerSelectionLocality
+	// PeerSelectionFreshest picks the peers of a sample that announced last,
+	// which are the most likely to be reachable
+	PeerSelectionFreshest
+)
+
+// Selections other than PeerSelectionRandom look at a random sample of the
+// swarm of sampleFactor times the peers wanted, and at least minSample peers,
+// so that their cost grows with the peers wanted rather than the swarm
+const (
+	sampleFactor = 4
+	minSample    = 256
+)
+
+var peerSelectionNames = []string{"random", "leechers-for-seeds", "locality", "freshest"}
+
+func (s PeerSelection) String() string {
+	if s < 0 || int(s) >= len(peerSelectionNames) {
+		return fmt.Sprintf("PeerSelection(%d)", int(s))
+	}
+	return peerSelectionNames[s]
+}
+
+// ParsePeerSelection returns the peer selection named s
+func ParsePeerSelection(s string) (p PeerSelection, err error) {
+	for i, name := range peerSelectionNames {
+		if name == s {
+			return PeerSelection(i), nil
+		}
+	}
+	err = fmt.Errorf("Unknown peer selection %#v", s)
+	return
+}
+
+// PeerSelector picks the peers sent to an announcing peer. Setting
+// Limits.PeerSelector replaces the built-in PeerSelection with one.
+type PeerSelector interface {
+	// SelectPeers returns the keys of up to count peers other than the one
+	// with peerKey, which may be missing. It is called under the lock of the
+	// torrent and must not keep peers.
+	SelectPeers(peers Peers, peerKey string, count int) []string
+}
+
+// Peers are the peers of a torrent by key
+type Peers struct {
+	peers trackerPeers
+	keys  peerKeys
+}
+
+// Len returns the number of peers
+func (p Peers) Len() int {
+	return len(p.peers)
+}
+
+// Get returns the peer with key
+func (p Peers) Get(key string) (peer Peer, ok bool) {
+	tp, ok := p.peers[key]
+	return Peer{tp}, ok
+}
+
+// Range calls f for the peers in no particular order until it returns false
+func (p Peers) Range(f func(key string, peer Peer) bool) {
+	for key, tp := range p.peers {
+		if !f(key, Peer{tp}) {
+			return
+		}
+	}
+}
+
+// Peer is a read-only view of a peer, its addresses must not be changed
+type Peer struct {
+	p *trackerPeer
+}
+
+func (p Peer) ID() PeerID {
+	return p.p.id
+}
+
+// Addr returns the listen address
+func (p Peer) Addr() *net.TCPAddr {
+	return p.p.listenAddr
+}
+
+// AltAddr returns the listen address of the other IP family, or nil
+func (p Peer) AltAddr() *net.TCPAddr {
+	return p.p.altAddr
+}
+
+// LastSeen returns when the peer last announced
+func (p Peer) LastSeen() time.Time {
+	return p.p.lastSeen
+}
+
+// Left returns the bytes the peer still has to download
+func (p Peer) Left() uint64 {
+	return p.p.left
+}
+
+// Complete reports whether the peer is a seed
+func (p Peer) Complete() bool {
+	return p.p.isComplete()
+}
+
+// peerSelector returns the selector of the limits
+func (l Limits) peerSelector() PeerSelector {
+	if l.PeerSelector != nil {
+		return checkedSelector{l.PeerSelector}
+	}
+	switch l.PeerSelection {
+	case PeerSelectionLeechersForSeeds:
+		return leechersForSeedsSelector{}
+	case PeerSelectionLocality:
+		return localitySelector{l.ASNTable}
+	case PeerSelectionFreshest:
+		return freshestSelector{}
+	}
+	return randomSelector{}
+}
+
+// checkedSelector drops the keys returned by a PeerSelector that are unknown,
+// repeated or the announcing peer's, and those beyond count
+type checkedSelector struct {
+	PeerSelector
+}
+
+func (s checkedSelector) SelectPeers(peers Peers, peerKey string, count int) (keys []string) {
+	seen := make(map[string]bool)
+	for _, key := range s.PeerSelector.SelectPeers(peers, peerKey, count) {
+		if len(keys) == count {
+			break
+		}
+		if _, ok := peers.peers[key]; ok && key != peerKey && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// sampleSize returns how many peers the sampling selections look at to pick
+// count peers
+func sampleSize(count int) int {
+	if n := count * sampleFactor; n > minSample {
+		return n
+	}
+	return minSample
+}
+
+// samplePeers returns up to count peers other than peerKey for which pick is
+// true, uniformly at random. It looks at no more than limit peers, drawn
+// without replacement by a partial Fisher-Yates shuffle of the indices of
+// the keys, so its cost grows with count and limit rather than the swarm.
+func samplePeers(peers Peers, peerKey string, count, limit int, pick func(*trackerPeer) bool) (keys []string) {
+	n := len(peers.keys)
+	if count <= 0 || n == 0 {
+		return
+	}
+	// MEMORY_ALLOCATION
+	// the indices moved by the shuffle, the others are in place
+	moved := make(map[int]int)
+	for i := 0; i < n && i < limit && len(keys) < count; i++ {
+		j := i + rand.Intn(n-i)
+		picked, ok := moved[j]
+		if !ok {
+			picked = j
+		}
+		if current, ok := moved[i]; ok {
+			moved[j] = current
+		} else {
+			moved[j] = i
+		}
+		key := peers.keys[picked]
+		if key == peerKey || (pick != nil && !pick(peers.peers[key])) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+type randomSelector struct{}
+
+func (randomSelector) SelectPeers(peers Peers, peerKey string, count int) []string {
+	// the announcing peer may be drawn once
+	return samplePeers(peers, peerKey, count, count+1, nil)
+}
+
+type leechersForSeedsSelector struct{}
+
+// SelectPeers looks for leechers for a seed among a sample of the swarm, a seed
+// may get fewer leechers than there are if they are rare
+func (leechersForSeedsSelector) SelectPeers(peers Peers, peerKey string, count int) []string {
+	if self, ok := peers.peers[peerKey]; ok && self.isComplete() {
+		return samplePeers(peers, peerKey, count, sampleSize(count), func(p *trackerPeer) bool { return !p.isComplete() })
+	}
+	return samplePeers(peers, peerKey, count, count+1, nil)
+}
+
+// rankedPeer is a peer ranked by a selector, lower ranks are picked first
+type rankedPeer struct {
+	key  string
+	rank float64
+}
+
+// rankPeers ranks a random sample of the peers other than peerKey and returns
+// the keys of the count peers of lowest rank
+func rankPeers(peers Peers, peerKey string, count int, rank func(*trackerPeer) float64) (keys []string) {
+	size := sampleSize(count)
+	sample := samplePeers(peers, peerKey, size, size+1, nil)
+	// MEMORY_ALLOCATION
+	ranked := make([]rankedPeer, len(sample))
+	for i, key := range sample {
+		ranked[i] = rankedPeer{key, rank(peers.peers[key])}
+	}
+	sort.Slice(ranked, func(i, j int) bool { return ranked[i].rank < ranked[j].rank })
+	if count > len(ranked) {
+		count = len(ranked)
+	}
+	for _, p := range ranked[:count] {
+		keys = append(keys, p.key)
+	}
+	return
+}
+
+type localitySelector struct {
+	asns *ASNTable
+}
+
+func (s localitySelector) SelectPeers(peers Peers, peerKey string, count int) []string {
+	self, ok := peers.peers[peerKey]
+	if !ok || count <= 0 {
+		return samplePeers(peers, peerKey, count, count+1, nil)
+	}
+	asn := s.asns.peerASN(self)
+	return rankPeers(peers, peerKey, count, func(peer *trackerPeer) float64 {
+		// random order within a tier
+		rank := 2 + rand.Float64()
+		if sameSubnet(self.listenAddr.IP, peer.listenAddr.IP) {
+			rank -= 2
+		} else if asn != 0 && s.asns.peerASN(peer) == asn {
+			rank--
+		}
+		return rank
+	})
+}
+
+// sameSubnet reports whether a and b are in the same /24 IPv4 or /64 IPv6
+// network
+func sameSubnet(a, b net.IP) bool {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		return a4 != nil && b4 != nil && a4.Mask(net.CIDRMask(24, 32)).Equal(b4.Mask(net.CIDRMask(24, 32)))
+	}
+	return a.Mask(net.CIDRMask(64, 128)).Equal(b.Mask(net.CIDRMask(64, 128)))
+}
+
+type freshestSelector struct{}
+
+func (freshestSelector) SelectPeers(peers Peers, peerKey string, count int) []string {
+	if count <= 0 {
+		return nil
+	}
+	return rankPeers(peers, peerKey, count, func(peer *trackerPeer) float64 {
+		return -float64(peer.lastSeen.UnixNano())
+	})
+}
+
+// ASNTable maps networks to the numbers of the autonomous systems announcing
+// them
+type ASNTable struct {
+	entries []asnEntry // longest prefixes first
+}
+
+type asnEntry struct {
+	network *net.IPNet
+	asn     uint32
+}
+
+// LoadASNTable reads the ASN table in file, see ReadASNTable
+func LoadASNTable(file string) (*ASNTable, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadASNTable(f)
+}
+
+// ReadASNTable reads lines of a network and an AS number, like
+// "192.0.2.0/24 AS64496". Blank lines and lines starting with # are skipped.
+func ReadASNTable(r io.Reader) (*ASNTable, error) {
+	t := new(ASNTable)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid ASN table line %d: %#v", line, scanner.Text())
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid ASN table line %d: %v", line, err)
+		}
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(fields[1]), "AS"), 10, 32)
+		if err != nil || asn == 0 {
+			return nil, fmt.Errorf("Invalid ASN table line %d: AS number %#v", line, fields[1])
+		}
+		t.entries = append(t.entries, asnEntry{network, uint32(asn)})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(t.entries, func(i, j int) bool {
+		a, _ := t.entries[i].network.Mask.Size()
+		b, _ := t.entries[j].network.Mask.Size()
+		return a > b
+	})
+	return t, nil
+}
+
+// Lookup returns the AS number of ip, or 0 if it is unknown
+func (t *ASNTable) Lookup(ip net.IP) uint32 {
+	if t == nil {
+		return 0
+	}
+	for _, e := range t.entries {
+		if e.network.Contains(ip) {
+			return e.asn
+		}
+	}
+	return 0
+}
+
+// peerASN returns the AS number of the peer, it is looked up once per table
+// and IP address, which changes when the peer moves
+func (t *ASNTable) peerASN(p *trackerPeer) uint32 {
+	if p.asnTable != t || !p.asnIP.Equal(p.listenAddr.IP) {
+		p.asn, p.asnTable, p.asnIP = t.Lookup(p.listenAddr.IP), t, p.listenAddr.IP
+	}
+	return p.asn
+}
@@ -0,0 +1,336 @@
+package cytracker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// selectionTrials is the number of selections counted by the statistical tests
+const selectionTrials = 20000
+
+// maxChiSquare bounds the chi-square statistic of the counted selections, for
+// up to 10 degrees of freedom a uniform selection exceeds it with a
+// probability below 1e-5
+const maxChiSquare = 45
+
+// testPeers returns the peers with the listen addresses, seeds if left is 0
+func testPeers(left uint64, addrs ...string) trackerPeers {
+	peers := make(trackerPeers)
+	for _, addr := range addrs {
+		peers.addTestPeer(addr, left)
+	}
+	return peers
+}
+
+func (t trackerPeers) addTestPeer(addr string, left uint64) *trackerPeer {
+	a, err := net.ResolveTCPAddr("tcp", addr)
+	So(err, ShouldBeNil)
+	p := &trackerPeer{listenAddr: a, left: left, lastSeen: time.Now()}
+	t.Add(a.String(), p)
+	return p
+}
+
+// peerView returns the Peers of peers, listing their keys as a torrent does
+func peerView(peers trackerPeers) Peers {
+	var keys peerKeys
+	for key, peer := range peers {
+		keys.add(key, peer)
+	}
+	return Peers{peers, keys}
+}
+
+// countSelections counts how often each peer is selected, and how often it
+// is selected first
+func countSelections(s PeerSelector, peers trackerPeers, peerKey string, count int) (selected, first map[string]int) {
+	selected, first = make(map[string]int), make(map[string]int)
+	view := peerView(peers)
+	for i := 0; i < selectionTrials; i++ {
+		keys := s.SelectPeers(view, peerKey, count)
+		So(len(keys), ShouldBeLessThanOrEqualTo, count)
+		seen := make(map[string]bool)
+		for _, key := range keys {
+			So(seen[key], ShouldBeFalse)
+			seen[key] = true
+			selected[key]++
+		}
+		if len(keys) > 0 {
+			first[keys[0]]++
+		}
+	}
+	return
+}
+
+// chiSquare returns the chi-square statistic of counts of the keys, which are
+// expected to be equal
+func chiSquare(counts map[string]int, keys []string) (x float64) {
+	total := 0
+	for _, key := range keys {
+		total += counts[key]
+	}
+	expected := float64(total) / float64(len(keys))
+	for _, key := range keys {
+		d := float64(counts[key]) - expected
+		x += d * d / expected
+	}
+	return
+}
+
+// shouldBeUniform checks that the keys, and only they, are selected equally
+// often, expected times per trial each
+func shouldBeUniform(counts map[string]int, keys []string, expected float64) {
+	So(counts, ShouldHaveLength, len(keys))
+	So(chiSquare(counts, keys), ShouldBeLessThan, maxChiSquare)
+	for _, key := range keys {
+		So(float64(counts[key])/selectionTrials, ShouldAlmostEqual, expected, 0.05)
+	}
+}
+
+func TestPeerSelection(t *testing.T) {
+	Convey("Peer selection names", t, func() {
+		for _, name := range peerSelectionNames {
+			s, err := ParsePeerSelection(name)
+			So(err, ShouldBeNil)
+			So(s.String(), ShouldEqual, name)
+		}
+		_, err := ParsePeerSelection("best")
+		So(err, ShouldNotBeNil)
+		So(Limits{PeerSelection: PeerSelection(9)}.validate(), ShouldNotBeNil)
+	})
+	Convey("Uniform random selection", t, func() {
+		peers := testPeers(1, "10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1", "10.0.0.4:1", "10.0.0.5:1",
+			"10.0.0.6:1", "10.0.0.7:1", "10.0.0.8:1", "10.0.0.9:1", "10.0.0.10:1")
+		self := "10.0.0.1:1"
+		var others []string
+		for key := range peers {
+			if key != self {
+				others = append(others, key)
+			}
+		}
+
+		selected, first := countSelections(randomSelector{}, peers, self, 3)
+		shouldBeUniform(selected, others, 3.0/9)
+		shouldBeUniform(first, others, 1.0/9)
+
+		Convey("returns every peer if there are few", func() {
+			So(randomSelector{}.SelectPeers(peerView(peers), self, 20), ShouldHaveLength, 9)
+			So(randomSelector{}.SelectPeers(peerView(peers), self, 0), ShouldBeEmpty)
+			So(randomSelector{}.SelectPeers(peerView(peers), "stopped", 20), ShouldHaveLength, 10)
+		})
+	})
+	Convey("Leechers for seeds", t, func() {
+		seeds := []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1", "10.0.0.4:1"}
+		leechers := []string{"10.0.1.1:1", "10.0.1.2:1", "10.0.1.3:1", "10.0.1.4:1"}
+		peers := testPeers(0, seeds...)
+		for _, addr := range leechers {
+			peers.addTestPeer(addr, 1)
+		}
+
+		Convey("seeds get only leechers", func() {
+			selected, _ := countSelections(leechersForSeedsSelector{}, peers, seeds[0], 2)
+			shouldBeUniform(selected, leechers, 2.0/4)
+			So(leechersForSeedsSelector{}.SelectPeers(peerView(peers), seeds[0], 10), ShouldHaveLength, 4)
+		})
+		Convey("leechers get any peers", func() {
+			selected, _ := countSelections(leechersForSeedsSelector{}, peers, leechers[0], 2)
+			shouldBeUniform(selected, append(append([]string{}, seeds...), leechers[1:]...), 2.0/7)
+		})
+	})
+	Convey("Locality", t, func() {
+		table, err := ReadASNTable(strings.NewReader("10.0.0.0/16 AS64496\n"))
+		So(err, ShouldBeNil)
+		selector := localitySelector{table}
+		self := "10.0.0.1:1"
+		subnet := []string{"10.0.0.2:1", "10.0.0.3:1"}
+		asn := []string{"10.0.5.1:1", "10.0.6.1:1", "10.0.7.1:1"}
+		others := []string{"192.0.2.1:1", "192.0.2.2:1", "198.51.100.1:1"}
+		peers := testPeers(1, self)
+		for _, addrs := range [][]string{subnet, asn, others} {
+			for _, addr := range addrs {
+				peers.addTestPeer(addr, 1)
+			}
+		}
+
+		Convey("prefers the same subnet", func() {
+			selected, _ := countSelections(selector, peers, self, 1)
+			shouldBeUniform(selected, subnet, 1.0/2)
+		})
+		Convey("then the same autonomous system", func() {
+			selected, _ := countSelections(selector, peers, self, 3)
+			So(selected[subnet[0]], ShouldEqual, selectionTrials)
+			So(selected[subnet[1]], ShouldEqual, selectionTrials)
+			delete(selected, subnet[0])
+			delete(selected, subnet[1])
+			shouldBeUniform(selected, asn, 1.0/3)
+		})
+		Convey("then any peers", func() {
+			selected, _ := countSelections(selector, peers, self, 6)
+			delete(selected, subnet[0])
+			delete(selected, subnet[1])
+			for _, key := range asn {
+				So(selected[key], ShouldEqual, selectionTrials)
+				delete(selected, key)
+			}
+			shouldBeUniform(selected, others, 1.0/3)
+		})
+		Convey("compares only subnets without a table", func() {
+			selected, _ := countSelections(localitySelector{}, peers, self, 3)
+			So(selected[subnet[0]], ShouldEqual, selectionTrials)
+			delete(selected, subnet[0])
+			delete(selected, subnet[1])
+			shouldBeUniform(selected, append(append([]string{}, asn...), others...), 1.0/6)
+		})
+		Convey("of IPv6 peers", func() {
+			So(sameSubnet(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::ffff:1")), ShouldBeTrue)
+			So(sameSubnet(net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8:0:1::1")), ShouldBeFalse)
+			So(sameSubnet(net.ParseIP("10.0.0.1"), net.ParseIP("::ffff:10.0.0.2")), ShouldBeTrue)
+			So(sameSubnet(net.ParseIP("10.0.0.1"), net.ParseIP("::a00:1")), ShouldBeFalse)
+		})
+	})
+	Convey("Freshest first", t, func() {
+		peers := make(trackerPeers)
+		now := time.Now()
+		var keys []string
+		for i := 0; i < 10; i++ {
+			p := peers.addTestPeer(fmt.Sprintf("10.0.0.%d:1", i+1), 1)
+			p.lastSeen = now.Add(-time.Duration(i) * time.Minute)
+			keys = append(keys, p.listenAddr.String())
+		}
+		selected, _ := countSelections(freshestSelector{}, peers, keys[0], 3)
+		So(selected, ShouldResemble, map[string]int{keys[1]: selectionTrials, keys[2]: selectionTrials, keys[3]: selectionTrials})
+		So(freshestSelector{}.SelectPeers(peerView(peers), keys[5], 3), ShouldResemble, keys[:3])
+		So(freshestSelector{}.SelectPeers(peerView(peers), keys[0], 20), ShouldResemble, keys[1:])
+	})
+	Convey("Selection in announces", t, func() {
+		tracker := NewTracker()
+		tracker.PeerSelection = PeerSelectionLeechersForSeeds
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		for port := 7000; port < 7010; port++ {
+			left := uint64(0)
+			if port%2 == 0 {
+				left = 10
+			}
+			get(mux, "/announce?"+announceQuery(infoHash, fmt.Sprint(port), port, 0, 0, left, "started"))
+		}
+		response := get(mux, "/announce?"+announceQuery(infoHash, "seed", 8000, 0, 0, 0, "started"))
+		So(response["peers"], ShouldHaveLength, 5*6)
+
+		Convey("by a custom selector", func() {
+			var seen []Peer
+			tracker.PeerSelector = selectorFunc(func(peers Peers, peerKey string, count int) []string {
+				self, ok := peers.Get(peerKey)
+				So(ok, ShouldBeTrue)
+				seen = append(seen, self)
+				var keys []string
+				peers.Range(func(key string, peer Peer) bool {
+					if peer.Addr().Port == 7003 {
+						keys = append(keys, key, key)
+					}
+					return true
+				})
+				return append(keys, "unknown", peerKey)
+			})
+			response := get(mux, "/announce?"+announceQuery(infoHash, "seed", 8000, 0, 0, 0, ""))
+			So(response["peers"], ShouldHaveLength, 6)
+			So(seen, ShouldHaveLength, 1)
+			So(seen[0].ID(), ShouldEqual, testPeerID("seed"))
+			So(seen[0].Addr().Port, ShouldEqual, 8000)
+			So(seen[0].Complete(), ShouldBeTrue)
+		})
+	})
+}
+
+// selectorFunc is a PeerSelector calling itself
+type selectorFunc func(peers Peers, peerKey string, count int) []string
+
+func (f selectorFunc) SelectPeers(peers Peers, peerKey string, count int) []string {
+	return f(peers, peerKey, count)
+}
+
+func TestASNTable(t *testing.T) {
+	Convey("ASN tables", t, func() {
+		table, err := ReadASNTable(strings.NewReader(`
+# network  AS number
+10.0.0.0/8      64496
+10.1.0.0/16     AS64497
+2001:db8::/32   as64498
+`))
+		So(err, ShouldBeNil)
+		So(table.Lookup(net.ParseIP("10.2.0.1")), ShouldEqual, 64496)
+		So(table.Lookup(net.ParseIP("10.1.0.1")), ShouldEqual, 64497)
+		So(table.Lookup(net.ParseIP("2001:db8::1")), ShouldEqual, 64498)
+		So(table.Lookup(net.ParseIP("192.0.2.1")), ShouldEqual, 0)
+		So((*ASNTable)(nil).Lookup(net.ParseIP("10.0.0.1")), ShouldEqual, 0)
+
+		Convey("of a peer that moved", func() {
+			peer := &trackerPeer{listenAddr: &net.TCPAddr{IP: net.ParseIP("10.2.0.1"), Port: 1}}
+			So(table.peerASN(peer), ShouldEqual, 64496)
+			peer.listenAddr = &net.TCPAddr{IP: net.ParseIP("10.1.0.1"), Port: 1}
+			So(table.peerASN(peer), ShouldEqual, 64497)
+		})
+
+		for _, s := range []string{"10.0.0.0/8", "10.0.0.0/8 AS0", "10.0.0.0/8 ASx", "10.0.0.1 64496"} {
+			_, err := ReadASNTable(strings.NewReader(s))
+			So(err, ShouldNotBeNil)
+		}
+	})
+}
+
+func TestPeerKeys(t *testing.T) {
+	Convey("Peer keys follow the peer table", t, func() {
+		torrent := newTrackerTorrent("test")
+		check := func() {
+			So(torrent.keys, ShouldHaveLength, len(torrent.peers))
+			for i, key := range torrent.keys {
+				So(torrent.peers[key].index, ShouldEqual, i)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			addr := &net.TCPAddr{IP: net.ParseIP(fmt.Sprintf("10.0.0.%d", i)), Port: 1}
+			torrent.addPeer(addr.String(), &trackerPeer{listenAddr: addr})
+		}
+		check()
+		torrent.addPeer("10.0.0.3:1", &trackerPeer{listenAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.3"), Port: 1}})
+		check()
+		for _, key := range []string{"10.0.0.9:1", "10.0.0.0:1", "10.0.0.5:1", "unknown"} {
+			torrent.removePeer(key)
+			check()
+		}
+		So(torrent.peers, ShouldHaveLength, 7)
+	})
+}
+
+func benchmarkSelectPeers(b *testing.B, selector PeerSelector, count int) {
+	peers := make(trackerPeers)
+	for i := 0; i < count; i++ {
+		addr := &net.TCPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 1}
+		peers.Add(addr.String(), &trackerPeer{listenAddr: addr, lastSeen: time.Unix(int64(i), 0)})
+	}
+	view := peerView(peers)
+	self := view.keys[0]
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		selector.SelectPeers(view, self, defaultPeerCount)
+	}
+}
+
+func BenchmarkSelectRandom1k(b *testing.B) {
+	benchmarkSelectPeers(b, randomSelector{}, 1000)
+}
+
+func BenchmarkSelectRandom100k(b *testing.B) {
+	benchmarkSelectPeers(b, randomSelector{}, 100000)
+}
+
+func BenchmarkSelectFreshest1k(b *testing.B) {
+	benchmarkSelectPeers(b, freshestSelector{}, 1000)
+}
+
+func BenchmarkSelectFreshest100k(b *testing.B) {
+	benchmarkSelectPeers(b, freshestSelector{}, 100000)
+}
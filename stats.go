@@ -0,0 +1,172 @@
+package cytracker
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// statsBucket is the time span of a bucket of torrent history
+	statsBucket = time.Hour
+	// statsHistory is how long torrent history is kept, a week
+	statsHistory = 7 * 24 * time.Hour
+)
+
+// TransferStats are the statistics a torrent accumulates from announces
+type TransferStats struct {
+	// Uploaded and Downloaded are the bytes peers reported to transfer,
+	// summed from the differences between their announces
+	Uploaded   uint64 `json:"uploaded"`
+	Downloaded uint64 `json:"downloaded"`
+	// PeakSeeders and PeakLeechers are the most peers seen at once
+	PeakSeeders  int `json:"peak_seeders"`
+	PeakLeechers int `json:"peak_leechers"`
+	// FirstSeen and LastActive are the times of the first and the latest
+	// announce
+	FirstSeen  time.Time `json:"first_seen"`
+	LastActive time.Time `json:"last_active"`
+	// History are hourly buckets of the last week, oldest first. Hours
+	// without announces are left out.
+	History []StatsBucket `json:"history"`
+}
+
+// StatsBucket are the statistics of the announces within an hour
+type StatsBucket struct {
+	Start        time.Time `json:"start"`
+	Announces    uint64    `json:"announces"`
+	Completed    uint64    `json:"completed"`
+	Uploaded     uint64    `json:"uploaded"`
+	Downloaded   uint64    `json:"downloaded"`
+	PeakSeeders  int       `json:"peak_seeders"`
+	PeakLeechers int       `json:"peak_leechers"`
+}
+
+// TorrentStats are the current peer counts and the transfer statistics of a
+// torrent
+type TorrentStats struct {
+	InfoHash  InfoHash `json:"info_hash"`
+	Name      string   `json:"name"`
+	Seeders   int      `json:"seeders"`
+	Leechers  int      `json:"leechers"`
+	Completed uint64   `json:"completed"`
+	TransferStats
+}
+
+// TorrentStats returns the statistics of the torrent with infoHash, or of the
+// torrent it is linked to
+func (t *Tracker) TorrentStats(infoHash InfoHash) (stats TorrentStats, err error) {
+	infoHash = t.torrents.resolve(infoHash)
+	torrent := t.torrents.get(infoHash)
+	if torrent == nil {
+		err = fmt.Errorf("Unknown torrent %v", infoHash)
+		return
+	}
+	torrent.m.RLock()
+	defer torrent.m.RUnlock()
+	return torrent.stats(infoHash), nil
+}
+
+// stats returns the statistics of the torrent, the caller must hold its lock
+func (t *trackerTorrent) stats(infoHash InfoHash) TorrentStats {
+	stats := TorrentStats{
+		InfoHash:      infoHash,
+		Name:          t.name,
+		Seeders:       t.seeders,
+		Leechers:      t.leechers,
+		Completed:     t.downloaded,
+		TransferStats: t.transfers,
+	}
+	stats.History = append([]StatsBucket(nil), t.transfers.History...)
+	return stats
+}
+
+// historySince returns the history buckets that end after since
+func (s *TransferStats) historySince(since time.Time) []StatsBucket {
+	i := sort.Search(len(s.History), func(i int) bool { return s.History[i].Start.Add(statsBucket).After(since) })
+	return s.History[i:]
+}
+
+// record adds an announce at now to the statistics
+func (s *TransferStats) record(now time.Time, delta transfer, completed bool, seeders, leechers int) {
+	s.Uploaded += delta.uploaded
+	s.Downloaded += delta.downloaded
+	s.PeakSeeders = max(s.PeakSeeders, seeders)
+	s.PeakLeechers = max(s.PeakLeechers, leechers)
+	if s.FirstSeen.IsZero() || now.Before(s.FirstSeen) {
+		s.FirstSeen = now
+	}
+	if now.After(s.LastActive) {
+		s.LastActive = now
+	}
+
+	b := s.bucket(now)
+	b.Announces++
+	if completed {
+		b.Completed++
+	}
+	b.Uploaded += delta.uploaded
+	b.Downloaded += delta.downloaded
+	b.PeakSeeders = max(b.PeakSeeders, seeders)
+	b.PeakLeechers = max(b.PeakLeechers, leechers)
+}
+
+// bucket returns the history bucket of now, dropping buckets older than the
+// kept history. Times before the latest bucket count into it.
+func (s *TransferStats) bucket(now time.Time) *StatsBucket {
+	start := now.Truncate(statsBucket)
+	if n := len(s.History); n == 0 || start.After(s.History[n-1].Start) {
+		s.History = append(s.History, StatsBucket{Start: start})
+		s.trim(start)
+	}
+	return &s.History[len(s.History)-1]
+}
+
+// trim drops the buckets that are too old at the bucket starting at start
+func (s *TransferStats) trim(start time.Time) {
+	oldest := start.Add(-statsHistory + statsBucket)
+	i := sort.Search(len(s.History), func(i int) bool { return !s.History[i].Start.Before(oldest) })
+	if i > 0 {
+		// MEMORY_ALLOCATION
+		s.History = append([]StatsBucket(nil), s.History[i:]...)
+	}
+}
+
+// merge adds other to the statistics, for torrents that are linked
+func (s *TransferStats) merge(other TransferStats) {
+	s.Uploaded += other.Uploaded
+	s.Downloaded += other.Downloaded
+	s.PeakSeeders = max(s.PeakSeeders, other.PeakSeeders)
+	s.PeakLeechers = max(s.PeakLeechers, other.PeakLeechers)
+	if !other.FirstSeen.IsZero() && (s.FirstSeen.IsZero() || other.FirstSeen.Before(s.FirstSeen)) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if other.LastActive.After(s.LastActive) {
+		s.LastActive = other.LastActive
+	}
+
+	// restored times differ in location, so buckets are keyed by Unix time
+	buckets := make(map[int64]*StatsBucket)
+	history := append(append([]StatsBucket(nil), s.History...), other.History...)
+	s.History = s.History[:0:0]
+	for _, b := range history {
+		if merged, ok := buckets[b.Start.Unix()]; ok {
+			merged.Announces += b.Announces
+			merged.Completed += b.Completed
+			merged.Uploaded += b.Uploaded
+			merged.Downloaded += b.Downloaded
+			merged.PeakSeeders = max(merged.PeakSeeders, b.PeakSeeders)
+			merged.PeakLeechers = max(merged.PeakLeechers, b.PeakLeechers)
+			continue
+		}
+		b := b
+		buckets[b.Start.Unix()] = &b
+	}
+	for _, b := range buckets {
+		s.History = append(s.History, *b)
+	}
+	sort.Slice(s.History, func(i, j int) bool { return s.History[i].Start.Before(s.History[j].Start) })
+	if n := len(s.History); n > 0 {
+		s.trim(s.History[n-1].Start)
+	}
+}
@@ -0,0 +1,121 @@
+package cytracker
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransferStats(t *testing.T) {
+	Convey("Transfer stats", t, func() {
+		var s TransferStats
+		start := time.Date(2020, 1, 1, 10, 0, 0, 0, time.UTC)
+		s.record(start.Add(10*time.Minute), transfer{uploaded: 100, downloaded: 10}, false, 1, 2)
+		s.record(start.Add(20*time.Minute), transfer{uploaded: 50}, true, 2, 1)
+		s.record(start.Add(90*time.Minute), transfer{downloaded: 5}, false, 1, 0)
+
+		So(s.Uploaded, ShouldEqual, 150)
+		So(s.Downloaded, ShouldEqual, 15)
+		So(s.PeakSeeders, ShouldEqual, 2)
+		So(s.PeakLeechers, ShouldEqual, 2)
+		So(s.FirstSeen, ShouldEqual, start.Add(10*time.Minute))
+		So(s.LastActive, ShouldEqual, start.Add(90*time.Minute))
+		So(s.History, ShouldResemble, []StatsBucket{
+			{Start: start, Announces: 2, Completed: 1, Uploaded: 150, Downloaded: 10, PeakSeeders: 2, PeakLeechers: 2},
+			{Start: start.Add(time.Hour), Announces: 1, Downloaded: 5, PeakSeeders: 1},
+		})
+		So(s.historySince(start.Add(30*time.Minute)), ShouldHaveLength, 2)
+		So(s.historySince(start.Add(time.Hour)), ShouldHaveLength, 1)
+		So(s.historySince(start.Add(2*time.Hour)), ShouldBeEmpty)
+
+		Convey("keep a week of history", func() {
+			s.record(start.Add(statsHistory), transfer{}, false, 0, 0)
+			So(s.History, ShouldHaveLength, 2)
+			So(s.History[0].Start, ShouldEqual, start.Add(time.Hour))
+			So(s.Uploaded, ShouldEqual, 150)
+		})
+		Convey("merge", func() {
+			var other TransferStats
+			other.record(start.Add(-time.Hour), transfer{uploaded: 1}, false, 5, 0)
+			other.record(start.Add(5*time.Minute), transfer{uploaded: 1}, true, 0, 0)
+			s.merge(other)
+			So(s.Uploaded, ShouldEqual, 152)
+			So(s.PeakSeeders, ShouldEqual, 5)
+			So(s.FirstSeen, ShouldEqual, start.Add(-time.Hour))
+			So(s.LastActive, ShouldEqual, start.Add(90*time.Minute))
+			So(s.History, ShouldHaveLength, 3)
+			So(s.History[0].Start, ShouldEqual, start.Add(-time.Hour))
+			So(s.History[1].Announces, ShouldEqual, 3)
+			So(s.History[1].Completed, ShouldEqual, 2)
+			So(s.History[1].PeakSeeders, ShouldEqual, 2)
+		})
+	})
+	Convey("Torrent stats", t, func() {
+		tracker := NewTracker()
+		tracker.AdminToken = "token"
+		mux := tracker.newServeMux()
+		infoHash := "01234567890123456789"
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 0, 0, 0, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 0, 100, "started"))
+		get(mux, "/announce?"+announceQuery(infoHash, "leech", 7001, 0, 100, 0, "completed"))
+		get(mux, "/announce?"+announceQuery(infoHash, "seed", 7000, 100, 0, 0, "stopped"))
+
+		stats, err := tracker.TorrentStats(testInfoHash(infoHash))
+		So(err, ShouldBeNil)
+		So(stats.Seeders, ShouldEqual, 1)
+		So(stats.Leechers, ShouldEqual, 0)
+		So(stats.Completed, ShouldEqual, 1)
+		So(stats.Uploaded, ShouldEqual, 100)
+		So(stats.Downloaded, ShouldEqual, 100)
+		So(stats.PeakSeeders, ShouldEqual, 2)
+		So(stats.PeakLeechers, ShouldEqual, 1)
+		So(stats.FirstSeen.IsZero(), ShouldBeFalse)
+		So(stats.History, ShouldHaveLength, 1)
+		So(stats.History[0].Announces, ShouldEqual, 4)
+		So(stats.History[0].Completed, ShouldEqual, 1)
+
+		_, err = tracker.TorrentStats(testInfoHash("abcdefghijabcdefghij"))
+		So(err, ShouldNotBeNil)
+
+		Convey("are served by the admin API", func() {
+			hexInfoHash := hex.EncodeToString([]byte(infoHash))
+			status, result := adminRequest(tracker, "GET", "/torrents/"+hexInfoHash+"/stats", "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(result.(map[string]interface{})["uploaded"], ShouldEqual, 100)
+			So(result.(map[string]interface{})["history"], ShouldHaveLength, 1)
+
+			since := time.Now().Add(2 * time.Hour).Format(time.RFC3339)
+			status, result = adminRequest(tracker, "GET", "/torrents/"+hexInfoHash+"/stats?since="+since, "")
+			So(status, ShouldEqual, http.StatusOK)
+			So(result.(map[string]interface{})["history"], ShouldBeEmpty)
+
+			status, _ = adminRequest(tracker, "GET", "/torrents/"+hexInfoHash+"/stats?since=yesterday", "")
+			So(status, ShouldEqual, http.StatusBadRequest)
+			status, _ = adminRequest(tracker, "GET", "/torrents/"+hex.EncodeToString([]byte("abcdefghijabcdefghij"))+"/stats", "")
+			So(status, ShouldEqual, http.StatusNotFound)
+		})
+		Convey("are saved in snapshots", func() {
+			dir, err := ioutil.TempDir("", "storage")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			s, err := NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			So(s.Snapshot(tracker.torrents.state()), ShouldBeNil)
+			So(s.Close(), ShouldBeNil)
+			s, err = NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			defer s.Close()
+			restored := NewTracker()
+			So(restored.torrents.restore(s, time.Time{}), ShouldBeNil)
+			restoredStats, err := restored.TorrentStats(testInfoHash(infoHash))
+			So(err, ShouldBeNil)
+			So(restoredStats.TransferStats.Uploaded, ShouldEqual, 100)
+			So(restoredStats.History, ShouldHaveLength, 1)
+		})
+	})
+}
@@ -0,0 +1,417 @@
+package cytracker
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// journalQueue is the number of journal entries waiting for the store
+	// before changes wait too
+	journalQueue = 4096
+	// snapshotEntries is the number of journal entries that trigger a
+	// snapshot before the next reaping
+	snapshotEntries = 100000
+)
+
+// Storage persists swarm state so that it survives tracker restarts.
+//
+// The state is kept as a snapshot of all torrents and banned IPs plus a
+// journal of changes. The snapshot is taken while the swarm changes, so the
+// journal may hold changes it already includes, their sequence numbers tell
+// them apart. Implementations must be safe for concurrent use.
+type Storage interface {
+	// Load returns the last snapshot and the journal kept since the Rotate
+	// before it
+	Load() (state SwarmState, journal []JournalEntry, err error)
+	// Append records a change to the journal
+	Append(entry JournalEntry) error
+	// Rotate starts a new part of the journal, the next Snapshot discards
+	// the parts before it
+	Rotate() error
+	// Snapshot replaces the saved state
+	Snapshot(state SwarmState) error
+	Close() error
+}
+
+// SwarmState is a snapshot of the swarm
+type SwarmState struct {
+	Torrents []TorrentState
+	Bans     []string `json:",omitempty"`
+	// BansSeq is the sequence number of the last ban or unban in Bans
+	BansSeq uint64 `json:",omitempty"`
+}
+
+// TorrentState is the saved state of a single torrent
+type TorrentState struct {
+	InfoHash   InfoHash
+	Name       string
+	Auto       bool `json:",omitempty"`
+	File       bool `json:",omitempty"` // registered for a torrent file
+	Downloaded uint64
+	Peers      []PeerState
+	Links      []InfoHash     `json:",omitempty"`
+	Stats      *TransferStats `json:",omitempty"`
+	// Seq is the sequence number of the last journal entry included
+	Seq uint64 `json:",omitempty"`
+}
+
+// PeerState is the saved state of a single peer
+type PeerState struct {
+	ID         PeerID
+	Key        string `json:",omitempty"`
+	Addr       string
+	AltAddr    string `json:",omitempty"`
+	ClientIP   string `json:",omitempty"`
+	LastSeen   time.Time
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+}
+
+type JournalOp string
+
+const (
+	JournalRegister   JournalOp = "register"
+	JournalUnregister JournalOp = "unregister"
+	JournalAnnounce   JournalOp = "announce"
+	JournalLink       JournalOp = "link"
+	JournalKick       JournalOp = "kick"
+	JournalBan        JournalOp = "ban"
+	JournalUnban      JournalOp = "unban"
+)
+
+// JournalEntry is a single change to the swarm state
+type JournalEntry struct {
+	Op JournalOp
+	// Seq numbers the entries in the order they were made, from 1
+	Seq      uint64
+	Time     time.Time
+	InfoHash InfoHash
+	Name     string     `json:",omitempty"` // register
+	Auto     bool       `json:",omitempty"` // register
+	File     bool       `json:",omitempty"` // register
+	Event    string     `json:",omitempty"` // announce
+	Peer     *PeerState `json:",omitempty"` // announce
+	Link     *InfoHash  `json:",omitempty"` // link
+	PeerKey  string     `json:",omitempty"` // kick
+	IP       string     `json:",omitempty"` // ban, unban
+}
+
+func newPeerState(now time.Time, listenAddr, altAddr *net.TCPAddr, params *announceParams) *PeerState {
+	p := &PeerState{
+		ID:         params.peerID,
+		Key:        params.key,
+		Addr:       listenAddr.String(),
+		LastSeen:   now,
+		Uploaded:   params.uploaded,
+		Downloaded: params.downloaded,
+		Left:       params.left,
+	}
+	if altAddr != nil {
+		p.AltAddr = altAddr.String()
+	}
+	if params.clientIP != nil {
+		p.ClientIP = params.clientIP.String()
+	}
+	return p
+}
+
+func (t *trackerPeer) state() PeerState {
+	params := &announceParams{peerID: t.id, key: t.key, uploaded: t.uploaded, downloaded: t.downloaded, left: t.left, clientIP: t.clientIP}
+	return *newPeerState(t.lastSeen, t.listenAddr, t.altAddr, params)
+}
+
+// announceParams rebuilds the announce that led to this peer state
+func (p *PeerState) announceParams(infoHash InfoHash, event string) (listenAddr *net.TCPAddr, params *announceParams, err error) {
+	listenAddr, err = net.ResolveTCPAddr("tcp", p.Addr)
+	if err != nil {
+		return
+	}
+	params = &announceParams{
+		infoHash:   infoHash,
+		peerID:     p.ID,
+		key:        p.Key,
+		port:       listenAddr.Port,
+		uploaded:   p.Uploaded,
+		downloaded: p.Downloaded,
+		left:       p.Left,
+		event:      event,
+		clientIP:   net.ParseIP(p.ClientIP),
+	}
+	if !blank(p.AltAddr) {
+		// the alternate address is always of the other family
+		params.ipv4, params.ipv6 = p.AltAddr, p.AltAddr
+	}
+	return
+}
+
+// journal queues entry for the store, if journaling, and sets seq to its
+// sequence number. The caller must hold the lock protecting seq, which may be
+// nil.
+func (t *trackerTorrents) journal(entry JournalEntry, seq *uint64) {
+	t.jm.RLock()
+	defer t.jm.RUnlock()
+	if t.journaled == nil {
+		return
+	}
+	entry.Seq = atomic.AddUint64(&t.seq, 1)
+	if seq != nil {
+		*seq = entry.Seq
+	}
+	// waits for the store if it falls behind
+	t.journaled <- entry
+}
+
+// startJournal starts appending the journaled entries to the store
+func (t *trackerTorrents) startJournal() {
+	t.jm.Lock()
+	defer t.jm.Unlock()
+	t.journaled = make(chan JournalEntry, journalQueue)
+	t.appended = make(chan struct{})
+	go t.appendJournal(t.journaled, t.appended)
+}
+
+// stopJournal appends the queued entries and stops journaling
+func (t *trackerTorrents) stopJournal() {
+	t.jm.Lock()
+	journaled := t.journaled
+	t.journaled = nil
+	t.jm.Unlock()
+	if journaled != nil {
+		close(journaled)
+		<-t.appended
+	}
+}
+
+func (t *trackerTorrents) appendJournal(journaled <-chan JournalEntry, appended chan<- struct{}) {
+	defer close(appended)
+	for entry := range journaled {
+		if err := t.store.Append(entry); err != nil {
+			t.log.error("journal failed", Field{"op", entry.Op}, infoHashField(entry.InfoHash), errorField(err))
+		}
+		if atomic.AddInt64(&t.unsnapshotted, 1) == snapshotEntries {
+			select {
+			case t.snapshotDue <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// state returns the current state of all torrents. Each torrent is copied
+// under its own lock while the others change, its links too since they are
+// changed and journaled under it.
+func (t *trackerTorrents) state() (state SwarmState) {
+	t.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		defer torrent.m.RUnlock()
+		ts := TorrentState{InfoHash: infoHash, Name: torrent.name, Auto: torrent.auto, File: torrent.file, Downloaded: torrent.downloaded, Seq: torrent.seq}
+		for link, target := range t.linkMap() {
+			if target == infoHash {
+				ts.Links = append(ts.Links, link)
+			}
+		}
+		if !torrent.transfers.FirstSeen.IsZero() {
+			stats := torrent.stats(infoHash).TransferStats
+			ts.Stats = &stats
+		}
+		for _, peer := range torrent.peers {
+			ts.Peers = append(ts.Peers, peer.state())
+		}
+		state.Torrents = append(state.Torrents, ts)
+	})
+	t.m.RLock()
+	defer t.m.RUnlock()
+	state.BansSeq = t.bansSeq
+	state.Bans = t.bannedIPs()
+	return
+}
+
+// snapshot saves the current state to the store. Announces go on meanwhile,
+// the journal entries they add are skipped when restoring the snapshot.
+func (t *trackerTorrents) snapshot() (err error) {
+	if t.store == nil {
+		return
+	}
+	t.sm.Lock()
+	defer t.sm.Unlock()
+	// the entries appended before are all in the state taken afterwards
+	if err = t.store.Rotate(); err != nil {
+		return
+	}
+	atomic.StoreInt64(&t.unsnapshotted, 0)
+	return t.store.Snapshot(t.state())
+}
+
+// restore loads the saved state from store, merging it with already registered
+// torrents, and starts recording changes to it. Peers last seen before deadline
+// are dropped. It must be called before serving starts.
+func (t *trackerTorrents) restore(store Storage, deadline time.Time) (err error) {
+	state, journal, err := store.Load()
+	if err != nil {
+		return
+	}
+	t.restoring = true
+	defer func() { t.restoring = false }()
+	for _, ip := range state.Bans {
+		t.banned[ip] = true
+	}
+	t.bansSeq = state.BansSeq
+	seq := state.BansSeq
+	for _, ts := range state.Torrents {
+		torrent := t.restoreTorrent(ts.InfoHash, ts.Name, ts.Auto)
+		torrent.file = torrent.file || ts.File
+		if ts.Downloaded > torrent.downloaded {
+			torrent.downloaded = ts.Downloaded
+		}
+		if ts.Stats != nil {
+			torrent.transfers.merge(*ts.Stats)
+		}
+		for _, ps := range ts.Peers {
+			if err = torrent.restorePeer(ps); err != nil {
+				t.log.warn("can't restore peer", infoHashField(ts.InfoHash), Field{fieldPeer, ps.Addr}, errorField(err))
+			}
+		}
+		for _, link := range ts.Links {
+			if err = t.link(ts.InfoHash, link); err != nil {
+				t.log.warn("can't restore link", infoHashField(ts.InfoHash), Field{"link", link.String()}, errorField(err))
+			}
+		}
+		torrent.seq = ts.Seq
+		seq = max(seq, ts.Seq)
+	}
+	for _, entry := range journal {
+		if entry.Seq == 0 {
+			t.log.warn("skipping journal entry without sequence number", Field{"op", string(entry.Op)}, infoHashField(entry.InfoHash))
+			continue
+		}
+		if !t.includes(entry) {
+			t.replay(entry)
+		}
+		seq = max(seq, entry.Seq)
+	}
+	// the peers of a banned IP are removed by a ban after the snapshot of
+	// their torrent may have been taken
+	t.dropBanned()
+	t.reap(deadline)
+	t.log.info("restored torrents", Field{"torrents", t.count()})
+	t.seq = seq
+	t.store = store
+	if err = t.snapshot(); err != nil {
+		return
+	}
+	t.startJournal()
+	return
+}
+
+// includes reports whether the restored state already includes entry
+func (t *trackerTorrents) includes(entry JournalEntry) bool {
+	switch entry.Op {
+	case JournalBan, JournalUnban:
+		return entry.Seq <= t.bansSeq
+	}
+	torrent := t.get(entry.InfoHash)
+	return torrent != nil && entry.Seq <= torrent.seq
+}
+
+// restoreTorrent returns the torrent with infoHash, adding it if missing
+func (t *trackerTorrents) restoreTorrent(infoHash InfoHash, name string, auto bool) *trackerTorrent {
+	s := t.shard(infoHash)
+	torrent, ok := s.torrents[infoHash]
+	if !ok {
+		torrent = newTrackerTorrent(name)
+		torrent.auto = auto
+		s.torrents[infoHash] = torrent
+	}
+	return torrent
+}
+
+func (t *trackerTorrents) replay(entry JournalEntry) {
+	var err error
+	switch entry.Op {
+	case JournalRegister:
+		torrent := t.restoreTorrent(entry.InfoHash, entry.Name, entry.Auto)
+		if torrent.auto && !entry.Auto {
+			torrent.name = entry.Name
+			torrent.auto = false
+		}
+		if !entry.Auto {
+			torrent.file = entry.File
+		}
+	case JournalUnregister:
+		t.lm.Lock()
+		t.unlink(entry.InfoHash)
+		t.lm.Unlock()
+		s := t.shard(entry.InfoHash)
+		delete(s.torrents, entry.InfoHash)
+	case JournalLink:
+		if entry.Link != nil {
+			err = t.link(entry.InfoHash, *entry.Link)
+		}
+	case JournalAnnounce:
+		if entry.Peer == nil {
+			return
+		}
+		var (
+			listenAddr *net.TCPAddr
+			params     *announceParams
+		)
+		listenAddr, params, err = entry.Peer.announceParams(entry.InfoHash, entry.Event)
+		if err == nil {
+			_, err = t.handleAnnounce(entry.Time, listenAddr, params, make(bmap))
+		}
+	case JournalKick:
+		if torrent := t.get(entry.InfoHash); torrent != nil {
+			torrent.removePeer(entry.PeerKey)
+		}
+	case JournalBan, JournalUnban:
+		ip := net.ParseIP(entry.IP)
+		if ip == nil {
+			err = fmt.Errorf("Invalid IP address %#v", entry.IP)
+		} else if entry.Op == JournalBan {
+			t.ban(ip)
+		} else {
+			err = t.unban(ip)
+		}
+	default:
+		t.log.warn("unknown journal entry", Field{"op", entry.Op})
+	}
+	if err != nil {
+		t.log.warn("can't replay journal entry", Field{"op", entry.Op}, infoHashField(entry.InfoHash), errorField(err))
+	}
+	switch entry.Op {
+	case JournalBan, JournalUnban:
+		t.bansSeq = entry.Seq
+	default:
+		if torrent := t.get(entry.InfoHash); torrent != nil {
+			torrent.seq = entry.Seq
+		}
+	}
+}
+
+func (t *trackerTorrent) restorePeer(ps PeerState) (err error) {
+	listenAddr, params, err := ps.announceParams(InfoHash{}, "")
+	if err != nil {
+		return
+	}
+	peer := &trackerPeer{
+		listenAddr: listenAddr,
+		id:         ps.ID,
+		key:        ps.Key,
+		lastSeen:   ps.LastSeen,
+		uploaded:   ps.Uploaded,
+		downloaded: ps.Downloaded,
+		left:       ps.Left,
+		clientIP:   params.clientIP,
+	}
+	peerKey := newPeerKey(ps.ID, listenAddr.IP)
+	t.addPeer(peerKey, peer)
+	altAddr, err := newTrackerPeerAltAddress(listenAddr, params)
+	if err == nil && altAddr != nil {
+		t.setAltAddress(peerKey, peer, altAddr)
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package cytracker
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestFileStorage(t *testing.T) {
+	Convey("File storage", t, func() {
+		dir, err := ioutil.TempDir("", "storage")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		s, err := NewFileStorage(dir)
+		So(err, ShouldBeNil)
+		defer s.Close()
+
+		infoHash := testInfoHash("\x00\xff binary info hash")
+		now := time.Now().Round(time.Second)
+		peer := &PeerState{ID: testPeerID("\x01\xfe binary peer id"), Addr: "10.0.0.1:7000", LastSeen: now}
+		So(s.Append(JournalEntry{Op: JournalRegister, Time: now, InfoHash: infoHash, Name: "name"}), ShouldBeNil)
+		So(s.Append(JournalEntry{Op: JournalAnnounce, Time: now, InfoHash: infoHash, Peer: peer}), ShouldBeNil)
+
+		Convey("Journal is binary safe", func() {
+			state, journal, err := s.Load()
+			So(err, ShouldBeNil)
+			So(state.Torrents, ShouldBeEmpty)
+			So(journal, ShouldHaveLength, 2)
+			So(journal[0].InfoHash, ShouldEqual, infoHash)
+			So(journal[0].Name, ShouldEqual, "name")
+			So(journal[1].Peer.ID, ShouldEqual, peer.ID)
+			So(journal[1].Peer.LastSeen.Equal(now), ShouldBeTrue)
+		})
+		Convey("Interrupted journal write is ignored", func() {
+			f, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_WRONLY|os.O_APPEND, 0600)
+			So(err, ShouldBeNil)
+			f.WriteString(`{"Op":"regis`)
+			f.Close()
+			_, journal, err := s.Load()
+			So(err, ShouldBeNil)
+			So(journal, ShouldHaveLength, 2)
+
+			Convey("and cut off when reopening", func() {
+				So(s.Close(), ShouldBeNil)
+				s, err = NewFileStorage(dir)
+				So(err, ShouldBeNil)
+				So(s.Append(JournalEntry{Op: JournalUnregister, Time: now, InfoHash: infoHash}), ShouldBeNil)
+				_, journal, err := s.Load()
+				So(err, ShouldBeNil)
+				So(journal, ShouldHaveLength, 3)
+				So(journal[2].Op, ShouldEqual, JournalUnregister)
+			})
+		})
+		Convey("Snapshot discards the journal before the rotation", func() {
+			So(s.Rotate(), ShouldBeNil)
+			So(s.Append(JournalEntry{Op: JournalUnregister, Time: now, InfoHash: infoHash}), ShouldBeNil)
+			_, journal, err := s.Load()
+			So(err, ShouldBeNil)
+			So(journal, ShouldHaveLength, 3)
+
+			So(s.Snapshot(SwarmState{
+				Torrents: []TorrentState{{InfoHash: infoHash, Name: "name", Downloaded: 3, Peers: []PeerState{*peer}, Seq: 2}},
+				Bans:     []string{"10.0.0.9"},
+			}), ShouldBeNil)
+			state, journal, err := s.Load()
+			So(err, ShouldBeNil)
+			So(journal, ShouldHaveLength, 1)
+			So(journal[0].Op, ShouldEqual, JournalUnregister)
+			So(state.Bans, ShouldResemble, []string{"10.0.0.9"})
+			So(state.Torrents, ShouldHaveLength, 1)
+			So(state.Torrents[0].InfoHash, ShouldEqual, infoHash)
+			So(state.Torrents[0].Downloaded, ShouldEqual, 3)
+			So(state.Torrents[0].Seq, ShouldEqual, 2)
+			So(state.Torrents[0].Peers[0].ID, ShouldEqual, peer.ID)
+		})
+		Convey("A failed snapshot keeps the rotated journal", func() {
+			So(s.Rotate(), ShouldBeNil)
+			So(s.Append(JournalEntry{Op: JournalUnregister, Time: now, InfoHash: infoHash}), ShouldBeNil)
+			So(s.Rotate(), ShouldBeNil)
+			_, journal, err := s.Load()
+			So(err, ShouldBeNil)
+			So(journal, ShouldHaveLength, 3)
+		})
+	})
+}
+
+func TestRestore(t *testing.T) {
+	Convey("Restoring swarm state", t, func() {
+		dir, err := ioutil.TempDir("", "storage")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+
+		now := time.Now()
+		infoHash := testInfoHash("01234567890123456789")
+		s, err := NewFileStorage(dir)
+		So(err, ShouldBeNil)
+		torrents := NewTrackerTorrents()
+		So(torrents.restore(s, now), ShouldBeNil)
+		So(torrents.register(infoHash, "registered"), ShouldBeNil)
+
+		announce := func(torrents *trackerTorrents, addr string, params announceParams) {
+			listenAddr, err := net.ResolveTCPAddr("tcp", addr)
+			So(err, ShouldBeNil)
+			params.infoHash = infoHash
+			params.port = listenAddr.Port
+			_, err = torrents.handleAnnounce(now, listenAddr, &params, make(bmap))
+			So(err, ShouldBeNil)
+		}
+		announce(torrents, "10.0.0.1:7000", announceParams{peerID: testPeerID("seed"), event: "started", ipv6: "2001:db8::1", clientIP: net.ParseIP("192.0.2.1")})
+		announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "started", left: 10, key: "secret"})
+
+		reopen := func(deadline time.Time) *trackerTorrents {
+			torrents.stopJournal()
+			So(s.Close(), ShouldBeNil)
+			s, err = NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			restored := NewTrackerTorrents()
+			So(restored.restore(s, deadline), ShouldBeNil)
+			return restored
+		}
+		check := func(restored *trackerTorrents) {
+			torrent := restored.get(infoHash)
+			So(torrent, ShouldNotBeNil)
+			So(torrent.name, ShouldEqual, "registered")
+			So(torrent.downloaded, ShouldEqual, 1)
+			So(torrent.peers, ShouldHaveLength, 2)
+			leech := newPeerKey(testPeerID("leech"), net.ParseIP("10.0.0.2"))
+			So(torrent.peers[leech].left, ShouldEqual, 0)
+			So(torrent.peers[leech].key, ShouldEqual, "secret")
+			So(torrent.aliases[keyAlias(testPeerID("leech"), "secret")], ShouldEqual, leech)
+			seed := newPeerKey(testPeerID("seed"), net.ParseIP("10.0.0.1"))
+			So(torrent.peers[seed].altAddr.String(), ShouldEqual, "[2001:db8::1]:7000")
+			So(torrent.peers[seed].clientIP.String(), ShouldEqual, "192.0.2.1")
+			So(torrent.aliases[newPeerKey(testPeerID("seed"), net.ParseIP("2001:db8::1"))], ShouldEqual, seed)
+		}
+
+		Convey("From journal", func() {
+			announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "completed"})
+			check(reopen(now.Add(-time.Minute)))
+		})
+		Convey("From snapshot and journal", func() {
+			So(torrents.snapshot(), ShouldBeNil)
+			announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "completed"})
+			check(reopen(now.Add(-time.Minute)))
+		})
+		Convey("From snapshot", func() {
+			announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "completed"})
+			So(torrents.snapshot(), ShouldBeNil)
+			check(reopen(now.Add(-time.Minute)))
+		})
+		Convey("From a snapshot taken while announcing", func() {
+			announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "completed"})
+			// the completion is both in the snapshot and in the journal
+			// kept after it, it is counted once
+			torrents.stopJournal()
+			So(s.Snapshot(torrents.state()), ShouldBeNil)
+			check(reopen(now.Add(-time.Minute)))
+		})
+		Convey("Merges with registered torrents", func() {
+			announce(torrents, "10.0.0.2:7000", announceParams{peerID: testPeerID("leech"), event: "completed"})
+			torrents.stopJournal()
+			So(s.Close(), ShouldBeNil)
+			s, err = NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			restored := NewTrackerTorrents()
+			So(restored.register(infoHash, "registered"), ShouldBeNil)
+			So(restored.restore(s, now.Add(-time.Minute)), ShouldBeNil)
+			check(restored)
+		})
+		Convey("Drops stale peers", func() {
+			restored := reopen(now.Add(time.Minute))
+			So(restored.get(infoHash).peers, ShouldBeEmpty)
+			So(restored.get(infoHash).aliases, ShouldBeEmpty)
+		})
+		Convey("Skips journal entries without sequence numbers", func() {
+			other := testInfoHash("other678901234567890")
+			torrents.stopJournal()
+			So(s.Append(JournalEntry{Op: JournalRegister, Time: now, InfoHash: other, Name: "other"}), ShouldBeNil)
+			restored := reopen(now.Add(-time.Minute))
+			So(restored.get(other), ShouldBeNil)
+			So(restored.get(infoHash), ShouldNotBeNil)
+		})
+		Convey("Unregistered torrents stay unregistered", func() {
+			So(torrents.unregister(infoHash), ShouldBeNil)
+			So(reopen(now.Add(-time.Minute)).get(infoHash), ShouldBeNil)
+		})
+		Convey("Kicks and bans", func() {
+			leech := newPeerKey(testPeerID("leech"), net.ParseIP("10.0.0.2"))
+			_, ok := torrents.kick(infoHash, torrents.get(infoHash), leech)
+			So(ok, ShouldBeTrue)
+			torrents.ban(net.ParseIP("10.0.0.1"))
+			torrents.ban(net.ParseIP("10.0.0.3"))
+			So(torrents.unban(net.ParseIP("10.0.0.3")), ShouldBeNil)
+			verify := func(restored *trackerTorrents) {
+				So(restored.get(infoHash).peers, ShouldBeEmpty)
+				So(restored.bans(), ShouldResemble, []string{"10.0.0.1"})
+			}
+			Convey("From journal", func() {
+				verify(reopen(now.Add(-time.Minute)))
+			})
+			Convey("From snapshot", func() {
+				So(torrents.snapshot(), ShouldBeNil)
+				verify(reopen(now.Add(-time.Minute)))
+			})
+		})
+		Convey("Links", func() {
+			link := testInfoHash("v2 info hash 0123456")
+			So(torrents.link(infoHash, link), ShouldBeNil)
+			Convey("From journal", func() {
+				So(reopen(now.Add(-time.Minute)).get(link), ShouldNotBeNil)
+			})
+			Convey("From snapshot", func() {
+				So(torrents.snapshot(), ShouldBeNil)
+				So(reopen(now.Add(-time.Minute)).get(link), ShouldNotBeNil)
+			})
+			Convey("Are removed with their torrent", func() {
+				So(torrents.unregister(link), ShouldBeNil)
+				restored := reopen(now.Add(-time.Minute))
+				So(restored.get(link), ShouldBeNil)
+				So(restored.linkMap(), ShouldBeEmpty)
+			})
+		})
+		Reset(func() {
+			s.Close()
+		})
+	})
+}
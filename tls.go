@@ -0,0 +1,168 @@
+package cytracker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certificateCheckInterval is how often the TLS files are checked for changes
+const certificateCheckInterval = 10 * time.Second
+
+// certificates is the TLS configuration read from the certificate, key and
+// client CA files. It is replaced when they are read again, connections in
+// progress keep the configuration they started with.
+type certificates struct {
+	certFile, keyFile, clientCAFile string
+	m                               sync.RWMutex // Protects config and modTimes
+	config                          *tls.Config
+	// modTimes are of the files when they were last read, also if that
+	// failed, or nil if they couldn't be found
+	modTimes []time.Time
+}
+
+// newCertificates reads the files, clientCAFile may be blank
+func newCertificates(certFile, keyFile, clientCAFile string) (c *certificates, err error) {
+	c = &certificates{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err = c.load(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (c *certificates) files() (files []string) {
+	files = []string{c.certFile, c.keyFile}
+	if !blank(c.clientCAFile) {
+		files = append(files, c.clientCAFile)
+	}
+	return
+}
+
+// stat returns the modification times of the files
+func (c *certificates) stat() (modTimes []time.Time, err error) {
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return
+}
+
+// load reads the files, the configuration is kept if they are invalid
+func (c *certificates) load() (err error) {
+	// the times are taken first, so a change while reading is loaded later
+	modTimes, err := c.stat()
+	var config *tls.Config
+	if err == nil {
+		config, err = c.read()
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	// a failed attempt is recorded too, so that it is retried only when the
+	// files change again
+	c.modTimes = modTimes
+	if err == nil {
+		c.config = config
+	}
+	return
+}
+
+// read returns the configuration in the files
+func (c *certificates) read() (config *tls.Config, err error) {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return
+	}
+	config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		// the HTTP server only speaks HTTP/1.1 over a TLS listener
+		NextProtos: []string{"http/1.1"},
+	}
+	if !blank(c.clientCAFile) {
+		pem, err := ioutil.ReadFile(c.clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates in client CA file %v", c.clientCAFile)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// changed reports whether the files changed since they were last read
+func (c *certificates) changed() bool {
+	modTimes, err := c.stat()
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if err != nil || c.modTimes == nil {
+		// reading them reports a missing file once
+		return (err != nil) != (c.modTimes == nil)
+	}
+	for i, modTime := range modTimes {
+		if !modTime.Equal(c.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerConfig returns a configuration that hands out the current one to
+// each connection
+func (c *certificates) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.m.RLock()
+			defer c.m.RUnlock()
+			return c.config, nil
+		},
+	}
+}
+
+func (t *Tracker) certificates() *certificates {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.certs
+}
+
+// ReloadCertificates reads TLSCertFile, TLSKeyFile and TLSClientCAFile again.
+// New connections use them, the current certificates are kept if they are
+// invalid. The tracker does it on SIGHUP and when the files change.
+func (t *Tracker) ReloadCertificates() (err error) {
+	certs := t.certificates()
+	if certs == nil {
+		return fmt.Errorf("Not serving HTTPS")
+	}
+	if err = certs.load(); err != nil {
+		t.log.error("reloading certificates failed", errorField(err))
+		return
+	}
+	t.log.info("reloaded certificates", Field{"cert", certs.certFile})
+	return
+}
+
+// watchCertificates reloads the certificates when their files change, until
+// the tracker quits
+func (t *Tracker) watchCertificates(certs *certificates) {
+	ticker := time.NewTicker(certificateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			if certs.changed() {
+				t.ReloadCertificates()
+			}
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package cytracker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// testCertificate is a certificate for 127.0.0.1 signed by parent, or self
+// signed if parent is nil
+type testCertificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCertificate(name string, ca bool, parent *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	So(err, ShouldBeNil)
+	serial, err := crand.Int(crand.Reader, big.NewInt(1<<62))
+	So(err, ShouldBeNil)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  ca,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, signer, &key.PublicKey, signerKey)
+	So(err, ShouldBeNil)
+	cert, err := x509.ParseCertificate(der)
+	So(err, ShouldBeNil)
+	return &testCertificate{cert, key, der}
+}
+
+// write saves the certificate and the key as PEM files
+func (c *testCertificate) write(certFile, keyFile string) {
+	So(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600), ShouldBeNil)
+	if keyFile == "" {
+		return
+	}
+	der, err := x509.MarshalECPrivateKey(c.key)
+	So(err, ShouldBeNil)
+	So(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600), ShouldBeNil)
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestTLS(t *testing.T) {
+	Convey("HTTPS", t, func() {
+		dir, err := ioutil.TempDir("", "tls")
+		So(err, ShouldBeNil)
+		certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+		first := newTestCertificate("first", false, nil)
+		first.write(certFile, keyFile)
+
+		tracker := NewTracker()
+		tracker.TLSCertFile, tracker.TLSKeyFile = certFile, keyFile
+		url, served := startTracker(tracker)
+		url = "https" + url[len("http"):]
+		infoHash := "01234567890123456789"
+		query := "/announce?" + announceQuery(infoHash, "peer", 7000, 0, 0, 10, "started")
+
+		// get announces with a client trusting roots, it returns the
+		// certificate of the tracker
+		get := func(roots []*testCertificate, clientCert *testCertificate) (*x509.Certificate, error) {
+			config := &tls.Config{RootCAs: x509.NewCertPool()}
+			for _, root := range roots {
+				config.RootCAs.AddCert(root.cert)
+			}
+			if clientCert != nil {
+				config.Certificates = []tls.Certificate{clientCert.tlsCertificate()}
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+			defer client.CloseIdleConnections()
+			r, err := client.Get(url + query)
+			if err != nil {
+				return nil, err
+			}
+			r.Body.Close()
+			So(r.StatusCode, ShouldEqual, http.StatusOK)
+			return r.TLS.PeerCertificates[0], nil
+		}
+
+		cert, err := get([]*testCertificate{first}, nil)
+		So(err, ShouldBeNil)
+		So(cert.Subject.CommonName, ShouldEqual, "first")
+		r, err := http.Get("http" + url[len("https"):] + query)
+		So(err, ShouldBeNil)
+		r.Body.Close()
+		So(r.StatusCode, ShouldEqual, http.StatusBadRequest)
+
+		Convey("reloads certificates", func() {
+			second := newTestCertificate("second", false, nil)
+			second.write(certFile, keyFile)
+			So(tracker.ReloadCertificates(), ShouldBeNil)
+			cert, err := get([]*testCertificate{first, second}, nil)
+			So(err, ShouldBeNil)
+			So(cert.Subject.CommonName, ShouldEqual, "second")
+
+			Convey("when they change", func() {
+				certs := tracker.certificates()
+				So(certs.changed(), ShouldBeFalse)
+				later := time.Now().Add(time.Minute)
+				So(os.Chtimes(keyFile, later, later), ShouldBeNil)
+				So(certs.changed(), ShouldBeTrue)
+			})
+		})
+		Convey("keeps certificates when the new ones are invalid", func() {
+			So(ioutil.WriteFile(keyFile, []byte("garbage"), 0600), ShouldBeNil)
+			So(tracker.ReloadCertificates(), ShouldNotBeNil)
+			cert, err := get([]*testCertificate{first}, nil)
+			So(err, ShouldBeNil)
+			So(cert.Subject.CommonName, ShouldEqual, "first")
+
+			Convey("and retries when they change again", func() {
+				certs := tracker.certificates()
+				So(certs.changed(), ShouldBeFalse)
+				second := newTestCertificate("second", false, nil)
+				second.write(certFile, keyFile)
+				later := time.Now().Add(time.Minute)
+				So(os.Chtimes(keyFile, later, later), ShouldBeNil)
+				So(certs.changed(), ShouldBeTrue)
+				So(tracker.ReloadCertificates(), ShouldBeNil)
+				So(certs.changed(), ShouldBeFalse)
+				cert, err := get([]*testCertificate{second}, nil)
+				So(err, ShouldBeNil)
+				So(cert.Subject.CommonName, ShouldEqual, "second")
+			})
+			Convey("and reports missing files once", func() {
+				certs := tracker.certificates()
+				So(os.Remove(keyFile), ShouldBeNil)
+				So(certs.changed(), ShouldBeTrue)
+				So(tracker.ReloadCertificates(), ShouldNotBeNil)
+				So(certs.changed(), ShouldBeFalse)
+				first.write(certFile, keyFile)
+				So(certs.changed(), ShouldBeTrue)
+			})
+		})
+		Convey("requires client certificates signed by the client CA", func() {
+			ca := newTestCertificate("ca", true, nil)
+			caFile := filepath.Join(dir, "ca.pem")
+			ca.write(caFile, "")
+			tracker.certificates().clientCAFile = caFile
+			So(tracker.ReloadCertificates(), ShouldBeNil)
+
+			_, err := get([]*testCertificate{first}, nil)
+			So(err, ShouldNotBeNil)
+			_, err = get([]*testCertificate{first}, newTestCertificate("stranger", false, nil))
+			So(err, ShouldNotBeNil)
+			cert, err := get([]*testCertificate{first}, newTestCertificate("client", false, ca))
+			So(err, ShouldBeNil)
+			So(cert.Subject.CommonName, ShouldEqual, "first")
+		})
+		Reset(func() {
+			So(tracker.Quit(), ShouldBeNil)
+			So(<-served, ShouldBeNil)
+			os.RemoveAll(dir)
+		})
+	})
+	Convey("HTTPS settings", t, func() {
+		tracker := NewTracker()
+		tracker.TLSCertFile = "cert.pem"
+		So(tracker.Validate(), ShouldNotBeNil)
+		tracker.TLSKeyFile = "key.pem"
+		So(tracker.Validate(), ShouldBeNil)
+		tracker.TLSCertFile, tracker.TLSKeyFile, tracker.TLSClientCAFile = "", "", "ca.pem"
+		So(tracker.Validate(), ShouldNotBeNil)
+		So(tracker.ReloadCertificates(), ShouldNotBeNil)
+
+		_, err := newCertificates("missing.pem", "missing.pem", "")
+		So(err, ShouldNotBeNil)
+	})
+}
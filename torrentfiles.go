@@ -0,0 +1,197 @@
+package cytracker
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const defaultTorrentDirInterval = 10 * time.Second
+
+// torrentFile is a loaded torrent file
+type torrentFile struct {
+	infoHash   InfoHash
+	registered bool // false if the file never loaded
+	modTime    time.Time
+	size       int64
+	failed     bool // the file changed and can't be loaded
+}
+
+// LoadTorrentFiles registers the torrents of files and of the .torrent files in
+// TorrentDir, and unregisters those of previously loaded files that are gone.
+// A file whose info hash changed replaces its old torrent. Files that can't be
+// loaded keep their previous torrent; the first such error of files is returned
+// after all files are processed, errors of TorrentDir are only logged. With
+// Storage, calling it before Start keeps the peers of the restored torrents.
+func (t *Tracker) LoadTorrentFiles(files []string) (err error) {
+	t.fm.Lock()
+	defer t.fm.Unlock()
+	t.fileList = files
+	return t.syncTorrentFiles()
+}
+
+// scanTorrentDir loads the changes of the torrent files
+func (t *Tracker) scanTorrentDir() {
+	t.fm.Lock()
+	defer t.fm.Unlock()
+	t.syncTorrentFiles()
+}
+
+// watchTorrentDir scans TorrentDir now and every TorrentDirInterval until the
+// tracker quits
+func (t *Tracker) watchTorrentDir() {
+	t.scanTorrentDir()
+	interval := t.TorrentDirInterval
+	if interval <= 0 {
+		interval = defaultTorrentDirInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+			t.scanTorrentDir()
+		}
+	}
+}
+
+// reconcileTorrentFiles syncs the restored torrents with the torrent files:
+// files whose torrent the journal unregistered are registered again, and
+// torrents restored for files that are gone are unregistered
+func (t *Tracker) reconcileTorrentFiles() {
+	t.fm.Lock()
+	defer t.fm.Unlock()
+	for file, f := range t.files {
+		if f.registered && !t.torrents.registered(f.infoHash) {
+			t.files[file] = torrentFile{}
+		}
+	}
+	t.syncTorrentFiles()
+	for _, infoHash := range t.torrents.fileTorrents() {
+		if !t.loaded(infoHash) {
+			t.log.info("torrent file removed", infoHashField(infoHash))
+			t.Unregister(infoHash)
+		}
+	}
+}
+
+// syncTorrentFiles loads the listed files and the files of TorrentDir, the
+// caller must hold t.fm
+func (t *Tracker) syncTorrentFiles() (err error) {
+	if t.files == nil {
+		t.files = make(map[string]torrentFile)
+	}
+	listed := make(map[string]bool)
+	for _, file := range t.fileList {
+		listed[file] = true
+		if e := t.loadTorrentFile(file); e != nil && err == nil {
+			err = e
+		}
+	}
+	if !blank(t.TorrentDir) {
+		dirFiles, e := filepath.Glob(filepath.Join(t.TorrentDir, "*.torrent"))
+		if e != nil {
+			t.log.error("can't scan torrent directory", Field{"dir", t.TorrentDir}, errorField(e))
+		}
+		sort.Strings(dirFiles)
+		for _, file := range dirFiles {
+			if listed[file] {
+				continue
+			}
+			listed[file] = true
+			t.loadTorrentFile(file)
+		}
+	}
+	for file := range t.files {
+		if !listed[file] {
+			t.unloadTorrentFile(file)
+		}
+	}
+	return
+}
+
+// loadTorrentFile registers the torrent of file if it changed since it was
+// loaded, the caller must hold t.fm
+func (t *Tracker) loadTorrentFile(file string) (err error) {
+	old, loaded := t.files[file]
+	fail := func(e error) error {
+		if !old.failed {
+			t.log.error("can't load torrent file", Field{"file", file}, errorField(e))
+		}
+		old.failed = true
+		t.files[file] = old
+		return fmt.Errorf("Can't load torrent file %v: %v", file, e)
+	}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return fail(err)
+	}
+	if loaded && stat.ModTime().Equal(old.modTime) && stat.Size() == old.size {
+		if old.failed {
+			return fmt.Errorf("Can't load torrent file %v", file)
+		}
+		return nil
+	}
+	// recording the version of the file first, so that a broken file is
+	// reported once
+	old.modTime, old.size = stat.ModTime(), stat.Size()
+	old.failed = false
+
+	metaInfo, err := readMetaInfo(file)
+	if err != nil {
+		return fail(err)
+	}
+	// hybrid torrents are tracked under the v1 info hash, linked to the v2 one
+	infoHash := metaInfo.infoHashes[0]
+	if old.registered && old.infoHash == infoHash {
+		t.files[file] = old
+		return nil
+	}
+	if old.registered {
+		t.unloadTorrentFile(file)
+	}
+	name := metaInfo.name
+	if name == "" {
+		name = path.Base(file)
+	}
+	if err = t.torrents.registerTorrent(infoHash, name, true); err != nil && !t.loaded(infoHash) {
+		old.registered = false
+		return fail(err)
+	}
+	t.log.info("torrent file loaded", Field{"file", file}, infoHashField(infoHash))
+	old.infoHash, old.registered = infoHash, true
+	t.files[file] = old
+	for _, link := range metaInfo.infoHashes[1:] {
+		if err = t.Link(infoHash, link); err != nil {
+			return fail(err)
+		}
+	}
+	return nil
+}
+
+// loaded reports whether infoHash was loaded from a file, the caller must hold
+// t.fm
+func (t *Tracker) loaded(infoHash InfoHash) bool {
+	for _, f := range t.files {
+		if f.registered && f.infoHash == infoHash {
+			return true
+		}
+	}
+	return false
+}
+
+// unloadTorrentFile forgets file and unregisters its torrent unless another
+// file has the same info hash, the caller must hold t.fm
+func (t *Tracker) unloadTorrentFile(file string) {
+	f := t.files[file]
+	delete(t.files, file)
+	if f.registered && !t.loaded(f.infoHash) {
+		t.log.info("torrent file removed", Field{"file", file}, infoHashField(f.infoHash))
+		t.Unregister(f.infoHash)
+	}
+}
@@ -0,0 +1,201 @@
+package cytracker
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackpal/Taipei-Torrent/torrent"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// writeTorrentFile writes a single file torrent named name and returns its info hash
+func writeTorrentFile(file, name string) InfoHash {
+	content := fmt.Sprintf("d8:announce9:/announce4:infod6:lengthi1e4:name%d:%s12:piece lengthi16384e6:pieces20:%020dee", len(name), name, 0)
+	So(ioutil.WriteFile(file, []byte(content), 0600), ShouldBeNil)
+	metaInfo, err := torrent.GetMetaInfo(nil, file)
+	So(err, ShouldBeNil)
+	infoHash, err := NewInfoHash(metaInfo.InfoHash)
+	So(err, ShouldBeNil)
+	return infoHash
+}
+
+func TestLoadTorrentFiles(t *testing.T) {
+	Convey("Loading torrent files", t, func() {
+		dir, err := ioutil.TempDir("", "torrents")
+		So(err, ShouldBeNil)
+		a, b := filepath.Join(dir, "a.torrent"), filepath.Join(dir, "b.torrent")
+		hashA, hashB := writeTorrentFile(a, "a"), writeTorrentFile(b, "b")
+		tracker := NewTracker()
+		So(tracker.LoadTorrentFiles([]string{a, b}), ShouldBeNil)
+		So(tracker.torrents.get(hashA).name, ShouldEqual, "a")
+		So(tracker.torrents.get(hashB), ShouldNotBeNil)
+
+		Convey("Reloading is idempotent", func() {
+			So(tracker.LoadTorrentFiles([]string{a, b}), ShouldBeNil)
+			So(tracker.torrents.count(), ShouldEqual, 2)
+		})
+		Convey("Unlisted files are unregistered", func() {
+			So(tracker.LoadTorrentFiles([]string{a}), ShouldBeNil)
+			So(tracker.torrents.get(hashB), ShouldBeNil)
+		})
+		Convey("Changed files replace their torrent", func() {
+			hashC := writeTorrentFile(b, "c")
+			So(tracker.LoadTorrentFiles([]string{a, b}), ShouldBeNil)
+			So(tracker.torrents.get(hashB), ShouldBeNil)
+			So(tracker.torrents.get(hashC).name, ShouldEqual, "c")
+		})
+		Convey("Broken files keep their torrent", func() {
+			So(ioutil.WriteFile(b, []byte("garbage"), 0600), ShouldBeNil)
+			So(tracker.LoadTorrentFiles([]string{a, b}), ShouldNotBeNil)
+			So(tracker.torrents.get(hashB), ShouldNotBeNil)
+		})
+		Convey("Hybrid torrents are linked", func() {
+			hybrid := filepath.Join(dir, "hybrid.torrent")
+			writeMetaInfo(hybrid, hybridInfo)
+			So(tracker.LoadTorrentFiles([]string{a, b, hybrid}), ShouldBeNil)
+			v1 := tracker.torrents.get(sha1.Sum([]byte(hybridInfo)))
+			So(v1.name, ShouldEqual, "hybrid")
+			So(tracker.torrents.get(truncateInfoHash(sha256.Sum256([]byte(hybridInfo)))), ShouldEqual, v1)
+			So(tracker.LoadTorrentFiles([]string{a, b}), ShouldBeNil)
+			So(tracker.torrents.linkMap(), ShouldBeEmpty)
+		})
+		Convey("Files with the same torrent", func() {
+			copyOfA := filepath.Join(dir, "copy.torrent")
+			writeTorrentFile(copyOfA, "a")
+			So(tracker.LoadTorrentFiles([]string{a, b, copyOfA}), ShouldBeNil)
+			So(tracker.LoadTorrentFiles([]string{b, copyOfA}), ShouldBeNil)
+			So(tracker.torrents.get(hashA), ShouldNotBeNil)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
+
+func TestWatchTorrentDir(t *testing.T) {
+	Convey("Watching a torrent directory", t, func() {
+		dir, err := ioutil.TempDir("", "torrents")
+		So(err, ShouldBeNil)
+		other, err := ioutil.TempDir("", "torrents")
+		So(err, ShouldBeNil)
+		listed := filepath.Join(other, "listed.torrent")
+		hashListed := writeTorrentFile(listed, "listed")
+		a := filepath.Join(dir, "a.torrent")
+		hashA := writeTorrentFile(a, "a")
+		So(ioutil.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a torrent"), 0600), ShouldBeNil)
+
+		l := &recordingLogger{}
+		tracker := NewTracker()
+		tracker.SetLogger(l)
+		tracker.TorrentDir = dir
+		So(tracker.Validate(), ShouldBeNil)
+		So(tracker.LoadTorrentFiles([]string{listed}), ShouldBeNil)
+		So(tracker.torrents.get(hashA).name, ShouldEqual, "a")
+		So(tracker.torrents.count(), ShouldEqual, 2)
+
+		Convey("New files are registered", func() {
+			hashB := writeTorrentFile(filepath.Join(dir, "b.torrent"), "b")
+			tracker.scanTorrentDir()
+			So(tracker.torrents.get(hashB).name, ShouldEqual, "b")
+		})
+		Convey("Removed files are unregistered", func() {
+			So(os.Remove(a), ShouldBeNil)
+			tracker.scanTorrentDir()
+			So(tracker.torrents.get(hashA), ShouldBeNil)
+			So(tracker.torrents.get(hashListed), ShouldNotBeNil)
+		})
+		Convey("Broken files are reported once", func() {
+			broken := filepath.Join(dir, "broken.torrent")
+			So(ioutil.WriteFile(broken, []byte("garbage"), 0600), ShouldBeNil)
+			tracker.scanTorrentDir()
+			tracker.scanTorrentDir()
+			So(tracker.LoadTorrentFiles([]string{listed}), ShouldBeNil)
+			failed, ok := l.find("can't load torrent file")
+			So(ok, ShouldBeTrue)
+			So(failed.fields["file"], ShouldEqual, broken)
+			count := 0
+			for _, m := range l.messages {
+				if m.msg == failed.msg {
+					count++
+				}
+			}
+			So(count, ShouldEqual, 1)
+
+			Convey("and registered once fixed", func() {
+				hashBroken := writeTorrentFile(broken, "fixed")
+				tracker.scanTorrentDir()
+				So(tracker.torrents.get(hashBroken).name, ShouldEqual, "fixed")
+			})
+		})
+		Convey("Unlisted files outside the directory are unregistered", func() {
+			So(tracker.LoadTorrentFiles(nil), ShouldBeNil)
+			So(tracker.torrents.get(hashListed), ShouldBeNil)
+			So(tracker.torrents.get(hashA), ShouldNotBeNil)
+		})
+		Convey("The directory must exist", func() {
+			tracker.TorrentDir = filepath.Join(dir, "missing")
+			So(tracker.Validate(), ShouldNotBeNil)
+			tracker.TorrentDir = a
+			So(tracker.Validate(), ShouldNotBeNil)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+			os.RemoveAll(other)
+		})
+	})
+}
+
+func TestRestoreTorrentFiles(t *testing.T) {
+	Convey("Restarting with torrent files", t, func() {
+		dir, err := ioutil.TempDir("", "torrents")
+		So(err, ShouldBeNil)
+		a, b := filepath.Join(dir, "a.torrent"), filepath.Join(dir, "b.torrent")
+		hashA, hashB := writeTorrentFile(a, "a"), writeTorrentFile(b, "b")
+		restart := func(files []string, change func(tracker *Tracker)) *Tracker {
+			s, err := NewFileStorage(filepath.Join(dir, "state"))
+			So(err, ShouldBeNil)
+			tracker := NewTracker()
+			tracker.Storage = s
+			So(tracker.LoadTorrentFiles(files), ShouldBeNil)
+			So(tracker.Start(), ShouldBeNil)
+			if change != nil {
+				change(tracker)
+			}
+			So(tracker.Shutdown(context.Background()), ShouldBeNil)
+			return tracker
+		}
+		restart([]string{a, b}, nil)
+
+		Convey("Torrents of deleted files are unregistered", func() {
+			So(os.Remove(b), ShouldBeNil)
+			tracker := restart([]string{a}, nil)
+			So(tracker.torrents.get(hashA), ShouldNotBeNil)
+			So(tracker.torrents.get(hashB), ShouldBeNil)
+		})
+		Convey("Unregistered torrents of files are registered again", func() {
+			restart([]string{a, b}, func(tracker *Tracker) {
+				So(tracker.Unregister(hashB), ShouldBeNil)
+			})
+			tracker := restart([]string{a, b}, nil)
+			So(tracker.torrents.get(hashB), ShouldNotBeNil)
+		})
+		Convey("Registered torrents are kept", func() {
+			hashC := testInfoHash("01234567890123456789")
+			restart([]string{a, b}, func(tracker *Tracker) {
+				So(tracker.Register(hashC, "c"), ShouldBeNil)
+			})
+			tracker := restart(nil, nil)
+			So(tracker.torrents.get(hashA), ShouldBeNil)
+			So(tracker.torrents.get(hashC), ShouldNotBeNil)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
@@ -3,105 +3,554 @@ package cytracker
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type trackerTorrents map[string]*trackerTorrent
+// torrentShards is the number of independently locked parts of the torrent
+// map, so that announces for different torrents don't contend for one lock
+const torrentShards = 64
+
+type torrentShard struct {
+	m        sync.RWMutex // Protects torrents
+	torrents map[InfoHash]*trackerTorrent
+}
+
+type trackerTorrents struct {
+	shards [torrentShards]torrentShard
+	log    logger
+	// store records changes if set, it is set before serving starts
+	store Storage
+	// seq is the sequence number of the last journal entry
+	seq uint64
+	// journaled queues the entries for the store, it is nil when not
+	// journaling. appended is closed once they are appended after it is
+	// closed.
+	jm        sync.RWMutex // Protects journaled
+	journaled chan JournalEntry
+	appended  chan struct{}
+	// unsnapshotted counts the entries appended since the last snapshot,
+	// snapshotDue is signalled when there are snapshotEntries
+	unsnapshotted int64
+	snapshotDue   chan struct{}
+	sm            sync.Mutex // Serializes snapshots
+	// links maps the other info hashes of hybrid torrents to the info hash
+	// they are tracked under. It holds a map[InfoHash]InfoHash that is
+	// replaced rather than changed, so announces read it without locking.
+	links     atomic.Value
+	lm        sync.Mutex   // Serializes changes of links
+	m         sync.RWMutex // Protects policy, blacklist and banned
+	policy    AccessPolicy
+	blacklist map[InfoHash]bool
+	banned    map[string]bool // IP addresses
+	bansSeq   uint64          // of the last journaled ban or unban
+	events    eventBus
+	// restoring is set while restore replays the saved state, which
+	// publishes no events
+	restoring bool
+}
 
-// Single-threaded imp
 type trackerTorrent struct {
+	m          sync.RWMutex // Protects all fields
 	name       string
+	auto       bool // registered by an announce rather than Register
+	file       bool // registered for a torrent file
+	removed    bool // no longer in the torrent map
 	downloaded uint64
 	peers      trackerPeers
+	keys       peerKeys // of peers, kept by addPeer and removePeer
+	// seeders and leechers count the peers, they are kept by addPeer,
+	// removePeer and setLeft
+	seeders  int
+	leechers int
+	// aliases maps the other keys of peers to their keys: the key at the
+	// alternate listen address of a dual-stack peer, and the keyAlias of a
+	// peer that sent key=
+	aliases map[string]string
+	// transfers are the statistics of the announces
+	transfers TransferStats
+	// seq is the sequence number of the last journal entry changing it
+	seq uint64
 }
 
 const (
 	paramComplete    = "complete"
 	paramIncomplete  = "incomplete"
 	paramPeers       = "peers"
+	paramPeers6      = "peers6"
 	defaultPeerCount = 50
 )
 
-func NewTrackerTorrents() trackerTorrents {
-	return make(trackerTorrents)
+func NewTrackerTorrents() *trackerTorrents {
+	t := &trackerTorrents{
+		blacklist:   make(map[InfoHash]bool),
+		banned:      make(map[string]bool),
+		snapshotDue: make(chan struct{}, 1),
+	}
+	for i := range t.shards {
+		t.shards[i].torrents = make(map[InfoHash]*trackerTorrent)
+	}
+	return t
 }
 
-func (t trackerTorrents) handleAnnounce(now time.Time, peerListenAddress *net.TCPAddr, params *announceParams, response bmap) (err error) {
-	log.Println("announce", params)
-	torrent := t[params.infoHash]
-	if torrent == nil {
-		if err = t.register(params.infoHash, params.infoHash); err != nil {
-			return err
+func newTrackerTorrent(name string) *trackerTorrent {
+	// MEMORY_ALLOCATION
+	// TODO: use torrent pool
+	return &trackerTorrent{name: name, peers: make(trackerPeers), aliases: make(map[string]string)}
+}
+
+// shard returns the shard holding infoHash
+func (t *trackerTorrents) shard(infoHash InfoHash) *torrentShard {
+	// FNV-1a, clients may announce info hashes that aren't SHA-1 hashes
+	return &t.shards[fnv1a(infoHash[:])%torrentShards]
+}
+
+// get returns the torrent with infoHash or linked to it, or nil
+func (t *trackerTorrents) get(infoHash InfoHash) *trackerTorrent {
+	infoHash = t.resolve(infoHash)
+	s := t.shard(infoHash)
+	s.m.RLock()
+	defer s.m.RUnlock()
+	return s.torrents[infoHash]
+}
+
+// each calls f for every torrent. The shards are not locked while f runs, so
+// f may lock the torrent and change it.
+func (t *trackerTorrents) each(f func(infoHash InfoHash, torrent *trackerTorrent)) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.m.RLock()
+		infoHashes := make([]InfoHash, 0, len(s.torrents))
+		torrents := make([]*trackerTorrent, 0, len(s.torrents))
+		for infoHash, torrent := range s.torrents {
+			infoHashes = append(infoHashes, infoHash)
+			torrents = append(torrents, torrent)
+		}
+		s.m.RUnlock()
+		for j, torrent := range torrents {
+			f(infoHashes[j], torrent)
+		}
+	}
+}
+
+// count returns the number of torrents
+func (t *trackerTorrents) count() (n int) {
+	for i := range t.shards {
+		s := &t.shards[i]
+		s.m.RLock()
+		n += len(s.torrents)
+		s.m.RUnlock()
+	}
+	return
+}
+
+func (t *trackerTorrents) handleAnnounce(now time.Time, peerListenAddress *net.TCPAddr, params *announceParams, response bmap) (delta transfer, err error) {
+	altAddress, err := newTrackerPeerAltAddress(peerListenAddress, params)
+	if err != nil {
+		return
+	}
+	if err = t.checkBanned(params.clientIP, peerListenAddress, altAddress); err != nil {
+		return
+	}
+	var torrent *trackerTorrent
+	for {
+		if torrent = t.get(params.infoHash); torrent == nil {
+			if err = t.checkAccess(params.infoHash, nil); err != nil {
+				return
+			}
+			if torrent = t.autoRegister(params.infoHash); torrent == nil {
+				// linked since it was looked up
+				continue
+			}
+		}
+		torrent.m.Lock()
+		if !torrent.removed {
+			break
 		}
-		torrent = t[params.infoHash]
+		// removed since it was looked up
+		torrent.m.Unlock()
+	}
+	defer torrent.m.Unlock()
+	if err = t.checkAccess(params.infoHash, torrent); err != nil {
+		return
+	}
+	// the fields of the announce are built for its debug messages only if
+	// they are logged, the other messages add them themselves
+	log := t.log
+	if log.enabled(LevelDebug) {
+		log = log.with(announceFields(peerListenAddress, params)...)
+	}
+	var cached bool
+	completed := torrent.downloaded
+	delta, cached, err = torrent.handleAnnounce(log, now, peerListenAddress, altAddress, params, response)
+	if err == nil && !cached {
+		t.publishAnnounce(now, torrent, peerListenAddress, params, torrent.downloaded > completed)
+		// journaling under the torrent lock keeps announces of a torrent in order
+		t.journal(JournalEntry{
+			Op:       JournalAnnounce,
+			Time:     now,
+			InfoHash: params.infoHash,
+			Event:    params.event,
+			Peer:     newPeerState(now, peerListenAddress, altAddress, params),
+		}, &torrent.seq)
+	}
+	return
+}
+
+// announceFields returns the fields of the messages of an announce
+func announceFields(peerListenAddress *net.TCPAddr, params *announceParams) []Field {
+	return []Field{infoHashField(params.infoHash), Field{fieldPeer, peerListenAddress.String()}}
+}
+
+// announceLog returns log, which has the fields of an announce if debug
+// messages are logged, with those fields
+func announceLog(log logger, peerListenAddress *net.TCPAddr, params *announceParams) logger {
+	if log.enabled(LevelDebug) {
+		return log
+	}
+	return log.with(announceFields(peerListenAddress, params)...)
+}
+
+// publishAnnounce publishes the event of an announce to torrent, the caller
+// must hold its lock
+func (t *trackerTorrents) publishAnnounce(now time.Time, torrent *trackerTorrent, peerListenAddress *net.TCPAddr, params *announceParams, completes bool) {
+	var typ EventType
+	switch {
+	case params.event == "started":
+		typ = EventStarted
+	case params.event == "completed" && completes:
+		typ = EventCompleted
+	case params.event == "stopped":
+		typ = EventStopped
+	default:
+		return
 	}
-	return torrent.handleAnnounce(now, peerListenAddress, params, response)
+	t.publish(torrent.newPeerEvent(typ, now, params.infoHash, params.peerID, peerListenAddress))
 }
 
-func (t trackerTorrents) scrape(infoHashes []string) (files bmap) {
+// publish sends e to the subscribers unless the state is being restored
+func (t *trackerTorrents) publish(e Event) {
+	if !t.restoring {
+		t.events.publish(e)
+	}
+}
+
+func (t *trackerTorrents) scrape(infoHashes []InfoHash) (files bmap) {
 	files = make(bmap)
+	scrape := func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		defer torrent.m.RUnlock()
+		if t.checkAccess(infoHash, torrent) == nil {
+			files[string(infoHash[:])] = torrent.scrape()
+		}
+	}
 	if len(infoHashes) > 0 {
 		for _, infoHash := range infoHashes {
-			if torrent, ok := t[infoHash]; ok {
-				files[infoHash] = torrent.scrape()
+			if torrent := t.get(infoHash); torrent != nil {
+				scrape(infoHash, torrent)
 			}
 		}
 	} else {
-		for infoHash, torrent := range t {
-			files[infoHash] = torrent.scrape()
-		}
+		t.each(scrape)
 	}
 	return
 }
 
-func (t trackerTorrents) register(infoHash, name string) (err error) {
-	log.Printf("registering %#v with infoHash %v", name, infoHash)
-	if t2, ok := t[infoHash]; ok {
-		return fmt.Errorf("Already have a torrent %#v with infoHash %v", t2.name, infoHash)
+func (t *trackerTorrents) register(infoHash InfoHash, name string) (err error) {
+	return t.registerTorrent(infoHash, name, false)
+}
+
+// registerTorrent registers a torrent, file tells whether it is registered for
+// a torrent file. A torrent file takes over a torrent restored for a file.
+func (t *trackerTorrents) registerTorrent(infoHash InfoHash, name string, file bool) (err error) {
+	t.log.info("registering torrent", infoHashField(infoHash), Field{"name", name})
+	s := t.shard(infoHash)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if target := t.resolve(infoHash); target != infoHash {
+		return fmt.Errorf("Info hash %v is linked to torrent %v", infoHash, target)
+	}
+	entry := JournalEntry{Op: JournalRegister, Time: time.Now(), InfoHash: infoHash, Name: name, File: file}
+	if t2, ok := s.torrents[infoHash]; ok {
+		t2.m.Lock()
+		defer t2.m.Unlock()
+		if !t2.auto && !(t2.file && file) {
+			return fmt.Errorf("Already have a torrent %#v with infoHash %v", t2.name, infoHash)
+		}
+		// explicit registration takes over an auto-registered torrent
+		t2.name = name
+		t2.auto = false
+		t2.file = file
+		t.publish(t2.newEvent(EventRegistered, time.Now(), infoHash))
+		t.journal(entry, &t2.seq)
+	} else {
+		torrent := newTrackerTorrent(name)
+		torrent.file = file
+		s.torrents[infoHash] = torrent
+		t.publish(torrent.newEvent(EventRegistered, time.Now(), infoHash))
+		t.journal(entry, &torrent.seq)
 	}
-	// MEMORY_ALLOCATION
-	// TODO: use torrent pool
-	t[infoHash] = &trackerTorrent{name: name, peers: make(trackerPeers)}
 	return nil
 }
 
-func (t trackerTorrents) unregister(infoHash string) (err error) {
-	log.Println("unregistering", infoHash)
-	delete(t, infoHash)
+// registered reports whether infoHash is tracked and not auto-registered
+func (t *trackerTorrents) registered(infoHash InfoHash) bool {
+	torrent := t.get(infoHash)
+	if torrent == nil {
+		return false
+	}
+	torrent.m.RLock()
+	defer torrent.m.RUnlock()
+	return !torrent.auto && !torrent.removed
+}
+
+// fileTorrents returns the info hashes of the torrents registered for torrent
+// files
+func (t *trackerTorrents) fileTorrents() (infoHashes []InfoHash) {
+	t.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		defer torrent.m.RUnlock()
+		if torrent.file && !torrent.auto {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	})
 	return
 }
 
-// TODO: move to structure fields and refactor
-func (t *trackerTorrent) countPeers() (complete, incomplete int) {
-	for _, p := range t.peers {
-		if p.isComplete() {
-			complete++
-		} else {
-			incomplete++
+// autoRegister starts tracking a torrent announced for the first time, or
+// returns it if a concurrent announce registered it first. It returns nil if
+// infoHash was linked to another torrent meanwhile.
+func (t *trackerTorrents) autoRegister(infoHash InfoHash) (torrent *trackerTorrent) {
+	s := t.shard(infoHash)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if t.resolve(infoHash) != infoHash {
+		return nil
+	}
+	if torrent = s.torrents[infoHash]; torrent != nil {
+		return
+	}
+	t.log.info("auto-registering torrent", infoHashField(infoHash))
+	torrent = newTrackerTorrent(infoHash.String())
+	torrent.auto = true
+	s.torrents[infoHash] = torrent
+	t.publish(torrent.newEvent(EventRegistered, time.Now(), infoHash))
+	t.journal(JournalEntry{Op: JournalRegister, Time: time.Now(), InfoHash: infoHash, Name: torrent.name, Auto: true}, &torrent.seq)
+	return
+}
+
+func (t *trackerTorrents) unregister(infoHash InfoHash) (err error) {
+	t.log.info("unregistering torrent", infoHashField(infoHash))
+	t.lm.Lock()
+	defer t.lm.Unlock()
+	infoHash = t.resolve(infoHash)
+	t.unlink(infoHash)
+	s := t.shard(infoHash)
+	s.m.Lock()
+	defer s.m.Unlock()
+	if torrent, ok := s.torrents[infoHash]; ok {
+		torrent.m.Lock()
+		torrent.removed = true
+		t.publish(torrent.newEvent(EventUnregistered, time.Now(), infoHash))
+		torrent.m.Unlock()
+	}
+	delete(s.torrents, infoHash)
+	t.journal(JournalEntry{Op: JournalUnregister, Time: time.Now(), InfoHash: infoHash}, nil)
+	return
+}
+
+// drop removes torrent if it is still an auto-registered torrent without peers
+func (t *trackerTorrents) drop(infoHash InfoHash, torrent *trackerTorrent) bool {
+	s := t.shard(infoHash)
+	s.m.Lock()
+	defer s.m.Unlock()
+	torrent.m.Lock()
+	defer torrent.m.Unlock()
+	if s.torrents[infoHash] != torrent || !torrent.auto || len(torrent.peers) > 0 {
+		return false
+	}
+	t.log.info("dropping torrent without peers", infoHashField(infoHash))
+	torrent.removed = true
+	delete(s.torrents, infoHash)
+	t.publish(torrent.newEvent(EventUnregistered, time.Now(), infoHash))
+	t.journal(JournalEntry{Op: JournalUnregister, Time: time.Now(), InfoHash: infoHash}, nil)
+	return true
+}
+
+// resolve returns the info hash the torrent with infoHash is tracked under
+func (t *trackerTorrents) resolve(infoHash InfoHash) InfoHash {
+	if target, ok := t.linkMap()[infoHash]; ok {
+		return target
+	}
+	return infoHash
+}
+
+func (t *trackerTorrents) linkMap() map[InfoHash]InfoHash {
+	links, _ := t.links.Load().(map[InfoHash]InfoHash)
+	return links
+}
+
+// changeLinks replaces the links with a copy changed by f, the caller must
+// hold t.lm
+func (t *trackerTorrents) changeLinks(f func(links map[InfoHash]InfoHash)) {
+	old := t.linkMap()
+	links := make(map[InfoHash]InfoHash, len(old)+1)
+	for link, target := range old {
+		links[link] = target
+	}
+	f(links)
+	t.links.Store(links)
+}
+
+// unlink removes the links to infoHash, the caller must hold t.lm
+func (t *trackerTorrents) unlink(infoHash InfoHash) {
+	t.changeLinks(func(links map[InfoHash]InfoHash) {
+		for link, target := range links {
+			if target == infoHash {
+				delete(links, link)
+			}
 		}
+	})
+}
+
+// link tracks the torrent infoHash under link too. A torrent auto-registered
+// under link is merged into it.
+func (t *trackerTorrents) link(infoHash, link InfoHash) (err error) {
+	t.log.info("linking torrent", infoHashField(infoHash), Field{"link", link.String()})
+	t.lm.Lock()
+	defer t.lm.Unlock()
+	links := t.linkMap()
+	if target, ok := links[link]; ok {
+		if target == infoHash {
+			return nil
+		}
+		return fmt.Errorf("Info hash %v is linked to torrent %v", link, target)
+	}
+	if target, ok := links[infoHash]; ok {
+		return fmt.Errorf("Info hash %v is linked to torrent %v", infoHash, target)
+	}
+	for _, target := range links {
+		if target == link {
+			return fmt.Errorf("Torrent %v has links", link)
+		}
+	}
+	if infoHash == link {
+		return fmt.Errorf("Can't link torrent %v to itself", infoHash)
+	}
+
+	torrent := t.get(infoHash)
+	s := t.shard(link)
+	s.m.Lock()
+	defer s.m.Unlock()
+	merged := s.torrents[link]
+	if merged != nil {
+		merged.m.Lock()
+		defer merged.m.Unlock()
+		if !merged.auto {
+			return fmt.Errorf("Already have a torrent %#v with infoHash %v", merged.name, link)
+		}
+	}
+	if torrent == nil {
+		return fmt.Errorf("Unknown torrent %v", infoHash)
 	}
+	torrent.m.Lock()
+	defer torrent.m.Unlock()
+	if torrent.removed || torrent.auto {
+		return fmt.Errorf("Torrent %v is not registered", infoHash)
+	}
+	t.changeLinks(func(links map[InfoHash]InfoHash) {
+		links[link] = infoHash
+	})
+	if merged != nil {
+		torrent.merge(merged)
+		merged.removed = true
+		delete(s.torrents, link)
+	}
+	t.journal(JournalEntry{Op: JournalLink, Time: time.Now(), InfoHash: infoHash, Link: &link}, &torrent.seq)
 	return
 }
 
-func (t *trackerTorrent) handleAnnounce(now time.Time, peerListenAddress *net.TCPAddr, params *announceParams, response bmap) (err error) {
+// merge adds the peers and completions of other, the caller must hold both
+// locks
+func (t *trackerTorrent) merge(other *trackerTorrent) {
+	for key, peer := range other.peers {
+		if _, ok := t.peers[key]; ok {
+			continue
+		}
+		t.addPeer(key, peer)
+	}
+	t.downloaded += other.downloaded
+	t.transfers.merge(other.transfers)
+}
+
+// countPeers returns the numbers of seeders and leechers
+func (t *trackerTorrent) countPeers() (complete, incomplete int) {
+	return t.seeders, t.leechers
+}
+
+// count adds n to the counter of the peer
+func (t *trackerTorrent) count(peer *trackerPeer, n int) {
+	if peer.isComplete() {
+		t.seeders += n
+	} else {
+		t.leechers += n
+	}
+}
+
+// setLeft updates the bytes left of a peer in the peer table
+func (t *trackerTorrent) setLeft(peer *trackerPeer, left uint64) {
+	t.count(peer, -1)
+	peer.left = left
+	t.count(peer, 1)
+}
+
+// handleAnnounce updates the peer and writes the response. An early regular
+// announce fails, or is answered with the previous response to the peer which
+// is reported as cached; the peer is not updated.
+func (t *trackerTorrent) handleAnnounce(log logger, now time.Time, peerListenAddress, altAddress *net.TCPAddr, params *announceParams, response bmap) (delta transfer, cached bool, err error) {
 	var (
 		// current peer
 		peer       *trackerPeer
 		peerExists bool
-		peerKey    = peerListenAddress.String()
+		peerKey    = newPeerKey(params.peerID, peerListenAddress.IP)
+		// announcing over the alternate address
+		alternate bool
 	)
 
+	// a dual-stack peer announcing over its other IP family is the same peer
+	if key, ok := t.aliases[peerKey]; ok {
+		if _, ok := t.peers[key]; ok {
+			peerKey, alternate = key, true
+		}
+	}
+
 	// checking peer existance
-	if peer, peerExists = t.peers[peerKey]; peerExists {
-		// checking peer ID persistance
-		if peer.id != params.peerID {
-			log.Printf("Peer changed ID. %#v != %#v", peer.id, params.peerID)
-			// MEMORY_FREE
-			t.peers.Remove(peerKey)
-			peer = nil
+	peer, peerExists = t.peers[peerKey]
+	if !peerExists && !blank(params.key) {
+		// the key proves that a peer moved to another IP address
+		if key, ok := t.aliases[keyAlias(params.peerID, params.key)]; ok {
+			if peer, peerExists = t.peers[key]; peerExists {
+				announceLog(log, peerListenAddress, params).info("peer moved", Field{"old_addr", peer.listenAddr.String()})
+				t.removePeer(key)
+				peer.altAddr = nil
+				t.addPeer(peerKey, peer)
+			}
+		}
+	}
+
+	if peerExists && t.early(peer, now, params) {
+		log.debug("early announce", Field{fieldEvent, params.event})
+		if _, compact := peer.response[paramPeers].(string); params.limits.CacheEarlyAnnounces && peer.response != nil && compact == params.compact {
+			for k, v := range peer.response {
+				response[k] = v
+			}
+			cached = true
+			return
 		}
+		err = failure{"too_early", fmt.Errorf("Announcing too early, the min interval is %v", params.limits.MinInterval)}
+		return
 	}
 
 	if peer == nil {
@@ -113,63 +562,98 @@ func (t *trackerTorrent) handleAnnounce(now time.Time, peerListenAddress *net.TC
 			listenAddr: peerListenAddress,
 			id:         params.peerID,
 		}
-		t.peers.Add(peerKey, peer)
+		t.addPeer(peerKey, peer)
+		// the first announce is never early but takes a token
+		t.early(peer, now, params)
+		log.debug("peer joined")
+	}
+
+	if alternate {
+		// the announce came over the alternate address, an ipv4= or ipv6= of
+		// the family of the listen address is ignored
+		t.setAltAddress(peerKey, peer, peerListenAddress)
+	} else {
+		// the port may have changed
+		peer.listenAddr = peerListenAddress
+		if altAddress != nil {
+			t.setAltAddress(peerKey, peer, altAddress)
+		}
+	}
+	if params.clientIP != nil {
+		peer.clientIP = params.clientIP
+	}
+	if !blank(params.key) && params.key != peer.key {
+		t.setKey(peerKey, peer, params.key)
 	}
 
+	if peerExists {
+		delta = peer.transferSince(params)
+	} else if params.event == "started" {
+		// counters of a new session start from zero
+		delta = transfer{uploaded: params.uploaded, downloaded: params.downloaded}
+	}
+
+	// a completion counts once per download, not for every completed event a
+	// seeder sends (BEP 48)
+	completes := !peerExists || peer.left > 0
+
 	// updating params
 	// TODO: refactor into function
 	peer.lastSeen = now
 	peer.uploaded = params.uploaded
 	peer.downloaded = params.downloaded
-	peer.left = params.left
+	t.setLeft(peer, params.left)
 
-	log.Printf("Peer %s Event %s", peerKey, params.event)
+	log.debug("announce", Field{fieldEvent, params.event})
 	// processing event
 	switch params.event {
 	default:
-		// TODO: report this as a warning
-		log.Printf("Peer %s Unknown event %s", peerKey, params.event)
+		announceLog(log, peerListenAddress, params).warn("unknown event", Field{fieldEvent, params.event})
 	case "":
 	case "started":
 		// do nothing
 	case "completed":
-		t.downloaded++
-		log.Printf("Peer %s completed. Total completions %d", peerKey, t.downloaded)
+		if completes {
+			t.downloaded++
+		}
+		log.debug("peer completed", Field{"downloaded", t.downloaded})
 	case "stopped":
 		// This client is reporting that they have stopped. Drop them from the peer table.
 		// And don't send any peers, since they won't need them.
-		log.Printf("Peer %s stopped", peerKey)
-		delete(t.peers, peerKey)
+		log.debug("peer stopped")
+		t.removePeer(peerKey)
 		params.numWant = 0
 	}
+	seeders, leechers := t.countPeers()
+	t.transfers.record(now, delta, params.event == "completed" && completes, seeders, leechers)
 
 	// generating response
 	response[paramComplete], response[paramIncomplete] = t.countPeers()
 
-	// calculating peer count for response
-	// TODO: extract to function
+	// calculating peer count for response, numWant is already limited by
+	// the tracker configuration
 	peerCount := len(t.peers)
 	numWant := params.numWant
-
-	if numWant <= 0 || numWant > defaultPeerCount {
-		// numWant incorrect
-		numWant = defaultPeerCount
-	}
 	if numWant > peerCount {
 		numWant = peerCount
 	}
 
-	// picking random peers from peerlist for current peer
-	peerKeys := t.peers.pickRandomPeers(peerKey, params.compact, numWant)
+	// picking peers from peerlist for current peer
+	selector := PeerSelector(randomSelector{})
+	if params.limits != nil {
+		selector = params.limits.peerSelector()
+	}
+	peerKeys := selector.SelectPeers(Peers{t.peers, t.keys}, peerKey, numWant)
 	if params.compact {
-		var b bytes.Buffer
+		var b, b6 bytes.Buffer
 		// MEMORY_ALLOCATION
 		// TODO: use bytes buffer pool
-		err = t.peers.writeCompactPeers(&b, peerKeys)
+		err = t.peers.writeCompactPeers(&b, &b6, peerKeys)
 		if err != nil {
 			return
 		}
 		response[paramPeers] = string(b.Bytes())
+		response[paramPeers6] = string(b6.Bytes())
 	} else {
 		var peers []bmap
 		// MEMORY_ALLOCATION
@@ -181,9 +665,104 @@ func (t *trackerTorrent) handleAnnounce(now time.Time, peerListenAddress *net.TC
 		}
 		response[paramPeers] = peers
 	}
+	if params.limits != nil && params.limits.CacheEarlyAnnounces && params.event != "stopped" {
+		// MEMORY_ALLOCATION
+		peer.response = make(bmap, len(response))
+		for k, v := range response {
+			peer.response[k] = v
+		}
+	}
 	return
 }
 
-func (t *trackerTorrent) reap(deadline time.Time) {
-	t.peers.reap(deadline)
+// early reports whether the announce comes sooner than MinInterval allows.
+// Every announce takes a token of the peer, only regular ones are early.
+func (t *trackerTorrent) early(peer *trackerPeer, now time.Time, params *announceParams) bool {
+	if params.limits == nil || params.limits.MinInterval <= 0 {
+		return false
+	}
+	rate := 1 / params.limits.MinInterval.Seconds()
+	return !peer.limit.take(now, rate, params.limits.peerAnnounceBurst()) && params.event == ""
+}
+
+// newPeerKey returns the key of the peer with id at ip. A peer keeps its key
+// when it changes ports, and clients behind one NAT address don't collide.
+func newPeerKey(id PeerID, ip net.IP) string {
+	return id.String() + "@" + ip.String()
+}
+
+// keyAlias returns the alias of the peer with id that sent key=
+func keyAlias(id PeerID, key string) string {
+	return id.String() + "#" + key
+}
+
+// aliases returns the aliases of the peer
+func (p *trackerPeer) aliases() (aliases []string) {
+	if p.altAddr != nil {
+		aliases = append(aliases, newPeerKey(p.id, p.altAddr.IP))
+	}
+	if !blank(p.key) {
+		aliases = append(aliases, keyAlias(p.id, p.key))
+	}
+	return
+}
+
+func (t *trackerTorrent) addAliases(peerKey string, peer *trackerPeer) {
+	for _, alias := range peer.aliases() {
+		t.aliases[alias] = peerKey
+	}
+}
+
+func (t *trackerTorrent) removeAliases(peerKey string, peer *trackerPeer) {
+	for _, alias := range peer.aliases() {
+		if t.aliases[alias] == peerKey {
+			delete(t.aliases, alias)
+		}
+	}
+}
+
+// setAltAddress records the listen address of the other IP family of a peer
+func (t *trackerTorrent) setAltAddress(peerKey string, peer *trackerPeer, altAddress *net.TCPAddr) {
+	t.removeAliases(peerKey, peer)
+	peer.altAddr = altAddress
+	t.addAliases(peerKey, peer)
+}
+
+// setKey records the key= of a peer
+func (t *trackerTorrent) setKey(peerKey string, peer *trackerPeer, key string) {
+	t.removeAliases(peerKey, peer)
+	peer.key = key
+	t.addAliases(peerKey, peer)
+}
+
+// addPeer adds the peer to the peer table, replacing a peer with the same key
+func (t *trackerTorrent) addPeer(peerKey string, peer *trackerPeer) {
+	t.removePeer(peerKey)
+	t.peers.Add(peerKey, peer)
+	t.keys.add(peerKey, peer)
+	t.addAliases(peerKey, peer)
+	t.count(peer, 1)
+}
+
+func (t *trackerTorrent) removePeer(peerKey string) {
+	peer, ok := t.peers[peerKey]
+	if !ok {
+		return
+	}
+	t.removeAliases(peerKey, peer)
+	t.count(peer, -1)
+	t.keys.remove(t.peers, peer)
+	t.peers.Remove(peerKey)
+}
+
+// reap removes peers last seen before deadline and returns them
+func (t *trackerTorrent) reap(log logger, deadline time.Time) (reaped []*trackerPeer) {
+	for key, peer := range t.peers {
+		if deadline.After(peer.lastSeen) {
+			log.debug("reaping peer", Field{fieldPeer, key})
+			t.removePeer(key)
+			reaped = append(reaped, peer)
+		}
+	}
+	return
 }
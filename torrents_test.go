@@ -0,0 +1,280 @@
+package cytracker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func benchmarkInfoHash(i int) string {
+	return fmt.Sprintf("%020d", i)
+}
+
+// benchmarkPeers is the number of peers per goroutine of benchmarkAnnounce
+const benchmarkPeers = 1000
+
+// benchmarkAnnounce announces from parallel goroutines to count torrents
+func benchmarkAnnounce(b *testing.B, count int) {
+	torrents := NewTrackerTorrents()
+	var goroutines int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		g := int(atomic.AddInt64(&goroutines, 1))
+		now := time.Now()
+		for i := 0; pb.Next(); i++ {
+			// a fixed pool of peers keeps the swarms from growing
+			p := i % benchmarkPeers
+			params := announceParams{
+				infoHash: testInfoHash(benchmarkInfoHash((g*7919 + i) % count)),
+				peerID:   testPeerID(fmt.Sprintf("%020d", p)),
+				port:     6881,
+				compact:  true,
+				left:     uint64(p % 2),
+			}
+			addr := &net.TCPAddr{IP: net.IPv4(10, byte(g), byte(p>>8), byte(p)), Port: 6881}
+			if _, err := torrents.handleAnnounce(now, addr, &params, make(bmap)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkAnnounceManyTorrents(b *testing.B) {
+	benchmarkAnnounce(b, 10000)
+}
+
+func BenchmarkAnnounceOneTorrent(b *testing.B) {
+	benchmarkAnnounce(b, 1)
+}
+
+func BenchmarkScrape(b *testing.B) {
+	torrents := NewTrackerTorrents()
+	now := time.Now()
+	const count = 1000
+	for i := 0; i < count; i++ {
+		params := announceParams{infoHash: testInfoHash(benchmarkInfoHash(i)), peerID: testPeerID("peer"), port: 6881}
+		torrents.handleAnnounce(now, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 6881}, &params, make(bmap))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			torrents.scrape([]InfoHash{testInfoHash(benchmarkInfoHash(i % count))})
+		}
+	})
+}
+
+func TestConcurrentAnnounces(t *testing.T) {
+	Convey("Concurrent announces", t, func() {
+		torrents := NewTrackerTorrents()
+		now := time.Now()
+		const (
+			goroutines = 8
+			announces  = 200
+			count      = 10
+		)
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < announces; i++ {
+					params := announceParams{
+						infoHash: testInfoHash(benchmarkInfoHash(i % count)),
+						peerID:   testPeerID(fmt.Sprintf("peer%d", g)),
+						port:     6881,
+						compact:  true,
+					}
+					addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(g)), Port: 6881}
+					torrents.handleAnnounce(now, addr, &params, make(bmap))
+					if i%50 == 0 {
+						// readers and bulk operations run alongside announces
+						torrents.scrape(nil)
+						torrents.reap(now.Add(-time.Hour))
+						torrents.state()
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		So(torrents.count(), ShouldEqual, count)
+		for i := 0; i < count; i++ {
+			So(torrents.get(testInfoHash(benchmarkInfoHash(i))).peers, ShouldHaveLength, goroutines)
+		}
+		shouldMatchRecount(torrents)
+	})
+}
+
+// recount counts the seeders and leechers of the torrent peer by peer
+func recount(t *trackerTorrent) (complete, incomplete int) {
+	for _, p := range t.peers {
+		if p.isComplete() {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return
+}
+
+// shouldMatchRecount checks the peer counters of every torrent
+func shouldMatchRecount(torrents *trackerTorrents) {
+	torrents.each(func(infoHash InfoHash, torrent *trackerTorrent) {
+		torrent.m.RLock()
+		defer torrent.m.RUnlock()
+		complete, incomplete := torrent.countPeers()
+		wantComplete, wantIncomplete := recount(torrent)
+		So(complete, ShouldEqual, wantComplete)
+		So(incomplete, ShouldEqual, wantIncomplete)
+	})
+}
+
+func TestPeerCounters(t *testing.T) {
+	Convey("Peer counters match a recount", t, func() {
+		dir, err := ioutil.TempDir("", "counters")
+		So(err, ShouldBeNil)
+		defer os.RemoveAll(dir)
+		s, err := NewFileStorage(dir)
+		So(err, ShouldBeNil)
+		defer func() { s.Close() }()
+		torrents := NewTrackerTorrents()
+		So(torrents.restore(s, time.Now()), ShouldBeNil)
+
+		primary, alias := testInfoHash("primary"), testInfoHash("alias")
+		So(torrents.register(primary, "primary"), ShouldBeNil)
+		r := rand.New(rand.NewSource(1))
+		now := time.Now()
+		events := []string{"", "", "started", "completed", "stopped"}
+		lefts := []uint64{0, 0, 10, 100}
+		keys := []string{"", "", "k1", "k2"}
+		for i := 0; i < 3000; i++ {
+			now = now.Add(time.Minute)
+			switch op := r.Intn(20); {
+			case op < 16:
+				infoHash := primary
+				if r.Intn(3) == 0 {
+					infoHash = alias
+				}
+				params := announceParams{
+					infoHash: infoHash,
+					peerID:   testPeerID(fmt.Sprintf("peer%d", r.Intn(20))),
+					port:     7000 + r.Intn(3),
+					left:     lefts[r.Intn(len(lefts))],
+					event:    events[r.Intn(len(events))],
+					key:      keys[r.Intn(len(keys))],
+					numWant:  5,
+				}
+				if r.Intn(4) == 0 {
+					params.ipv6 = fmt.Sprintf("2001:db8::%d", r.Intn(4))
+				}
+				addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, byte(r.Intn(4))), Port: params.port}
+				_, err := torrents.handleAnnounce(now, addr, &params, make(bmap))
+				So(err, ShouldBeNil)
+			case op < 18:
+				torrents.reap(now.Add(-time.Duration(r.Intn(60)) * time.Minute))
+			case op < 19:
+				if torrent := torrents.get(primary); torrent != nil {
+					torrent.m.Lock()
+					for key := range torrent.peers {
+						torrent.removePeer(key)
+						break
+					}
+					torrent.m.Unlock()
+				}
+			default:
+				if torrents.resolve(alias) == alias && torrents.get(alias) != nil {
+					So(torrents.link(primary, alias), ShouldBeNil)
+				}
+			}
+			shouldMatchRecount(torrents)
+		}
+		So(torrents.get(primary).peers, ShouldNotBeEmpty)
+
+		restore := func() {
+			torrents.stopJournal()
+			So(s.Close(), ShouldBeNil)
+			s, err = NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			restored := NewTrackerTorrents()
+			So(restored.restore(s, now.Add(-time.Hour)), ShouldBeNil)
+			shouldMatchRecount(restored)
+			So(restored.get(primary).peers, ShouldNotBeEmpty)
+		}
+		Convey("after replaying the journal", func() {
+			restore()
+		})
+		Convey("after restoring a snapshot", func() {
+			So(torrents.snapshot(), ShouldBeNil)
+			restore()
+		})
+	})
+}
+
+func TestLinks(t *testing.T) {
+	Convey("Linked info hashes", t, func() {
+		torrents := NewTrackerTorrents()
+		now := time.Now()
+		v1, v2 := testInfoHash("v1 info hash 0123456"), testInfoHash("v2 info hash 0123456")
+		announce := func(infoHash InfoHash, peer byte) bmap {
+			params := announceParams{infoHash: infoHash, peerID: testPeerID(string([]byte{'p', peer})), port: 6881, compact: true, numWant: 10}
+			response := make(bmap)
+			_, err := torrents.handleAnnounce(now, &net.TCPAddr{IP: net.IPv4(10, 0, 0, peer), Port: 6881}, &params, response)
+			So(err, ShouldBeNil)
+			return response
+		}
+		So(torrents.register(v1, "hybrid"), ShouldBeNil)
+		announce(v1, 1)
+		announce(v2, 2)
+		So(torrents.count(), ShouldEqual, 2)
+
+		So(torrents.link(v1, v2), ShouldBeNil)
+		So(torrents.count(), ShouldEqual, 1)
+		So(torrents.get(v2), ShouldEqual, torrents.get(v1))
+
+		Convey("Peers of both hashes share the swarm", func() {
+			So(torrents.get(v1).peers, ShouldHaveLength, 2)
+			So(announce(v2, 3)[paramPeers], ShouldHaveLength, 2*6)
+			So(announce(v1, 4)[paramPeers], ShouldHaveLength, 3*6)
+		})
+		Convey("Scrapes answer under either hash", func() {
+			files := torrents.scrape([]InfoHash{v1, v2})
+			So(files, ShouldContainKey, string(v1[:]))
+			So(files, ShouldContainKey, string(v2[:]))
+			So(files[string(v2[:])].(bmap)[paramComplete], ShouldEqual, 2)
+			So(torrents.scrape(nil), ShouldHaveLength, 1)
+		})
+		Convey("Linking is idempotent", func() {
+			So(torrents.link(v1, v2), ShouldBeNil)
+		})
+		Convey("Conflicting links fail", func() {
+			other := testInfoHash("other info hash 0123")
+			So(torrents.register(other, "other"), ShouldBeNil)
+			So(torrents.link(other, v2), ShouldNotBeNil)
+			So(torrents.link(v2, other), ShouldNotBeNil)
+			So(torrents.link(other, v1), ShouldNotBeNil)
+			So(torrents.link(other, other), ShouldNotBeNil)
+			So(torrents.register(v2, "v2"), ShouldNotBeNil)
+			auto := testInfoHash("auto info hash 01234")
+			announce(auto, 5)
+			So(torrents.link(auto, testInfoHash("unused")), ShouldNotBeNil)
+			So(torrents.link(testInfoHash("unknown"), testInfoHash("unused")), ShouldNotBeNil)
+		})
+		Convey("Unregistering either hash removes the links", func() {
+			So(torrents.unregister(v2), ShouldBeNil)
+			So(torrents.get(v1), ShouldBeNil)
+			So(torrents.get(v2), ShouldBeNil)
+			announce(v2, 3)
+			So(torrents.get(v2).auto, ShouldBeTrue)
+		})
+	})
+}
@@ -1,34 +1,93 @@
 package cytracker
 
 import (
+	"context"
+	crand "crypto/rand"
+	"crypto/tls"
 	"fmt"
-	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"path"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
-
-	"github.com/jackpal/Taipei-Torrent/torrent"
 )
 
 const (
 	defaultAddr     = ":80"
 	defaultAnnounce = "/"
 	announcePath    = "/announce"
+	defaultInterval = 30 * time.Minute
+
+	defaultShutdownTimeout = 10 * time.Second
 )
 
 type Tracker struct {
 	Announce string
 	Addr     string
-	ID       string
-	done     chan struct{}
-	m        sync.Mutex // Protects l and t
-	l        net.Listener
-	torrents trackerTorrents
+	// UDPAddr is the address of the UDP tracker (BEP 15) listener, disabled if blank
+	UDPAddr string
+	// Storage persists swarm state across restarts if set
+	Storage Storage
+	// Users makes the tracker private, accepting only announces with a
+	// known passkey in the URL
+	Users UserStore
+	// AdminAddr is the address of the administrative JSON API listener,
+	// disabled if blank. Requests must carry AdminToken as a bearer token.
+	AdminAddr  string
+	AdminToken string
+	// Limits can be changed with SetLimits while serving
+	Limits
+	lm sync.RWMutex // Protects Limits
+	// TrustedProxies are the reverse proxies whose X-Forwarded-For and
+	// X-Real-IP headers give the addresses of clients
+	TrustedProxies []*net.IPNet
+	// ProxyProtocol reads a PROXY protocol header, v1 or v2, at the start of
+	// HTTP connections from TrustedProxies
+	ProxyProtocol bool
+	// ClientIP decides when the addresses clients announce are used, always
+	// by default
+	ClientIP ClientIPPolicy
+	// TLSCertFile and TLSKeyFile make Serve and ListenAndServe speak HTTPS.
+	// They are read again on SIGHUP and when they change.
+	TLSCertFile string
+	TLSKeyFile  string
+	// TLSClientCAFile requires HTTPS clients to present a certificate
+	// signed by one of the CAs in the file
+	TLSClientCAFile string
+	// ShutdownTimeout is how long Run waits for in-flight requests when
+	// interrupted, 10 seconds if zero
+	ShutdownTimeout time.Duration
+	// TorrentDir is a directory whose .torrent files are registered while
+	// serving, and unregistered when they disappear. Not watched if blank.
+	TorrentDir string
+	// TorrentDirInterval is how often TorrentDir is scanned, 10 seconds if
+	// zero
+	TorrentDirInterval time.Duration
+	ID                 string
+	m                  sync.Mutex    // Protects done, stopped, launched, server, adminServer, addr, udp and certs
+	done               chan struct{} // closed when stopping starts
+	stopped            chan struct{} // closed when stopping is complete
+	launched           chan struct{} // closed when launch returns
+	launchErr          error         // of launch, set before launched is closed
+	server             *http.Server
+	adminServer        *http.Server
+	addr               net.Addr // of the HTTP listener
+	udp                net.PacketConn
+	certs              *certificates          // of HTTPS, nil for HTTP
+	serving            sync.WaitGroup         // UDP serving, reaper and watcher goroutines
+	fm                 sync.Mutex             // Protects fileList and files
+	fileList           []string               // torrent files given to LoadTorrentFiles
+	files              map[string]torrentFile // loaded torrent files
+	fullScrapes        fullScrapes
+	announceLimiter    ipRateLimiter
+	udpConnections     udpConnections
+	torrents           *trackerTorrents
+	metrics            *trackerMetrics
+	log                logger
 }
 
 type bmap map[string]interface{}
@@ -48,76 +107,335 @@ func randomString(s string, n int) string {
 
 // Start a tracker and run it until interrupted.
 func StartTracker(addr string, torrentFiles []string) (err error) {
-	quitChan := listenSigInt()
-	return startStoppableTracker(addr, torrentFiles, quitChan)
+	t := NewTracker()
+	t.Addr = addr
+	return t.Run(torrentFiles)
+}
+
+// Run registers torrentFiles and serves until SIGINT or SIGTERM, which shut the
+// tracker down gracefully. SIGHUP rescans torrentFiles.
+func (t *Tracker) Run(torrentFiles []string) (err error) {
+	return t.RunWithReload(torrentFiles, nil)
+}
+
+// RunWithReload is Run calling reload on SIGHUP instead of rescanning
+// torrentFiles, if reload is not nil
+func (t *Tracker) RunWithReload(torrentFiles []string, reload func()) (err error) {
+	return t.runStoppable(torrentFiles, listenSignals(), reload)
 }
 
 func startStoppableTracker(addr string, torrents []string, stop chan os.Signal) (err error) {
 	t := NewTracker()
 	t.Addr = addr
-	for _, torrentFile := range torrents {
-		var metaInfo *torrent.MetaInfo
-		metaInfo, err = torrent.GetMetaInfo(nil, torrentFile)
-		if err != nil {
+	return t.runStoppable(torrents, stop, nil)
+}
+
+func (t *Tracker) runStoppable(torrentFiles []string, signals chan os.Signal, reload func()) (err error) {
+	if err = t.LoadTorrentFiles(torrentFiles); err != nil {
+		return
+	}
+	if reload == nil {
+		reload = func() {
+			// errors are logged, the torrents of broken files stay registered
+			t.LoadTorrentFiles(torrentFiles)
+		}
+	}
+	quit := make(chan struct{})
+	go t.handleSignals(signals, quit, reload)
+	err = t.ListenAndServe()
+	close(quit)
+	return
+}
+
+// handleSignals shuts the tracker down on SIGINT, SIGTERM or when signals is
+// closed, and calls reload on SIGHUP. It stops relaying signals to signals when
+// it returns, which it also does once quit is closed.
+func (t *Tracker) handleSignals(signals chan os.Signal, quit <-chan struct{}, reload func()) {
+	defer signal.Stop(signals)
+	for {
+		var sig os.Signal
+		select {
+		case <-quit:
 			return
+		case sig = <-signals:
 		}
-		name := metaInfo.Info.Name
-		if name == "" {
-			name = path.Base(torrentFile)
+		if sig == syscall.SIGHUP {
+			t.log.info("reloading", Field{"signal", sig.String()})
+			if t.certificates() != nil {
+				t.ReloadCertificates()
+			}
+			reload()
+			continue
 		}
-		err = t.Register(metaInfo.InfoHash, name)
-		if err != nil {
-			return
+		if sig == nil {
+			t.log.info("shutting down")
+		} else {
+			t.log.info("shutting down", Field{"signal", sig.String()})
 		}
+		break
+	}
+	timeout := t.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = defaultShutdownTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := t.Shutdown(ctx); err != nil {
+		t.log.error("shutdown failed", errorField(err))
 	}
-	go func() {
-		select {
-		case <-stop:
-			log.Printf("got control-C")
-			t.Quit()
-		}
-	}()
-
-	return t.ListenAndServe()
 }
 
-func listenSigInt() chan os.Signal {
+// listenSignals returns a channel receiving SIGINT, SIGTERM and SIGHUP
+func listenSignals() chan os.Signal {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 	return c
 }
 
 // NewTracker initializes new tracker structure and returns pointer to it
 func NewTracker() *Tracker {
-	return &Tracker{Announce: announcePath, torrents: NewTrackerTorrents()}
+	secret := make([]byte, 20)
+	crand.Read(secret)
+	return &Tracker{
+		Announce:       announcePath,
+		torrents:       NewTrackerTorrents(),
+		metrics:        newTrackerMetrics(),
+		udpConnections: udpConnections{secret: secret},
+	}
 }
 
-// ListenAndServer starts to listen on specified port and blocking until end of operation
+// ListenAndServe listens on Addr and serves until the tracker is shut down,
+// see Serve
 func (t *Tracker) ListenAndServe() (err error) {
+	addr := t.Addr
+	if blank(addr) {
+		addr = defaultAddr
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+	return t.Serve(l)
+}
+
+// Serve serves the announce and scrape requests of Handler on l until the
+// tracker is shut down, then it closes l. It starts the tracker unless Start
+// was called, which is needed to serve several listeners.
+func (t *Tracker) Serve(l net.Listener) (err error) {
+	if t.begin() {
+		err = t.launch()
+	} else {
+		err = t.launchError()
+	}
+	if err != nil {
+		l.Close()
+		return
+	}
+	if t.ProxyProtocol {
+		l = proxyListener{l, t}
+	}
+	if certs := t.certificates(); certs != nil {
+		// the PROXY protocol header precedes the TLS handshake
+		l = tls.NewListener(l, certs.listenerConfig())
+	}
+	t.m.Lock()
+	if t.addr == nil {
+		t.addr = l.Addr()
+	}
+	server := t.server
+	t.m.Unlock()
+	t.log.info("listening", Field{"addr", l.Addr().String()})
+
+	// This statement will not return until there is an error or the tracker
+	// is shut down
+	err = server.Serve(l)
+	if err == http.ErrServerClosed {
+		// waiting for in-flight requests and saving of the state
+		<-t.stopped
+		err = nil
+	}
+	return
+}
+
+// Start restores the saved swarm state, opens the UDP and admin listeners and
+// starts reaping peers and watching TorrentDir. Serve calls it, embedders
+// serving Handler on their own server call it instead, and Shutdown once they
+// stopped serving.
+func (t *Tracker) Start() (err error) {
+	if !t.begin() {
+		return fmt.Errorf("Already started")
+	}
+	return t.launch()
+}
+
+// begin prepares starting the tracker and reports whether it wasn't started
+// yet, then the caller must launch it
+func (t *Tracker) begin() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.done != nil {
+		return false
+	}
 	t.done = make(chan struct{})
+	t.stopped = make(chan struct{})
+	t.launched = make(chan struct{})
+	// the handler is set once the configuration is validated
+	t.server = &http.Server{}
+	if !blank(t.AdminAddr) {
+		t.adminServer = &http.Server{Handler: t.newAdminMux()}
+	}
+	return true
+}
 
+// launch starts the tracker after begin. If it fails, it closes what it opened
+// and Storage once restoring began, and the tracker is done.
+func (t *Tracker) launch() (err error) {
+	var (
+		udp       net.PacketConn
+		admin     net.Listener
+		restoring bool
+	)
+	defer func() {
+		if err != nil {
+			if udp != nil {
+				udp.Close()
+			}
+			if admin != nil {
+				admin.Close()
+			}
+			// Shutdown closes Storage if it was called meanwhile
+			if t.abort() && restoring {
+				t.torrents.stopJournal()
+				t.Storage.Close()
+			}
+		}
+		t.launchErr = err
+		close(t.launched)
+	}()
+	if err = t.Validate(); err != nil {
+		return
+	}
+	t.m.Lock()
+	t.server.Handler = t.Handler()
+	t.m.Unlock()
 	if blank(t.ID) {
 		// generating tracker ID
 		t.ID = randomHexString(20)
 	}
 
-	// starting listening on specified addr
-	addr := t.Addr
-	if blank(addr) {
-		addr = defaultAddr
+	// reading the certificates of HTTPS
+	var certs *certificates
+	if !blank(t.TLSCertFile) {
+		if certs, err = newCertificates(t.TLSCertFile, t.TLSKeyFile, t.TLSClientCAFile); err != nil {
+			return
+		}
+		t.m.Lock()
+		t.certs = certs
+		t.m.Unlock()
 	}
-	var l net.Listener
-	l, err = net.Listen("tcp", addr)
-	if err != nil {
+
+	// opening the UDP and admin listeners if configured, before Storage is
+	// restored so that a failure leaves it untouched
+	if !blank(t.UDPAddr) {
+		if udp, err = net.ListenPacket("udp", t.UDPAddr); err != nil {
+			return
+		}
+	}
+	if !blank(t.AdminAddr) {
+		if admin, err = net.Listen("tcp", t.AdminAddr); err != nil {
+			return
+		}
+	}
+
+	// restoring saved state
+	if t.Storage != nil {
+		restoring = true
+		if err = t.torrents.restore(t.Storage, time.Now().Add(-t.limits().peerTTL())); err != nil {
+			return
+		}
+		t.reconcileTorrentFiles()
+	}
+
+	// saving the UDP listener to tracker, unless shut down while starting
+	t.m.Lock()
+	select {
+	case <-t.done:
+		t.m.Unlock()
+		if udp != nil {
+			udp.Close()
+		}
+		if admin != nil {
+			admin.Close()
+		}
+		<-t.stopped
 		return
+	default:
+	}
+	t.udp = udp
+	if udp != nil {
+		t.background(func() { t.serveUDP(udp) })
+	}
+	// starting reaper cycle, stop waits for it before closing Storage
+	t.background(t.reaper)
+	if !blank(t.TorrentDir) {
+		t.background(t.watchTorrentDir)
+	}
+	if certs != nil {
+		t.background(func() { t.watchCertificates(certs) })
+	}
+	t.m.Unlock()
+
+	if admin != nil {
+		go t.adminServer.Serve(admin)
 	}
+	return
+}
 
-	// saving listener to tracker
+// abort makes the tracker done after launch failed and reports whether it did,
+// it didn't if Shutdown was called meanwhile
+func (t *Tracker) abort() bool {
 	t.m.Lock()
-	t.l = l
+	defer t.m.Unlock()
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	close(t.done)
+	close(t.stopped)
+	return true
+}
+
+// launchError waits until the tracker is launched and returns the error of
+// launch, the tracker must be begun
+func (t *Tracker) launchError() error {
+	t.m.Lock()
+	launched := t.launched
 	t.m.Unlock()
+	<-launched
+	return t.launchErr
+}
 
-	// creating new muxer
+// background runs f in a goroutine that stop waits for. The caller must hold
+// t.m and have checked that the tracker isn't done.
+func (t *Tracker) background(f func()) {
+	t.serving.Add(1)
+	go func() {
+		defer t.serving.Done()
+		f()
+	}()
+}
+
+// Handler returns a handler of the announce and scrape requests, to be served
+// by an embedding server or wrapped in middleware. The routes follow Announce
+// and Users at the time of the call, Limits and the logger apply as they
+// change.
+func (t *Tracker) Handler() http.Handler {
+	return t.newServeMux()
+}
+
+// newServeMux creates a muxer with the announce and scrape handlers
+func (t *Tracker) newServeMux() *http.ServeMux {
 	serveMux := http.NewServeMux()
 	announce := t.Announce
 	if blank(announce) {
@@ -125,74 +443,175 @@ func (t *Tracker) ListenAndServe() (err error) {
 	}
 
 	// setting handlers
+	if t.Users != nil {
+		// private tracker: /<passkey>/announce and /<passkey>/scrape
+		serveMux.HandleFunc("/", t.handlePrivate)
+		return serveMux
+	}
 	serveMux.HandleFunc(announce, t.handleAnnounce)
 	scrape := ScrapePattern(announce)
 	if !blank(scrape) {
 		serveMux.HandleFunc(scrape, t.handleScrape)
 	}
+	return serveMux
+}
 
-	// starting reaper cycle
-	go t.reaper()
+// Quit stops tracker operation immediately, dropping in-flight requests, and
+// saves the swarm state
+func (t *Tracker) Quit() (err error) {
+	return t.stop(nil)
+}
 
-	// This statement will not return until there is an error or the t.l channel is closed
-	err = http.Serve(l, serveMux)
-	if err != nil {
-		select {
-		case <-t.done:
-			// We're finished. Err is probably a "use of closed network connection" error.
-			err = nil
-		default:
-			// Not finished
-		}
-	}
-	return
+// Shutdown stops accepting requests and waits until the in-flight ones are
+// done or ctx expires, then saves the swarm state. ListenAndServe returns once
+// it completes.
+func (t *Tracker) Shutdown(ctx context.Context) (err error) {
+	return t.stop(ctx)
 }
 
-// Quit stops tracker operation
-func (t *Tracker) Quit() (err error) {
+// stop shuts the tracker down, it drops in-flight requests if ctx is nil
+func (t *Tracker) stop(ctx context.Context) (err error) {
+	t.m.Lock()
+	if t.done == nil {
+		t.m.Unlock()
+		return fmt.Errorf("Not started")
+	}
 	select {
 	case <-t.done:
-		err = fmt.Errorf("Already done")
-		return
+		t.m.Unlock()
+		return fmt.Errorf("Already done")
 	default:
 	}
-	t.m.Lock()
-	t.l.Close()
-	t.m.Unlock()
+	// closing done first, so that serving goroutines treat errors from
+	// closed listeners as a normal shutdown
 	close(t.done)
+	server, adminServer, udp := t.server, t.adminServer, t.udp
+	t.m.Unlock()
+	defer close(t.stopped)
+
+	if udp != nil {
+		// unblocking serveUDP, it returns after the request it handles
+		udp.SetReadDeadline(time.Now())
+	}
+	for _, s := range []*http.Server{server, adminServer} {
+		if s == nil {
+			continue
+		}
+		if ctx == nil {
+			s.Close()
+		} else if e := s.Shutdown(ctx); e != nil {
+			// out of time, dropping the remaining requests
+			s.Close()
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	t.serving.Wait()
+	if udp != nil {
+		udp.Close()
+	}
+
+	// flushing the state even if requests were dropped
+	if t.Storage != nil {
+		t.torrents.stopJournal()
+		e := t.torrents.snapshot()
+		if closeErr := t.Storage.Close(); e == nil {
+			e = closeErr
+		}
+		if err == nil {
+			err = e
+		}
+	}
 	return
 }
 
-func (t *Tracker) Register(infoHash, name string) (err error) {
-	log.Printf("Register(%#v,%#v)", infoHash, name)
-	t.m.Lock()
-	defer t.m.Unlock()
+func (t *Tracker) Register(infoHash InfoHash, name string) (err error) {
 	err = t.torrents.register(infoHash, name)
 	return
 }
 
-func (t *Tracker) Unregister(infoHash string) (err error) {
-	t.m.Lock()
-	defer t.m.Unlock()
+func (t *Tracker) Unregister(infoHash InfoHash) (err error) {
 	err = t.torrents.unregister(infoHash)
 	return
 }
 
+// Link tracks the registered torrent infoHash under link too, such as the v1
+// and v2 info hashes of a hybrid torrent (BEP 52). Peers announcing either
+// share one swarm and scrapes answer for both. Unregister removes the links.
+func (t *Tracker) Link(infoHash, link InfoHash) (err error) {
+	err = t.torrents.link(infoHash, link)
+	return
+}
+
+// Validate returns an error if the configuration of the tracker is invalid,
+// ListenAndServe calls it before listening
+func (t *Tracker) Validate() error {
+	if err := t.Limits.validate(); err != nil {
+		return err
+	}
+	switch {
+	case !blank(t.Announce) && !strings.HasPrefix(t.Announce, "/"):
+		return fmt.Errorf("Announce path %#v must start with /", t.Announce)
+	case !blank(t.AdminAddr) && blank(t.AdminToken):
+		return fmt.Errorf("AdminToken is required for the admin API")
+	case t.TorrentDirInterval < 0:
+		return fmt.Errorf("TorrentDirInterval must not be negative")
+	case t.ProxyProtocol && len(t.TrustedProxies) == 0:
+		return fmt.Errorf("ProxyProtocol requires TrustedProxies")
+	case t.ClientIP < 0 || int(t.ClientIP) >= len(clientIPPolicyNames):
+		return fmt.Errorf("Unknown client IP policy %v", t.ClientIP)
+	case blank(t.TLSCertFile) != blank(t.TLSKeyFile):
+		return fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	case !blank(t.TLSClientCAFile) && blank(t.TLSCertFile):
+		return fmt.Errorf("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if !blank(t.TorrentDir) {
+		if info, err := os.Stat(t.TorrentDir); err != nil {
+			return fmt.Errorf("Invalid torrent directory: %v", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("Torrent directory %v is not a directory", t.TorrentDir)
+		}
+	}
+	return nil
+}
+
+// reaper reaps every announce interval until the tracker quits. It snapshots
+// the state after reaping, and when the journal grew long.
 func (t *Tracker) reaper() {
-	checkDuration := 30 * time.Minute
-	reapDuration := 2 * checkDuration
-	ticker := time.Tick(checkDuration)
-	select {
-	case <-t.done:
-		return
-	case <-ticker:
-		t.m.Lock()
-		deadline := time.Now().Add(-reapDuration)
-		t.torrents.reap(deadline)
-		t.m.Unlock()
+	// the interval is read every round, it may have been changed
+	next := time.Now().Add(t.limits().announceInterval())
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-t.done:
+			timer.Stop()
+			return
+		case now := <-timer.C:
+			t.reap(now)
+			next = now.Add(t.limits().announceInterval())
+		case <-t.torrents.snapshotDue:
+			timer.Stop()
+		}
+		if err := t.torrents.snapshot(); err != nil {
+			t.log.error("snapshot failed", errorField(err))
+		}
 	}
 }
 
+// reap removes the peers that haven't announced within the peer TTL and the
+// auto-registered torrents left without peers, and returns their numbers. IP
+// addresses whose announce rate limit refilled are forgotten.
+func (t *Tracker) reap(now time.Time) (peers, torrents int) {
+	limits := t.limits()
+	peers, torrents = t.torrents.reap(now.Add(-limits.peerTTL()))
+	t.announceLimiter.reap(now, limits.AnnounceRate, limits.announceBurst())
+	t.metrics.reaped.add("", uint64(peers))
+	t.metrics.reapedTorrents.add("", uint64(torrents))
+	t.log.info("reaped", Field{"peers", peers}, Field{"torrents", torrents})
+	return
+}
+
 func blank(s string) bool {
 	return len(s) == 0
 }
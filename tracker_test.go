@@ -3,19 +3,26 @@ package cytracker
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
 	"strconv"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/jackpal/Taipei-Torrent/torrent"
+	"github.com/jackpal/bencode-go"
 	. "github.com/smartystreets/goconvey/convey"
 )
 
@@ -413,3 +420,374 @@ func testHelperProcessImp(args []string) (err error) {
 	}
 	return
 }
+
+func TestReap(t *testing.T) {
+	Convey("Reaping", t, func() {
+		tracker := NewTracker()
+		tracker.AnnounceInterval = time.Minute
+		tracker.MinInterval = 30 * time.Second
+		mux := tracker.newServeMux()
+		registered := "registered0123456789"
+		auto := "auto0123456789012345"
+		So(tracker.Register(testInfoHash(registered), "registered"), ShouldBeNil)
+		announce := func(infoHash, peerID string, port int) map[string]interface{} {
+			return get(mux, "/announce?"+announceQuery(infoHash, peerID, port, 0, 0, 0, "started"))
+		}
+		response := announce(auto, "peer", 7000)
+		announce(registered, "peer", 7000)
+
+		Convey("Intervals are sent to clients", func() {
+			So(response["interval"], ShouldEqual, 60)
+			So(response["min interval"], ShouldEqual, 30)
+		})
+		Convey("Keeps peers within the TTL", func() {
+			peers, torrents := tracker.reap(time.Now().Add(tracker.limits().peerTTL() - time.Minute))
+			So(peers, ShouldEqual, 0)
+			So(torrents, ShouldEqual, 0)
+		})
+		Convey("Removes stale peers and empty auto-registered torrents", func() {
+			peers, torrents := tracker.reap(time.Now().Add(tracker.limits().peerTTL() + time.Minute))
+			So(peers, ShouldEqual, 2)
+			So(torrents, ShouldEqual, 1)
+			So(tracker.torrents.get(testInfoHash(auto)), ShouldBeNil)
+			So(tracker.torrents.get(testInfoHash(registered)), ShouldNotBeNil)
+
+			Convey("Dropped torrents are registered again on announce", func() {
+				So(announce(auto, "peer", 7000)["incomplete"], ShouldEqual, 0)
+				So(tracker.torrents.get(testInfoHash(auto)).peers, ShouldHaveLength, 1)
+			})
+		})
+	})
+	Convey("Reaper runs every announce interval", t, func() {
+		tracker := NewTracker()
+		tracker.AnnounceInterval = time.Millisecond
+		tracker.PeerTTL = time.Millisecond
+		tracker.done = make(chan struct{})
+		go tracker.reaper()
+		defer close(tracker.done)
+		for round := 0; round < 2; round++ {
+			infoHash := fmt.Sprintf("%020d", round)
+			get(tracker.newServeMux(), "/announce?"+announceQuery(infoHash, "peer", 7000, 0, 0, 0, "started"))
+			deadline := time.Now().Add(trackerStopTimeOut)
+			for tracker.torrents.get(testInfoHash(infoHash)) != nil && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			So(tracker.torrents.get(testInfoHash(infoHash)), ShouldBeNil)
+		}
+	})
+}
+
+func TestCheckTiming(t *testing.T) {
+	Convey("Announce timing", t, func() {
+		tracker := NewTracker()
+		So(tracker.Validate(), ShouldBeNil)
+		So(tracker.limits().peerTTL(), ShouldEqual, 2*defaultInterval)
+		tracker.MinInterval = time.Hour
+		So(tracker.Validate(), ShouldNotBeNil)
+		tracker.MinInterval = 0
+		tracker.PeerTTL = time.Minute
+		So(tracker.Validate(), ShouldNotBeNil)
+		tracker.AnnounceInterval = time.Second
+		So(tracker.Validate(), ShouldBeNil)
+		tracker.AnnounceInterval = -time.Second
+		So(tracker.Validate(), ShouldNotBeNil)
+	})
+}
+
+func TestNumWant(t *testing.T) {
+	Convey("Number of peers sent to clients", t, func() {
+		tracker := NewTracker()
+		So(tracker.limits().numWant(0), ShouldEqual, defaultPeerCount)
+		So(tracker.limits().numWant(10), ShouldEqual, 10)
+		So(tracker.limits().numWant(1000), ShouldEqual, defaultPeerCount)
+		tracker.NumWant = 20
+		tracker.MaxNumWant = 100
+		So(tracker.limits().numWant(-1), ShouldEqual, 20)
+		So(tracker.limits().numWant(80), ShouldEqual, 80)
+		So(tracker.limits().numWant(1000), ShouldEqual, 100)
+
+		Convey("Limits responses", func() {
+			mux := tracker.newServeMux()
+			infoHash := "01234567890123456789"
+			for port := 7000; port < 7030; port++ {
+				get(mux, "/announce?"+announceQuery(infoHash, fmt.Sprint(port), port, 0, 0, 10, "started"))
+			}
+			response := get(mux, "/announce?"+announceQuery(infoHash, "new", 8000, 0, 0, 10, "started"))
+			So(response["peers"], ShouldHaveLength, 20*6)
+			response = get(mux, "/announce?"+announceQuery(infoHash, "new", 8000, 0, 0, 10, "stopped"))
+			So(response["peers"], ShouldBeEmpty)
+		})
+	})
+}
+
+func TestValidate(t *testing.T) {
+	Convey("Tracker configuration", t, func() {
+		tracker := NewTracker()
+		So(tracker.Validate(), ShouldBeNil)
+		Convey("Announce path", func() {
+			tracker.Announce = "announce"
+			So(tracker.Validate(), ShouldNotBeNil)
+		})
+		Convey("NumWant", func() {
+			tracker.NumWant = 100
+			tracker.MaxNumWant = 10
+			So(tracker.Validate(), ShouldNotBeNil)
+			tracker.MaxNumWant = -1
+			So(tracker.Validate(), ShouldNotBeNil)
+		})
+		Convey("Admin token", func() {
+			tracker.AdminAddr = ":0"
+			So(tracker.Validate(), ShouldNotBeNil)
+			tracker.AdminToken = "token"
+			So(tracker.Validate(), ShouldBeNil)
+		})
+		Convey("Timing", func() {
+			tracker.MinInterval = time.Hour
+			So(tracker.Validate(), ShouldNotBeNil)
+		})
+	})
+}
+
+// blockingUsers is a UserStore whose Authenticate waits for release
+type blockingUsers struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (u *blockingUsers) Authenticate(passkey string) error {
+	u.entered <- struct{}{}
+	<-u.release
+	return nil
+}
+
+func (u *blockingUsers) Account(passkey string, uploaded, downloaded uint64) error {
+	return nil
+}
+
+// startTracker serves tracker in the background and returns its URL and the
+// channel receiving the result of ListenAndServe
+func startTracker(tracker *Tracker) (url string, served chan error) {
+	tracker.Addr = "127.0.0.1:0"
+	served = make(chan error, 1)
+	go func() {
+		served <- tracker.ListenAndServe()
+	}()
+	deadline := time.Now().Add(trackerStopTimeOut)
+	for time.Now().Before(deadline) {
+		tracker.m.Lock()
+		addr := tracker.addr
+		tracker.m.Unlock()
+		if addr != nil {
+			return "http://" + addr.String(), served
+		}
+		time.Sleep(time.Millisecond)
+	}
+	So(timedOutError, ShouldBeNil)
+	return
+}
+
+func TestShutdown(t *testing.T) {
+	Convey("Graceful shutdown", t, func() {
+		dir, err := ioutil.TempDir("", "shutdown")
+		So(err, ShouldBeNil)
+		storage, err := NewFileStorage(dir)
+		So(err, ShouldBeNil)
+		users := &blockingUsers{entered: make(chan struct{}), release: make(chan struct{})}
+		tracker := NewTracker()
+		tracker.Storage = storage
+		tracker.Users = users
+		url, served := startTracker(tracker)
+		infoHash := "01234567890123456789"
+
+		// an announce in flight while shutting down
+		responses := make(chan int, 1)
+		go func() {
+			r, err := http.Get(url + "/secret/announce?" + announceQuery(infoHash, "peer", 7000, 0, 0, 10, "started"))
+			if err != nil {
+				responses <- 0
+				return
+			}
+			r.Body.Close()
+			responses <- r.StatusCode
+		}()
+		<-users.entered
+
+		Convey("Waits for in-flight requests", func() {
+			shutdown := make(chan error, 1)
+			go func() {
+				shutdown <- tracker.Shutdown(context.Background())
+			}()
+			time.Sleep(trackerStartDuration)
+			So(shutdown, ShouldBeEmpty)
+			So(served, ShouldBeEmpty)
+
+			close(users.release)
+			So(<-responses, ShouldEqual, http.StatusOK)
+			So(<-shutdown, ShouldBeNil)
+			So(<-served, ShouldBeNil)
+			So(tracker.Shutdown(context.Background()), ShouldNotBeNil)
+
+			Convey("Saves the state", func() {
+				storage, err := NewFileStorage(dir)
+				So(err, ShouldBeNil)
+				defer storage.Close()
+				state, _, err := storage.Load()
+				So(err, ShouldBeNil)
+				So(state.Torrents, ShouldHaveLength, 1)
+				So(state.Torrents[0].Peers, ShouldHaveLength, 1)
+			})
+		})
+		Convey("Drops requests after the timeout", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), trackerStartDuration)
+			defer cancel()
+			So(tracker.Shutdown(ctx), ShouldEqual, context.DeadlineExceeded)
+			So(<-served, ShouldBeNil)
+			So(<-responses, ShouldEqual, 0)
+			close(users.release)
+		})
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+	})
+}
+
+func TestEmbedding(t *testing.T) {
+	Convey("Embedding the tracker", t, func() {
+		tracker := NewTracker()
+		infoHash := "01234567890123456789"
+		query := "/announce?" + announceQuery(infoHash, "peer", 7000, 0, 0, 10, "started")
+
+		Convey("Handler serves announces behind middleware", func() {
+			var requests int
+			handler := tracker.Handler()
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				handler.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+			So(tracker.Start(), ShouldBeNil)
+			So(tracker.Start(), ShouldNotBeNil)
+
+			So(tracker.SetLimits(Limits{AnnounceInterval: 10 * time.Minute}), ShouldBeNil)
+			r, err := http.Get(server.URL + query)
+			So(err, ShouldBeNil)
+			decoded, err := bencode.Decode(r.Body)
+			r.Body.Close()
+			So(err, ShouldBeNil)
+			So(decoded.(map[string]interface{})["interval"], ShouldEqual, 600)
+			So(requests, ShouldEqual, 1)
+			So(tracker.torrents.get(testInfoHash(infoHash)), ShouldNotBeNil)
+			So(tracker.Shutdown(context.Background()), ShouldBeNil)
+		})
+		Convey("Serve serves given listeners", func() {
+			l1, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			l2, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			So(tracker.Start(), ShouldBeNil)
+			served := make(chan error, 2)
+			for _, l := range []net.Listener{l1, l2} {
+				go func(l net.Listener) {
+					served <- tracker.Serve(l)
+				}(l)
+			}
+			for _, l := range []net.Listener{l1, l2} {
+				r, err := http.Get("http://" + l.Addr().String() + query)
+				So(err, ShouldBeNil)
+				r.Body.Close()
+				So(r.StatusCode, ShouldEqual, http.StatusOK)
+			}
+			So(tracker.Shutdown(context.Background()), ShouldBeNil)
+			So(<-served, ShouldBeNil)
+			So(<-served, ShouldBeNil)
+			_, err = net.Dial("tcp", l1.Addr().String())
+			So(err, ShouldNotBeNil)
+		})
+		Convey("Serve fails with an invalid configuration", func() {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			tracker.Announce = "announce"
+			So(tracker.Serve(l), ShouldNotBeNil)
+			_, err = net.Dial("tcp", l.Addr().String())
+			So(err, ShouldNotBeNil)
+
+			Convey("and so do later calls", func() {
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				So(tracker.Serve(l), ShouldNotBeNil)
+				_, err = net.Dial("tcp", l.Addr().String())
+				So(err, ShouldNotBeNil)
+			})
+		})
+		Convey("A failed start cleans up", func() {
+			dir, err := ioutil.TempDir("", "storage")
+			So(err, ShouldBeNil)
+			defer os.RemoveAll(dir)
+			s, err := NewFileStorage(dir)
+			So(err, ShouldBeNil)
+			tracker.Storage = s
+			udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+			So(err, ShouldBeNil)
+			tracker.UDPAddr = udp.LocalAddr().String()
+			So(udp.Close(), ShouldBeNil)
+
+			Convey("leaving Storage untouched if a listener fails", func() {
+				admin, err := net.Listen("tcp", "127.0.0.1:0")
+				So(err, ShouldBeNil)
+				defer admin.Close()
+				tracker.AdminAddr = admin.Addr().String()
+				So(tracker.Start(), ShouldNotBeNil)
+				So(s.Append(JournalEntry{Op: JournalUnregister, Seq: 1}), ShouldBeNil)
+				So(s.Close(), ShouldBeNil)
+				udp, err := net.ListenPacket("udp", tracker.UDPAddr)
+				So(err, ShouldBeNil)
+				udp.Close()
+				So(tracker.Shutdown(context.Background()), ShouldNotBeNil)
+			})
+			Convey("closing Storage if restoring fails", func() {
+				So(ioutil.WriteFile(filepath.Join(dir, snapshotFile), []byte("corrupt"), 0600), ShouldBeNil)
+				startErr := tracker.Start()
+				So(startErr, ShouldNotBeNil)
+				So(s.Append(JournalEntry{Op: JournalUnregister, Seq: 1}), ShouldNotBeNil)
+				udp, err := net.ListenPacket("udp", tracker.UDPAddr)
+				So(err, ShouldBeNil)
+				udp.Close()
+
+				l, e := net.Listen("tcp", "127.0.0.1:0")
+				So(e, ShouldBeNil)
+				So(tracker.Serve(l), ShouldEqual, startErr)
+			})
+		})
+	})
+}
+
+func TestSignals(t *testing.T) {
+	Convey("Signals", t, func() {
+		tracker := NewTracker()
+		signals := make(chan os.Signal)
+		reloaded := make(chan bool)
+		done := make(chan bool)
+		go func() {
+			tracker.handleSignals(signals, nil, func() { reloaded <- true })
+			done <- true
+		}()
+		signals <- syscall.SIGHUP
+		So(<-reloaded, ShouldBeTrue)
+		_, served := startTracker(tracker)
+		signals <- syscall.SIGTERM
+		So(<-done, ShouldBeTrue)
+		So(<-served, ShouldBeNil)
+	})
+	Convey("Signals are no longer handled once the tracker quits", t, func() {
+		tracker := NewTracker()
+		signals := make(chan os.Signal)
+		quit := make(chan struct{})
+		done := make(chan bool)
+		go func() {
+			tracker.handleSignals(signals, quit, func() {})
+			done <- true
+		}()
+		close(quit)
+		So(<-done, ShouldBeTrue)
+	})
+}
@@ -0,0 +1,252 @@
+package cytracker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// UDP tracker protocol, see http://www.bittorrent.org/beps/bep_0015.html
+
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	udpHeaderSize       = 16
+	udpAnnounceSize     = 98
+	udpMaxPacketSize    = 2048
+	udpMaxScrapeHashes  = 74
+	udpConnectionWindow = time.Minute
+)
+
+// udpEvents maps the BEP 15 event numbers to the HTTP announce event names
+var udpEvents = []string{"", "completed", "started", "stopped"}
+
+// udpConnections issues and validates connection IDs without keeping
+// per-client state. An ID is derived from a secret, the client address and
+// the current time window, and is accepted for up to two windows.
+type udpConnections struct {
+	secret []byte
+}
+
+func (c udpConnections) id(addr *net.UDPAddr, window int64) uint64 {
+	h := sha1.New()
+	h.Write(c.secret)
+	binary.Write(h, binary.BigEndian, window)
+	h.Write(addr.IP)
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+func (c udpConnections) newID(addr *net.UDPAddr, now time.Time) uint64 {
+	return c.id(addr, now.UnixNano()/int64(udpConnectionWindow))
+}
+
+func (c udpConnections) valid(id uint64, addr *net.UDPAddr, now time.Time) bool {
+	window := now.UnixNano() / int64(udpConnectionWindow)
+	return id == c.id(addr, window) || id == c.id(addr, window-1)
+}
+
+// serveUDP reads requests from conn until it is closed
+func (t *Tracker) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, udpMaxPacketSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-t.done:
+				// Closed by Quit
+			default:
+				t.log.error("udp read failed", errorField(err))
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		response := t.handleUDPPacket(time.Now(), buf[:n], udpAddr)
+		if response == nil {
+			continue
+		}
+		if _, err = conn.WriteTo(response, addr); err != nil {
+			t.log.warn("udp write failed", Field{fieldRemoteAddr, addr.String()}, errorField(err))
+		}
+	}
+}
+
+// handleUDPPacket processes a single request and returns the response packet,
+// or nil if the packet should be dropped silently
+func (t *Tracker) handleUDPPacket(now time.Time, packet []byte, addr *net.UDPAddr) []byte {
+	if len(packet) < udpHeaderSize {
+		return nil
+	}
+	var (
+		connectionID  = binary.BigEndian.Uint64(packet[0:8])
+		action        = binary.BigEndian.Uint32(packet[8:12])
+		transactionID = binary.BigEndian.Uint32(packet[12:16])
+		response      []byte
+		err           error
+	)
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		return t.udpConnect(now, transactionID, addr)
+	}
+	if !t.udpConnections.valid(connectionID, addr, now) {
+		err = failure{"connection_id", fmt.Errorf("Invalid connection ID")}
+	} else if t.Users != nil {
+		// there is no passkey in the UDP protocol
+		err = failure{"passkey", fmt.Errorf("Private tracker, announce over HTTP with your passkey")}
+	} else {
+		switch action {
+		case udpActionAnnounce:
+			response, err = t.udpAnnounce(now, transactionID, packet, addr)
+		case udpActionScrape:
+			response, err = t.udpScrape(transactionID, packet)
+		default:
+			err = fmt.Errorf("Unknown action %d", action)
+		}
+	}
+	if err != nil {
+		if action != udpActionAnnounce {
+			t.metrics.failed(err)
+		}
+		t.log.info("udp request failed", Field{fieldRemoteAddr, addr.String()}, Field{"action", action}, errorField(err))
+		return udpError(transactionID, err)
+	}
+	return response
+}
+
+func udpHeader(b *bytes.Buffer, action, transactionID uint32) {
+	binary.Write(b, binary.BigEndian, action)
+	binary.Write(b, binary.BigEndian, transactionID)
+}
+
+func udpError(transactionID uint32, err error) []byte {
+	var b bytes.Buffer
+	udpHeader(&b, udpActionError, transactionID)
+	b.WriteString(err.Error())
+	return b.Bytes()
+}
+
+func (t *Tracker) udpConnect(now time.Time, transactionID uint32, addr *net.UDPAddr) []byte {
+	var b bytes.Buffer
+	udpHeader(&b, udpActionConnect, transactionID)
+	binary.Write(&b, binary.BigEndian, t.udpConnections.newID(addr, now))
+	return b.Bytes()
+}
+
+func (t *Tracker) udpAnnounce(now time.Time, transactionID uint32, packet []byte, addr *net.UDPAddr) (b []byte, err error) {
+	var (
+		start     = time.Now()
+		eventName = "unknown"
+	)
+	defer func() {
+		t.metrics.announced(start, eventName, err)
+	}()
+	if len(packet) < udpAnnounceSize {
+		err = fmt.Errorf("Announce packet too short: %d bytes", len(packet))
+		return
+	}
+	limits := t.limits()
+	if err = t.checkAnnounceRate(addr.IP, now, limits); err != nil {
+		return
+	}
+	var (
+		params            announceParams
+		peerListenAddress *net.TCPAddr
+		response          = make(bmap)
+	)
+	copy(params.infoHash[:], packet[16:36])
+	copy(params.peerID[:], packet[36:56])
+	params.downloaded = binary.BigEndian.Uint64(packet[56:64])
+	params.left = binary.BigEndian.Uint64(packet[64:72])
+	params.uploaded = binary.BigEndian.Uint64(packet[72:80])
+	event := binary.BigEndian.Uint32(packet[80:84])
+	if event >= uint32(len(udpEvents)) {
+		err = fmt.Errorf("Unknown event %d", event)
+		return
+	}
+	params.event = udpEvents[event]
+	eventName = params.event
+	if ip := net.IP(packet[84:88]); !ip.Equal(net.IPv4zero) {
+		params.ip = ip.String()
+	}
+	if key := binary.BigEndian.Uint32(packet[88:92]); key != 0 {
+		params.key = strconv.FormatUint(uint64(key), 16)
+	}
+	params.numWant = limits.numWant(int(int32(binary.BigEndian.Uint32(packet[92:96]))))
+	params.limits = &limits
+	params.clientIP = addr.IP
+	params.port = int(binary.BigEndian.Uint16(packet[96:98]))
+	params.compact = true
+
+	t.applyClientIPPolicy(&params)
+	peerListenAddress, err = newTrackerPeerListenAddress(addr.IP, &params)
+	if err != nil {
+		return
+	}
+	_, err = t.torrents.handleAnnounce(now, peerListenAddress, &params, response)
+	if err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	udpHeader(&buf, udpActionAnnounce, transactionID)
+	binary.Write(&buf, binary.BigEndian, uint32(limits.announceInterval()/time.Second))
+	binary.Write(&buf, binary.BigEndian, uint32(response[paramIncomplete].(int)))
+	binary.Write(&buf, binary.BigEndian, uint32(response[paramComplete].(int)))
+	// peers of the same address family as the request
+	if addr.IP.To4() != nil {
+		buf.WriteString(response[paramPeers].(string))
+	} else {
+		buf.WriteString(response[paramPeers6].(string))
+	}
+	b = buf.Bytes()
+	return
+}
+
+func (t *Tracker) udpScrape(transactionID uint32, packet []byte) (b []byte, err error) {
+	hashes := packet[udpHeaderSize:]
+	if len(hashes) == 0 || len(hashes)%hashSize != 0 {
+		err = fmt.Errorf("Malformed scrape request")
+		return
+	}
+	t.metrics.scrapes.inc("")
+	max := t.limits().maxScrapeHashes()
+	if max > udpMaxScrapeHashes {
+		max = udpMaxScrapeHashes
+	}
+	var infoHashes []InfoHash
+	for i := 0; i < len(hashes) && len(infoHashes) < max; i += hashSize {
+		var infoHash InfoHash
+		copy(infoHash[:], hashes[i:])
+		infoHashes = append(infoHashes, infoHash)
+	}
+	files := t.torrents.scrape(infoHashes)
+
+	var buf bytes.Buffer
+	udpHeader(&buf, udpActionScrape, transactionID)
+	for _, infoHash := range infoHashes {
+		var seeders, completed, leechers uint32
+		if file, ok := files[string(infoHash[:])].(bmap); ok {
+			seeders = uint32(file[paramComplete].(int))
+			completed = uint32(file[paramDownloaded].(uint64))
+			leechers = uint32(file[paramIncomplete].(int))
+		}
+		binary.Write(&buf, binary.BigEndian, seeders)
+		binary.Write(&buf, binary.BigEndian, completed)
+		binary.Write(&buf, binary.BigEndian, leechers)
+	}
+	b = buf.Bytes()
+	return
+}
@@ -0,0 +1,130 @@
+package cytracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func udpConnectRequest(transactionID uint32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint64(udpProtocolID))
+	udpHeader(&b, udpActionConnect, transactionID)
+	return b.Bytes()
+}
+
+func udpAnnounceRequest(connectionID uint64, infoHash, peerID string, left uint64, event uint32, port uint16) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, connectionID)
+	udpHeader(&b, udpActionAnnounce, 2)
+	b.WriteString(infoHash)
+	b.WriteString(peerID)
+	binary.Write(&b, binary.BigEndian, uint64(0)) // downloaded
+	binary.Write(&b, binary.BigEndian, left)
+	binary.Write(&b, binary.BigEndian, uint64(0)) // uploaded
+	binary.Write(&b, binary.BigEndian, event)
+	binary.Write(&b, binary.BigEndian, uint32(0)) // ip
+	binary.Write(&b, binary.BigEndian, uint32(0)) // key
+	binary.Write(&b, binary.BigEndian, int32(-1)) // num_want
+	binary.Write(&b, binary.BigEndian, port)
+	return b.Bytes()
+}
+
+func udpScrapeRequest(connectionID uint64, infoHashes ...string) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, connectionID)
+	udpHeader(&b, udpActionScrape, 3)
+	for _, infoHash := range infoHashes {
+		b.WriteString(infoHash)
+	}
+	return b.Bytes()
+}
+
+func TestUDP(t *testing.T) {
+	Convey("UDP tracker protocol", t, func() {
+		tracker := NewTracker()
+		now := time.Now()
+		addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6881}
+		infoHash := strings.Repeat("h", 20)
+
+		response := tracker.handleUDPPacket(now, udpConnectRequest(1), addr)
+		So(response, ShouldHaveLength, 16)
+		So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionConnect)
+		So(binary.BigEndian.Uint32(response[4:8]), ShouldEqual, 1)
+		connectionID := binary.BigEndian.Uint64(response[8:16])
+
+		Convey("Connect with wrong protocol ID is dropped", func() {
+			request := udpConnectRequest(1)
+			request[0] = 1
+			So(tracker.handleUDPPacket(now, request, addr), ShouldBeNil)
+		})
+		Convey("Connection ID", func() {
+			Convey("Is valid for the next window", func() {
+				later := now.Add(udpConnectionWindow)
+				request := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("a", 20), 0, 2, 7000)
+				response := tracker.handleUDPPacket(later, request, addr)
+				So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionAnnounce)
+			})
+			Convey("Expires", func() {
+				later := now.Add(3 * udpConnectionWindow)
+				request := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("a", 20), 0, 2, 7000)
+				response := tracker.handleUDPPacket(later, request, addr)
+				So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionError)
+			})
+			Convey("Is bound to client address", func() {
+				other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6881}
+				request := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("a", 20), 0, 2, 7000)
+				response := tracker.handleUDPPacket(now, request, other)
+				So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionError)
+				So(string(response[8:]), ShouldEqual, "Invalid connection ID")
+			})
+		})
+		Convey("Announce and scrape", func() {
+			seed := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("s", 20), 0, 2, 7000)
+			response := tracker.handleUDPPacket(now, seed, addr)
+			So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionAnnounce)
+			So(binary.BigEndian.Uint32(response[4:8]), ShouldEqual, 2)
+			So(binary.BigEndian.Uint32(response[8:12]), ShouldEqual, uint32(defaultInterval/time.Second))
+			So(binary.BigEndian.Uint32(response[12:16]), ShouldEqual, 0) // leechers
+			So(binary.BigEndian.Uint32(response[16:20]), ShouldEqual, 1) // seeders
+			So(response, ShouldHaveLength, 20)
+
+			leech := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("l", 20), 100, 2, 7001)
+			response = tracker.handleUDPPacket(now, leech, addr)
+			So(binary.BigEndian.Uint32(response[12:16]), ShouldEqual, 1)
+			So(binary.BigEndian.Uint32(response[16:20]), ShouldEqual, 1)
+			So(response, ShouldHaveLength, 26)
+			So(net.IP(response[20:24]).String(), ShouldEqual, "127.0.0.1")
+			So(binary.BigEndian.Uint16(response[24:26]), ShouldEqual, 7000)
+
+			Convey("Scrape reports counters", func() {
+				completed := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("l", 20), 0, 1, 7001)
+				tracker.handleUDPPacket(now, completed, addr)
+
+				unknown := strings.Repeat("u", 20)
+				response := tracker.handleUDPPacket(now, udpScrapeRequest(connectionID, infoHash, unknown), addr)
+				So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionScrape)
+				So(binary.BigEndian.Uint32(response[4:8]), ShouldEqual, 3)
+				So(response, ShouldHaveLength, 8+2*12)
+				So(binary.BigEndian.Uint32(response[8:12]), ShouldEqual, 2)  // seeders
+				So(binary.BigEndian.Uint32(response[12:16]), ShouldEqual, 1) // completed
+				So(binary.BigEndian.Uint32(response[16:20]), ShouldEqual, 0) // leechers
+				So(bytes.Equal(response[20:32], make([]byte, 12)), ShouldBeTrue)
+			})
+			Convey("Malformed scrape is an error", func() {
+				response := tracker.handleUDPPacket(now, udpScrapeRequest(connectionID, "short"), addr)
+				So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionError)
+			})
+		})
+		Convey("Truncated announce is an error", func() {
+			request := udpAnnounceRequest(connectionID, infoHash, strings.Repeat("a", 20), 0, 2, 7000)
+			response := tracker.handleUDPPacket(now, request[:50], addr)
+			So(binary.BigEndian.Uint32(response[0:4]), ShouldEqual, udpActionError)
+		})
+	})
+}